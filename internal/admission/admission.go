@@ -0,0 +1,189 @@
+// Package admission limits how many image jobs run at once.
+package admission
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+
+	"fars/internal/config"
+)
+
+var (
+	// ErrQueueFull is returned when every slot is busy and the queue is full.
+	ErrQueueFull = errors.New("processing queue is full")
+	// ErrQueueTimeout is returned when a job waited too long for a slot.
+	ErrQueueTimeout = errors.New("timed out waiting for a processing slot")
+)
+
+// Controller is a weighted, FIFO semaphore with a bounded wait queue. A nil
+// controller admits every job.
+type Controller struct {
+	slots      int64
+	queueSize  int
+	timeout    time.Duration
+	jobPixels  int64
+	retryAfter time.Duration
+
+	mu      sync.Mutex
+	used    int64
+	waiters list.List // of *waiter
+	stats   Stats
+}
+
+// Stats reports admission counters. InUse (occupied slots) and Queued
+// (waiting jobs) are current values; the rest count since startup.
+type Stats struct {
+	InUse    int64
+	Queued   int64
+	Admitted int64
+	Rejected int64
+	TimedOut int64
+}
+
+type waiter struct {
+	weight int64
+	ready  chan struct{}
+}
+
+// New creates a controller from the admission config section.
+func New(cfg *config.Config) *Controller {
+	a := cfg.Admission
+	slots := int64(a.MaxJobs)
+	if slots <= 0 {
+		slots = int64(runtime.GOMAXPROCS(0))
+	}
+	return &Controller{
+		slots:      slots,
+		queueSize:  a.QueueSize,
+		timeout:    a.QueueTimeout.Duration,
+		jobPixels:  a.JobPixels,
+		retryAfter: a.RetryAfter.Duration,
+	}
+}
+
+// Weight returns the number of slots a job over a source of the given pixel
+// count occupies: one, or one per job_pixels when weighting is enabled.
+func (c *Controller) Weight(pixels int64) int64 {
+	if c == nil || c.jobPixels <= 0 || pixels <= 0 {
+		return 1
+	}
+	weight := (pixels + c.jobPixels - 1) / c.jobPixels
+	return min(weight, c.slots)
+}
+
+// RetryAfter is the back-off suggested to rejected clients.
+func (c *Controller) RetryAfter() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return c.retryAfter
+}
+
+// Acquire waits for weight slots and returns the function releasing them.
+// Jobs are admitted in arrival order, so a heavy job is not starved by a
+// stream of light ones.
+func (c *Controller) Acquire(ctx context.Context, weight int64) (func(), error) {
+	if c == nil {
+		return func() {}, nil
+	}
+	weight = max(1, min(weight, c.slots))
+
+	c.mu.Lock()
+	if c.waiters.Len() == 0 && c.used+weight <= c.slots {
+		c.used += weight
+		c.stats.Admitted++
+		c.mu.Unlock()
+		return c.releaser(weight), nil
+	}
+	if c.waiters.Len() >= c.queueSize {
+		c.stats.Rejected++
+		c.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &waiter{weight: weight, ready: make(chan struct{})}
+	elem := c.waiters.PushBack(w)
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if c.timeout > 0 {
+		timer := time.NewTimer(c.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		return c.releaser(weight), nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = ErrQueueTimeout
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-w.ready:
+		// Admitted while giving up; keep the slots rather than leak them.
+		return c.releaser(weight), nil
+	default:
+	}
+	if errors.Is(err, ErrQueueTimeout) {
+		c.stats.TimedOut++
+	}
+	front := c.waiters.Front() == elem
+	c.waiters.Remove(elem)
+	if front {
+		// Jobs queued behind this one may fit now.
+		c.admitWaiters()
+	}
+	return nil, err
+}
+
+func (c *Controller) releaser(weight int64) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.used -= weight
+			c.admitWaiters()
+		})
+	}
+}
+
+// admitWaiters hands free slots to queued jobs in order. c.mu must be held.
+func (c *Controller) admitWaiters() {
+	for {
+		front := c.waiters.Front()
+		if front == nil {
+			return
+		}
+		w := front.Value.(*waiter)
+		if c.used+w.weight > c.slots {
+			return
+		}
+		c.used += w.weight
+		c.stats.Admitted++
+		c.waiters.Remove(front)
+		close(w.ready)
+	}
+}
+
+// Stats returns a snapshot of the admission counters.
+func (c *Controller) Stats() Stats {
+	if c == nil {
+		return Stats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.InUse = c.used
+	stats.Queued = int64(c.waiters.Len())
+	return stats
+}
@@ -0,0 +1,116 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"fars/internal/config"
+)
+
+func newTestController(maxJobs, queueSize int, timeout time.Duration, jobPixels int64) *Controller {
+	cfg := &config.Config{}
+	cfg.Admission = config.AdmissionConfig{
+		MaxJobs:      maxJobs,
+		QueueSize:    queueSize,
+		QueueTimeout: config.Duration{Duration: timeout},
+		JobPixels:    jobPixels,
+	}
+	return New(cfg)
+}
+
+func TestWeight(t *testing.T) {
+	c := newTestController(4, 0, 0, 1_000_000)
+	tests := map[int64]int64{
+		0:          1,
+		640 * 480:  1,
+		1_000_001:  2,
+		24_000_000: 4, // capped at max_jobs
+	}
+	for pixels, expected := range tests {
+		if got := c.Weight(pixels); got != expected {
+			t.Fatalf("Weight(%d) = %d, expected %d", pixels, got, expected)
+		}
+	}
+	if got := newTestController(4, 0, 0, 0).Weight(24_000_000); got != 1 {
+		t.Fatalf("unweighted controller returned %d", got)
+	}
+}
+
+func TestAcquireQueuesInOrder(t *testing.T) {
+	c := newTestController(2, 2, 0, 0)
+	releaseFirst, err := c.Acquire(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	releaseSecond, _ := c.Acquire(context.Background(), 1)
+
+	// A heavy job queues first; a light one behind it must not overtake it.
+	order := make(chan string, 2)
+	acquire := func(name string, weight int64) {
+		release, err := c.Acquire(context.Background(), weight)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			return
+		}
+		order <- name
+		release()
+	}
+	go acquire("heavy", 2)
+	waitQueued(t, c, 1)
+	go acquire("light", 1)
+	waitQueued(t, c, 2)
+
+	if _, err := c.Acquire(context.Background(), 1); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+
+	releaseFirst()
+	select {
+	case name := <-order:
+		t.Fatalf("%s admitted before the heavy job had room", name)
+	case <-time.After(20 * time.Millisecond):
+	}
+	releaseSecond()
+	if first, second := <-order, <-order; first != "heavy" || second != "light" {
+		t.Fatalf("unexpected order: %s, %s", first, second)
+	}
+
+	stats := c.Stats()
+	if stats.Admitted != 4 || stats.Rejected != 1 || stats.InUse != 0 || stats.Queued != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestAcquireTimesOut(t *testing.T) {
+	c := newTestController(1, 1, 10*time.Millisecond, 0)
+	release, _ := c.Acquire(context.Background(), 1)
+	if _, err := c.Acquire(context.Background(), 1); !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("expected ErrQueueTimeout, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Acquire(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	release()
+
+	if stats := c.Stats(); stats.TimedOut != 1 || stats.InUse != 0 || stats.Queued != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if _, err := c.Acquire(context.Background(), 1); err != nil {
+		t.Fatalf("expected a free slot, got %v", err)
+	}
+}
+
+func waitQueued(t *testing.T, c *Controller, queued int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for c.Stats().Queued != queued {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued jobs", queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
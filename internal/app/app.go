@@ -7,6 +7,7 @@ import (
 	"os"
 	"runtime"
 
+	"fars/internal/admission"
 	"fars/internal/cache"
 	"fars/internal/config"
 	"fars/internal/httpapi"
@@ -32,6 +33,7 @@ func Build(cfg *config.Config) *fx.App {
 			cache.NewManager,
 			processor.New,
 			locker.New,
+			admission.New,
 			httpapi.NewHandler,
 		),
 		server.Module,
@@ -4,10 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -17,15 +19,33 @@ import (
 	"fars/pkg/human"
 )
 
+// staleTempAge is how old a temporary file left by writeFileAtomic must be
+// before cleanup treats it as abandoned by a crashed write and removes it.
+// Writes in flight finish well within it.
+const staleTempAge = time.Hour
+
 // Manager handles cache lookups and maintenance.
 type Manager struct {
 	cfg    *config.Config
 	logger *slog.Logger
+	meta   *metaIndex
+	// usage is nil unless cache.max_size or cache.max_files is set.
+	usage    *usageTracker
+	evicting atomic.Bool
+	// memory is nil unless cache.memory_size is set.
+	memory *memoryTier
 }
 
 // NewManager creates a cache manager bound to configuration.
 func NewManager(cfg *config.Config, logger *slog.Logger) *Manager {
-	return &Manager{cfg: cfg, logger: logger.With("component", "cache")}
+	m := &Manager{cfg: cfg, logger: logger.With("component", "cache"), meta: newMetaIndex(metaIndexCapacity)}
+	if cfg.Cache.MaxSize.Bytes > 0 || cfg.Cache.MaxFiles > 0 {
+		m.usage = newUsageTracker(cfg.Cache.Eviction)
+	}
+	if cfg.Cache.MemorySize.Bytes > 0 {
+		m.memory = newMemoryTier(cfg.Cache.MemorySize.Bytes)
+	}
+	return m
 }
 
 // EnsureParent ensures the cache directory for the target file exists.
@@ -37,39 +57,82 @@ func (m *Manager) EnsureParent(path string) error {
 	return os.MkdirAll(dir, 0o755)
 }
 
-// IsFresh determines whether cached file is still valid.
-func (m *Manager) IsFresh(cachePath string, originalInfo os.FileInfo) bool {
+// IsFresh determines whether cached file is still valid. Variants with
+// metadata must match the source's exact mtime and size and, when settings is
+// non-empty, the settings fingerprint they were rendered with; older entries
+// fall back to comparing modification times.
+func (m *Manager) IsFresh(cachePath string, originalInfo os.FileInfo, settings string) bool {
 	info, err := os.Stat(cachePath)
 	if err != nil {
 		return false
 	}
 	ttl := m.cfg.Cache.TTL.Duration
-	if originalInfo != nil && !originalInfo.ModTime().IsZero() && originalInfo.ModTime().After(info.ModTime()) {
+	if ttl > 0 && time.Since(info.ModTime()) > ttl {
 		return false
 	}
-	if ttl > 0 && time.Since(info.ModTime()) > ttl {
+	if meta, ok := m.storedMetadata(cachePath, info); ok {
+		return meta.matches(originalInfo, settings)
+	}
+	if originalInfo != nil && !originalInfo.ModTime().IsZero() && originalInfo.ModTime().After(info.ModTime()) {
 		return false
 	}
 	return true
 }
 
-// Write stores bytes to cache respecting file permissions.
-func (m *Manager) Write(cachePath string, payload []byte) error {
+// Write stores bytes to cache respecting file permissions, together with a
+// metadata sidecar. The ETag and creation time are filled in from the payload.
+func (m *Manager) Write(cachePath string, payload []byte, meta Metadata) error {
 	if err := m.EnsureParent(cachePath); err != nil {
 		return fmt.Errorf("ensure cache dir: %w", err)
 	}
-	tmp := cachePath + ".tmp"
-	if err := os.WriteFile(tmp, payload, 0o644); err != nil {
+	if err := writeFileAtomic(cachePath, payload); err != nil {
+		return err
+	}
+	meta.ETag = ContentETag(payload)
+	meta.CreatedAt = time.Now().UTC()
+	if m.memory != nil {
+		m.memory.put(cachePath, payload, meta)
+	}
+	if err := writeMetadata(MetadataPath(cachePath), meta); err != nil {
+		return err
+	}
+	if info, err := os.Stat(cachePath); err == nil {
+		m.meta.store(cachePath, info, meta, true)
+		if m.usage != nil {
+			m.usage.add(cachePath, info.Size()+m.sidecarSize(cachePath), time.Now())
+			m.evictIfNeeded(cachePath)
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data through a uniquely named temporary
+// file next to it, so concurrent writers of the same path never share one.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
 		return fmt.Errorf("write temp file: %w", err)
 	}
-	if err := os.Rename(tmp, cachePath); err != nil {
-		_ = os.Remove(tmp)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		_ = os.Remove(tmp.Name())
 		return fmt.Errorf("rename temp file: %w", err)
 	}
 	return nil
 }
 
-// ServeFileStats obtains file info for a cached entry.
+// ServeFileStats obtains file info for a cached entry and records the access
+// for eviction.
 func (m *Manager) ServeFileStats(cachePath string) (os.FileInfo, *os.File, error) {
 	file, err := os.Open(cachePath)
 	if err != nil {
@@ -80,13 +143,76 @@ func (m *Manager) ServeFileStats(cachePath string) (os.FileInfo, *os.File, error
 		file.Close()
 		return nil, nil, err
 	}
+	if m.usage != nil {
+		m.usage.touch(cachePath, time.Now())
+	}
 	return info, file, nil
 }
 
-// StartCleanup launches periodic cleanup until the context is cancelled.
+// Memory returns a variant from the in-memory tier when it is present and
+// still fresh for the original and settings (see IsFresh).
+func (m *Manager) Memory(cachePath string, originalInfo os.FileInfo, settings string) ([]byte, Metadata, bool) {
+	if m.memory == nil {
+		return nil, Metadata{}, false
+	}
+	entry, ok := m.memory.get(cachePath)
+	if ok && !entry.meta.matches(originalInfo, settings) {
+		m.memory.remove(cachePath)
+		ok = false
+	}
+	if ok {
+		if ttl := m.cfg.Cache.TTL.Duration; ttl > 0 && time.Since(entry.meta.CreatedAt) > ttl {
+			m.memory.remove(cachePath)
+			ok = false
+		}
+	}
+	if !ok {
+		m.memory.misses.Add(1)
+		return nil, Metadata{}, false
+	}
+	m.memory.hits.Add(1)
+	if m.usage != nil {
+		m.usage.touch(cachePath, time.Now())
+	}
+	return entry.payload, entry.meta, true
+}
+
+// Promote loads an open cache file into the in-memory tier and returns its
+// payload. It declines when the tier is disabled, the file is too large, or
+// the entry has no recorded metadata to check freshness against.
+func (m *Manager) Promote(cachePath string, info os.FileInfo, file io.ReaderAt, meta Metadata) ([]byte, bool) {
+	if m.memory == nil || meta.SourceMTime.IsZero() || !m.memory.fits(info.Size()) {
+		return nil, false
+	}
+	payload := make([]byte, info.Size())
+	if _, err := file.ReadAt(payload, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, false
+	}
+	m.memory.put(cachePath, payload, meta)
+	return payload, true
+}
+
+// MemoryStats reports hit/miss counters and size of the in-memory tier.
+func (m *Manager) MemoryStats() MemoryStats {
+	if m.memory == nil {
+		return MemoryStats{}
+	}
+	return m.memory.stats()
+}
+
+// StartCleanup launches periodic cleanup until the context is cancelled. When
+// size limits are configured, the cache is also scanned once to seed usage
+// tracking (cleanup passes seed it otherwise).
 func (m *Manager) StartCleanup(ctx context.Context) {
 	interval := m.cfg.Cache.CleanupInterval.Duration
 	if interval <= 0 {
+		if m.usage != nil {
+			go func() {
+				if err := m.seedUsage(ctx); err != nil {
+					m.logger.Error("cache usage scan failed", slog.Any("error", err))
+				}
+			}()
+		}
 		return
 	}
 	ticker := time.NewTicker(interval)
@@ -108,6 +234,28 @@ func (m *Manager) StartCleanup(ctx context.Context) {
 	}()
 }
 
+// StartStatsLog logs cache usage and the memory tier counters every
+// cache.stats_interval until the context is cancelled. Nothing is logged
+// when neither size limits nor the memory tier are configured.
+func (m *Manager) StartStatsLog(ctx context.Context) {
+	interval := m.cfg.Cache.StatsInterval.Duration
+	if interval <= 0 || (m.usage == nil && m.memory == nil) {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.logger.Info("cache stats", m.usageAttrs()...)
+			}
+		}
+	}()
+}
+
 func (m *Manager) cleanupOnce(ctx context.Context) error {
 	root := m.cfg.Storage.CacheDir
 	if _, err := os.Stat(root); err != nil {
@@ -131,36 +279,27 @@ func (m *Manager) cleanupOnce(ctx context.Context) error {
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
-		if !isAllowedCacheExt(path) {
+		if strings.HasSuffix(path, ".tmp") {
+			m.cleanupTemp(path, d)
 			return nil
 		}
-		info, err := d.Info()
-		if err != nil {
-			return err
-		}
-		if ttl > 0 && time.Since(info.ModTime()) > ttl {
-			if err := m.removeCacheFile(path, info.Size(), &stats); err != nil {
-				m.logger.Warn("remove stale cache", slog.String("path", path), slog.Any("error", err))
+		if variant, ok := strings.CutSuffix(path, metadataExt); ok {
+			if _, err := os.Stat(variant); errors.Is(err, os.ErrNotExist) {
+				if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+					m.logger.Warn("remove orphan metadata", slog.String("path", path), slog.Any("error", err))
+				}
 			}
 			return nil
 		}
-		_, rel, ok := splitCachePath(m.cfg.Storage.CacheDir, path)
-		if !ok {
+		if !isAllowedCacheExt(path) {
 			return nil
 		}
-		origInfo, err := m.lookupOriginalInfo(rel)
+		info, err := d.Info()
 		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				if remErr := m.removeCacheFile(path, info.Size(), &stats); remErr != nil {
-					m.logger.Warn("remove orphan cache", slog.String("path", path), slog.Any("error", remErr))
-				}
-			}
-			return nil
+			return err
 		}
-		if origInfo.ModTime().After(info.ModTime()) {
-			if err := m.removeCacheFile(path, info.Size(), &stats); err != nil {
-				m.logger.Warn("remove outdated cache", slog.String("path", path), slog.Any("error", err))
-			}
+		if !m.cleanupFile(path, info, ttl, &stats) {
+			m.seedFile(path, info)
 		}
 		return nil
 	})
@@ -176,13 +315,172 @@ func (m *Manager) cleanupOnce(ctx context.Context) error {
 			m.logger.Warn("remove cache dir", slog.String("path", dir), slog.Any("error", err))
 		}
 	}
-	m.logger.Info("cache cleanup finished",
+	m.logger.Info("cache cleanup finished", append([]any{
 		slog.Int("files_removed", stats.files),
 		slog.String("bytes_removed", human.FormatBytes(stats.bytes)),
-		slog.Int64("raw_bytes_removed", stats.bytes))
+		slog.Int64("raw_bytes_removed", stats.bytes),
+	}, m.usageAttrs()...)...)
 	return nil
 }
 
+// cleanupTemp removes a temporary file from an interrupted write once it is
+// older than staleTempAge.
+func (m *Manager) cleanupTemp(path string, d fs.DirEntry) {
+	info, err := d.Info()
+	if err != nil || time.Since(info.ModTime()) < staleTempAge {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		m.logger.Warn("remove stale temp file", slog.String("path", path), slog.Any("error", err))
+	}
+}
+
+// cleanupFile removes a cached variant when it outlived the TTL or its source
+// changed or disappeared, and reports whether it did.
+func (m *Manager) cleanupFile(path string, info os.FileInfo, ttl time.Duration, stats *cleanupStats) bool {
+	if ttl > 0 && time.Since(info.ModTime()) > ttl {
+		if err := m.removeCacheFile(path, info.Size(), stats); err != nil {
+			m.logger.Warn("remove stale cache", slog.String("path", path), slog.Any("error", err))
+		}
+		return true
+	}
+	if meta, ok := m.peekMetadata(path, info); ok && meta.SourcePath != "" {
+		src, err := os.Stat(filepath.Join(m.cfg.Storage.BaseDir, filepath.FromSlash(meta.SourcePath)))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			if remErr := m.removeCacheFile(path, info.Size(), stats); remErr != nil {
+				m.logger.Warn("remove orphan cache", slog.String("path", path), slog.Any("error", remErr))
+			}
+			return true
+		case err == nil && (!src.ModTime().Equal(meta.SourceMTime) || src.Size() != meta.SourceSize):
+			if remErr := m.removeCacheFile(path, info.Size(), stats); remErr != nil {
+				m.logger.Warn("remove outdated cache", slog.String("path", path), slog.Any("error", remErr))
+			}
+			return true
+		}
+		return false
+	}
+	_, rel, ok := splitCachePath(m.cfg.Storage.CacheDir, path)
+	if !ok {
+		return false
+	}
+	origInfo, err := m.lookupOriginalInfo(rel)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			if remErr := m.removeCacheFile(path, info.Size(), stats); remErr != nil {
+				m.logger.Warn("remove orphan cache", slog.String("path", path), slog.Any("error", remErr))
+			}
+			return true
+		}
+		return false
+	}
+	if origInfo.ModTime().After(info.ModTime()) {
+		if err := m.removeCacheFile(path, info.Size(), stats); err != nil {
+			m.logger.Warn("remove outdated cache", slog.String("path", path), slog.Any("error", err))
+		}
+		return true
+	}
+	return false
+}
+
+// seedUsage walks the cache once to register existing variants for eviction.
+func (m *Manager) seedUsage(ctx context.Context) error {
+	root := m.cfg.Storage.CacheDir
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() || !isAllowedCacheExt(path) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		m.seedFile(path, info)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.logger.Info("cache usage scanned", m.usageAttrs()...)
+	m.evictIfNeeded("")
+	return nil
+}
+
+// seedFile registers a variant found on disk, using its mtime as last access.
+func (m *Manager) seedFile(path string, info os.FileInfo) {
+	if m.usage != nil {
+		m.usage.seed(path, info.Size()+m.sidecarSize(path), info.ModTime())
+	}
+}
+
+func (m *Manager) sidecarSize(cachePath string) int64 {
+	if info, err := os.Stat(MetadataPath(cachePath)); err == nil {
+		return info.Size()
+	}
+	return 0
+}
+
+// evictIfNeeded removes the least valuable variants, other than keep, once the
+// cache exceeds its size or file limit. Concurrent callers skip while a pass
+// is running.
+func (m *Manager) evictIfNeeded(keep string) {
+	if m.usage == nil || !m.evicting.CompareAndSwap(false, true) {
+		return
+	}
+	defer m.evicting.Store(false)
+	victims := m.usage.victims(m.cfg.Cache.MaxSize.Bytes, m.cfg.Cache.MaxFiles, keep, time.Now())
+	if len(victims) == 0 {
+		return
+	}
+	stats := cleanupStats{}
+	for _, victim := range victims {
+		if err := m.removeCacheFile(victim.path, victim.size, &stats); err != nil {
+			m.logger.Warn("evict cache", slog.String("path", victim.path), slog.Any("error", err))
+		}
+	}
+	m.logger.Info("cache eviction finished", append([]any{
+		slog.String("policy", m.cfg.Cache.Eviction),
+		slog.Int("files_removed", stats.files),
+		slog.String("bytes_removed", human.FormatBytes(stats.bytes)),
+	}, m.usageAttrs()...)...)
+}
+
+// usageAttrs describes current cache usage against the limits for logging.
+func (m *Manager) usageAttrs() []any {
+	var attrs []any
+	if m.usage != nil {
+		files, bytes := m.usage.totals()
+		attrs = append(attrs,
+			slog.Int("usage_files", files),
+			slog.String("usage_bytes", human.FormatBytes(bytes)),
+			slog.Int64("raw_usage_bytes", bytes),
+			slog.Int("max_files", m.cfg.Cache.MaxFiles),
+			slog.String("max_size", human.FormatBytes(m.cfg.Cache.MaxSize.Bytes)),
+		)
+	}
+	if m.memory != nil {
+		stats := m.memory.stats()
+		attrs = append(attrs,
+			slog.Uint64("memory_hits", stats.Hits),
+			slog.Uint64("memory_misses", stats.Misses),
+			slog.Int("memory_entries", stats.Entries),
+			slog.String("memory_bytes", human.FormatBytes(stats.Bytes)),
+		)
+	}
+	return attrs
+}
+
 func splitCachePath(cacheRoot, candidate string) (geometry string, rel string, ok bool) {
 	relPath, err := filepath.Rel(cacheRoot, candidate)
 	if err != nil {
@@ -205,6 +503,9 @@ var allowedCacheExtensions = map[string]struct{}{
 	".avif": {},
 	".webp": {},
 	".jpg":  {},
+	".jpeg": {},
+	".gif":  {},
+	".jxl":  {},
 }
 
 func isAllowedCacheExt(path string) bool {
@@ -237,7 +538,27 @@ func (m *Manager) lookupOriginalInfo(rel string) (os.FileInfo, error) {
 	return nil, fallbackErr
 }
 
+// peekMetadata reads a variant's metadata without adding it to the index, so a
+// cleanup pass does not load the whole cache into memory.
+func (m *Manager) peekMetadata(path string, info os.FileInfo) (Metadata, bool) {
+	if entry, ok := m.meta.lookup(path, info); ok {
+		return entry.meta, entry.recorded
+	}
+	meta, err := readMetadata(MetadataPath(path))
+	return meta, err == nil
+}
+
 func (m *Manager) removeCacheFile(path string, size int64, stats *cleanupStats) error {
+	m.meta.forget(path)
+	if m.memory != nil {
+		m.memory.remove(path)
+	}
+	if m.usage != nil {
+		m.usage.remove(path)
+	}
+	if err := os.Remove(MetadataPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
 	if err := os.Remove(path); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return nil
@@ -1,10 +1,14 @@
 package cache
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -59,3 +63,392 @@ func TestCleanupPreservesDerivedCacheWhenOriginalExists(t *testing.T) {
 		t.Fatalf("expected cache file to remain, got error: %v", err)
 	}
 }
+
+func TestWriteStoresMetadata(t *testing.T) {
+	baseDir := t.TempDir()
+	cacheDir := t.TempDir()
+	cfg := &config.Config{Storage: config.StorageConfig{BaseDir: baseDir, CacheDir: cacheDir}}
+	manager := NewManager(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	originalPath := filepath.Join(baseDir, "img", "a.jpg")
+	if err := os.MkdirAll(filepath.Dir(originalPath), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(originalPath, []byte("original"), 0o644); err != nil {
+		t.Fatalf("write original: %v", err)
+	}
+	original, err := os.Stat(originalPath)
+	if err != nil {
+		t.Fatalf("stat original: %v", err)
+	}
+
+	cachePath := filepath.Join(cacheDir, "200x200", "img", "a.jpg")
+	meta := Metadata{SourcePath: "img/a.jpg", SourceMTime: original.ModTime(), SourceSize: original.Size(), Settings: "v1"}
+	if err := manager.Write(cachePath, []byte("payload"), meta); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	stored, err := readMetadata(MetadataPath(cachePath))
+	if err != nil {
+		t.Fatalf("read sidecar: %v", err)
+	}
+	if stored.ETag != ContentETag([]byte("payload")) || stored.SourcePath != "img/a.jpg" || stored.CreatedAt.IsZero() {
+		t.Fatalf("unexpected sidecar: %+v", stored)
+	}
+
+	// A fresh manager (new process) reads the sidecar instead of the index.
+	manager = NewManager(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if !manager.IsFresh(cachePath, original, "v1") {
+		t.Fatalf("expected variant to be fresh")
+	}
+	if manager.IsFresh(cachePath, original, "v2") {
+		t.Fatalf("expected changed settings to invalidate the variant")
+	}
+
+	// Replacing the source with an older file is detected through its size.
+	if err := os.WriteFile(originalPath, []byte("replaced original"), 0o644); err != nil {
+		t.Fatalf("rewrite original: %v", err)
+	}
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(originalPath, past, past); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	replaced, err := os.Stat(originalPath)
+	if err != nil {
+		t.Fatalf("stat original: %v", err)
+	}
+	if manager.IsFresh(cachePath, replaced, "v1") {
+		t.Fatalf("expected replaced source to invalidate the variant")
+	}
+
+	// Cleanup removes outdated variants together with their sidecar.
+	if err := manager.cleanupOnce(context.Background()); err != nil {
+		t.Fatalf("cleanupOnce: %v", err)
+	}
+	for _, path := range []string{cachePath, MetadataPath(cachePath)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed, got %v", path, err)
+		}
+	}
+}
+
+func TestConcurrentWritesUseOwnTempFiles(t *testing.T) {
+	cacheDir := t.TempDir()
+	cfg := &config.Config{Storage: config.StorageConfig{BaseDir: t.TempDir(), CacheDir: cacheDir}}
+	manager := NewManager(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	cachePath := filepath.Join(cacheDir, "200x200", "img", "a.jpg")
+	payloads := [][]byte{[]byte(strings.Repeat("a", 1<<16)), []byte(strings.Repeat("b", 1<<16))}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(payload []byte) {
+			defer wg.Done()
+			if err := manager.Write(cachePath, payload, Metadata{SourcePath: "img/a.jpg"}); err != nil {
+				t.Errorf("Write: %v", err)
+			}
+		}(payloads[i%2])
+	}
+	wg.Wait()
+
+	stored, err := os.ReadFile(cachePath)
+	if err != nil {
+		t.Fatalf("read variant: %v", err)
+	}
+	if !bytes.Equal(stored, payloads[0]) && !bytes.Equal(stored, payloads[1]) {
+		t.Fatalf("variant mixes concurrent writes")
+	}
+	entries, err := os.ReadDir(filepath.Dir(cachePath))
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			t.Fatalf("left temp file %s behind", entry.Name())
+		}
+	}
+}
+
+func TestCleanupRemovesStaleTempFiles(t *testing.T) {
+	cacheDir := t.TempDir()
+	cfg := &config.Config{Storage: config.StorageConfig{BaseDir: t.TempDir(), CacheDir: cacheDir}}
+	manager := NewManager(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	dir := filepath.Join(cacheDir, "200x200", "img")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	stale := filepath.Join(dir, "a.jpg.123.tmp")
+	fresh := filepath.Join(dir, "b.jpg.456.tmp")
+	for _, path := range []string{stale, fresh} {
+		if err := os.WriteFile(path, []byte("partial"), 0o600); err != nil {
+			t.Fatalf("write temp: %v", err)
+		}
+	}
+	past := time.Now().Add(-2 * staleTempAge)
+	if err := os.Chtimes(stale, past, past); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	if err := manager.cleanupOnce(context.Background()); err != nil {
+		t.Fatalf("cleanupOnce: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected stale temp file to be removed, got %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("expected in-flight temp file to remain, got %v", err)
+	}
+}
+
+func TestMetadataHashesLegacyEntries(t *testing.T) {
+	cacheDir := t.TempDir()
+	cfg := &config.Config{Storage: config.StorageConfig{CacheDir: cacheDir}}
+	manager := NewManager(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	legacy := filepath.Join(cacheDir, "200x200", "b.jpg")
+	if err := os.MkdirAll(filepath.Dir(legacy), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(legacy, []byte("legacy"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	info, file, err := manager.ServeFileStats(legacy)
+	if err != nil {
+		t.Fatalf("ServeFileStats: %v", err)
+	}
+	defer file.Close()
+	meta, err := manager.Metadata(legacy, info, file)
+	if err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+	if meta.ETag != ContentETag([]byte("legacy")) {
+		t.Fatalf("unexpected etag: %q", meta.ETag)
+	}
+	if entry, ok := manager.meta.lookup(legacy, info); !ok || entry.recorded {
+		t.Fatalf("expected hashed etag to be indexed as unrecorded, got %+v (%v)", entry, ok)
+	}
+}
+
+func TestMetaIndexIsBounded(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.jpg")
+	if err := os.WriteFile(path, []byte("a"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+
+	index := newMetaIndex(2)
+	index.store("a", info, Metadata{ETag: "a"}, true)
+	index.store("b", info, Metadata{ETag: "b"}, true)
+	if _, ok := index.lookup("a", info); !ok {
+		t.Fatal("expected a to be indexed")
+	}
+	index.store("c", info, Metadata{ETag: "c"}, true)
+
+	if _, ok := index.lookup("b", info); ok {
+		t.Fatal("expected the least recently used entry to be dropped")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := index.lookup(key, info); !ok {
+			t.Fatalf("expected %s to stay indexed", key)
+		}
+	}
+	if len(index.entries) != 2 || index.order.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d/%d", len(index.entries), index.order.Len())
+	}
+}
+
+func TestUsageTrackerVictims(t *testing.T) {
+	base := time.Now()
+	build := func(policy string) *usageTracker {
+		u := newUsageTracker(policy)
+		u.add("old-popular", 100, base)
+		u.add("new-rare", 100, base.Add(2*time.Minute))
+		u.add("mid", 100, base.Add(time.Minute))
+		for i := 0; i < 5; i++ {
+			u.touch("old-popular", base)
+		}
+		return u
+	}
+
+	now := base.Add(2 * time.Minute)
+	if victims := build("lru").victims(1000, 0, "", now); victims != nil {
+		t.Fatalf("expected no victims below the limits, got %+v", victims)
+	}
+	lru := build("lru").victims(200, 0, "", now)
+	if len(lru) != 2 || lru[0].path != "old-popular" || lru[1].path != "mid" {
+		t.Fatalf("unexpected lru victims: %+v", lru)
+	}
+	lfu := build("lfu").victims(0, 2, "", now)
+	if len(lfu) != 2 || lfu[0].path != "mid" || lfu[1].path != "new-rare" {
+		t.Fatalf("unexpected lfu victims: %+v", lfu)
+	}
+
+	// The entry being written is never its own victim.
+	kept := build("lfu").victims(0, 2, "mid", now)
+	if len(kept) != 2 || kept[0].path != "new-rare" || kept[1].path != "old-popular" {
+		t.Fatalf("unexpected lfu victims keeping mid: %+v", kept)
+	}
+
+	// Hits decay, so a day-old burst does not outrank a fresh write.
+	aged := build("lfu")
+	later := base.Add(24 * time.Hour)
+	aged.add("fresh", 100, later)
+	victims := aged.victims(0, 2, "", later)
+	if len(victims) != 3 || victims[2].path != "old-popular" {
+		t.Fatalf("unexpected aged lfu victims: %+v", victims)
+	}
+}
+
+func TestWriteEvictsLeastRecentlyUsed(t *testing.T) {
+	cacheDir := t.TempDir()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{CacheDir: cacheDir},
+		Cache:   config.CacheConfig{MaxFiles: 3, Eviction: "lru"},
+	}
+	manager := NewManager(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	paths := make([]string, 4)
+	for i, name := range []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"} {
+		paths[i] = filepath.Join(cacheDir, "100x100", name)
+	}
+	write := func(path string) {
+		time.Sleep(time.Millisecond)
+		if err := manager.Write(path, []byte("variant"), Metadata{}); err != nil {
+			t.Fatalf("Write %s: %v", path, err)
+		}
+	}
+	for _, path := range paths[:3] {
+		write(path)
+	}
+	// Reading a.jpg leaves b.jpg and c.jpg as the least recently used entries.
+	time.Sleep(time.Millisecond)
+	_, file, err := manager.ServeFileStats(paths[0])
+	if err != nil {
+		t.Fatalf("ServeFileStats: %v", err)
+	}
+	file.Close()
+	// The fourth file exceeds max_files; eviction shrinks the cache to 90% (2 files).
+	write(paths[3])
+
+	for i, path := range paths {
+		_, err := os.Stat(path)
+		if evicted := os.IsNotExist(err); evicted != (i == 1 || i == 2) {
+			t.Fatalf("%s: unexpected eviction state (err %v)", path, err)
+		}
+	}
+	if _, err := os.Stat(MetadataPath(paths[1])); !os.IsNotExist(err) {
+		t.Fatalf("expected evicted sidecar to be removed, got %v", err)
+	}
+	if files, _ := manager.usage.totals(); files != 2 {
+		t.Fatalf("unexpected usage after eviction: %d files", files)
+	}
+}
+
+func TestMemoryTier(t *testing.T) {
+	baseDir := t.TempDir()
+	cacheDir := t.TempDir()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{BaseDir: baseDir, CacheDir: cacheDir},
+		Cache:   config.CacheConfig{MemorySize: config.ByteSize{Bytes: 80}},
+	}
+	manager := NewManager(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	originalPath := filepath.Join(baseDir, "a.jpg")
+	if err := os.WriteFile(originalPath, []byte("original"), 0o644); err != nil {
+		t.Fatalf("write original: %v", err)
+	}
+	original, err := os.Stat(originalPath)
+	if err != nil {
+		t.Fatalf("stat original: %v", err)
+	}
+	meta := Metadata{SourcePath: "a.jpg", SourceMTime: original.ModTime(), SourceSize: original.Size(), Settings: "v1"}
+
+	hot := filepath.Join(cacheDir, "100x100", "a.jpg")
+	if err := manager.Write(hot, []byte("0123456789"), meta); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	payload, got, ok := manager.Memory(hot, original, "v1")
+	if !ok || string(payload) != "0123456789" || got.ETag != ContentETag(payload) {
+		t.Fatalf("expected memory hit, got %q %+v %v", payload, got, ok)
+	}
+	if _, _, ok := manager.Memory(hot, original, "v2"); ok {
+		t.Fatalf("expected settings change to miss")
+	}
+	if _, _, ok := manager.Memory(hot, original, "v1"); ok {
+		t.Fatalf("expected stale entry to be dropped")
+	}
+
+	// Entries above an eighth of the budget are not kept.
+	large := filepath.Join(cacheDir, "100x100", "large.jpg")
+	if err := manager.Write(large, make([]byte, 11), meta); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, _, ok := manager.Memory(large, original, "v1"); ok {
+		t.Fatalf("expected oversized payload to skip the memory tier")
+	}
+
+	// Disk hits are promoted and the least recently used entries make room.
+	for i := 0; i < 9; i++ {
+		path := filepath.Join(cacheDir, "100x100", strconv.Itoa(i)+".jpg")
+		if err := manager.Write(path, []byte("0123456789"), meta); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if _, _, ok := manager.Memory(filepath.Join(cacheDir, "100x100", "0.jpg"), original, "v1"); ok {
+		t.Fatalf("expected oldest entry to be evicted from memory")
+	}
+	info, file, err := manager.ServeFileStats(filepath.Join(cacheDir, "100x100", "0.jpg"))
+	if err != nil {
+		t.Fatalf("ServeFileStats: %v", err)
+	}
+	defer file.Close()
+	stored, err := manager.Metadata(filepath.Join(cacheDir, "100x100", "0.jpg"), info, file)
+	if err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+	if promoted, ok := manager.Promote(filepath.Join(cacheDir, "100x100", "0.jpg"), info, file, stored); !ok || string(promoted) != "0123456789" {
+		t.Fatalf("expected promotion, got %q %v", promoted, ok)
+	}
+
+	stats := manager.MemoryStats()
+	if stats.Hits != 1 || stats.Misses != 4 || stats.Bytes > 80 || stats.Entries != 8 {
+		t.Fatalf("unexpected memory stats: %+v", stats)
+	}
+
+	// The counters are logged periodically.
+	var logged syncBuffer
+	manager.logger = slog.New(slog.NewTextHandler(&logged, nil))
+	cfg.Cache.StatsInterval.Duration = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager.StartStatsLog(ctx)
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(logged.String(), "memory_hits=1 memory_misses=4") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected periodic stats, got %q", logged.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for a logger goroutine and the test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// memoryItemShare bounds a single memory entry to this fraction of the budget,
+// so one large variant cannot flush every hot thumbnail.
+const memoryItemShare = 8
+
+// MemoryStats reports the state of the in-memory tier.
+type MemoryStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Bytes   int64
+}
+
+// memoryTier is a byte-bounded LRU of variant payloads and their metadata.
+type memoryTier struct {
+	mu      sync.Mutex
+	budget  int64
+	bytes   int64
+	order   *list.List
+	entries map[string]*list.Element
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+type memoryEntry struct {
+	path    string
+	payload []byte
+	meta    Metadata
+}
+
+func newMemoryTier(budget int64) *memoryTier {
+	return &memoryTier{budget: budget, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (t *memoryTier) get(path string) (memoryEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elem, ok := t.entries[path]
+	if !ok {
+		return memoryEntry{}, false
+	}
+	t.order.MoveToFront(elem)
+	return *elem.Value.(*memoryEntry), true
+}
+
+// fits reports whether a payload of size may be kept.
+func (t *memoryTier) fits(size int64) bool {
+	return size <= t.budget/memoryItemShare
+}
+
+func (t *memoryTier) put(path string, payload []byte, meta Metadata) {
+	size := int64(len(payload))
+	if !t.fits(size) {
+		t.remove(path)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if elem, ok := t.entries[path]; ok {
+		t.removeElement(elem)
+	}
+	t.entries[path] = t.order.PushFront(&memoryEntry{path: path, payload: payload, meta: meta})
+	t.bytes += size
+	for t.bytes > t.budget {
+		t.removeElement(t.order.Back())
+	}
+}
+
+func (t *memoryTier) remove(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if elem, ok := t.entries[path]; ok {
+		t.removeElement(elem)
+	}
+}
+
+func (t *memoryTier) removeElement(elem *list.Element) {
+	entry := t.order.Remove(elem).(*memoryEntry)
+	delete(t.entries, entry.path)
+	t.bytes -= int64(len(entry.payload))
+}
+
+func (t *memoryTier) stats() MemoryStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return MemoryStats{Hits: t.hits.Load(), Misses: t.misses.Load(), Entries: len(t.entries), Bytes: t.bytes}
+}
@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// metadataExt is appended to a variant's path to name its metadata sidecar.
+const metadataExt = ".meta"
+
+// Metadata describes how a cached variant was produced. It is stored as a JSON
+// sidecar next to the variant.
+type Metadata struct {
+	ETag        string    `json:"etag"`
+	SourcePath  string    `json:"source_path,omitempty"`
+	SourceMTime time.Time `json:"source_mtime"`
+	SourceSize  int64     `json:"source_size"`
+	// Settings fingerprints the processing options; a different value means
+	// the variant was rendered with other encoder settings.
+	Settings  string    `json:"settings,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// matches reports whether the metadata was recorded for the original as it is
+// now (exact mtime and size) and, when settings is non-empty, for the same
+// processing settings.
+func (meta Metadata) matches(originalInfo os.FileInfo, settings string) bool {
+	if originalInfo != nil && (!meta.SourceMTime.Equal(originalInfo.ModTime()) || meta.SourceSize != originalInfo.Size()) {
+		return false
+	}
+	return settings == "" || meta.Settings == settings
+}
+
+// ContentETag returns the strong ETag of a payload: its quoted SHA-256.
+func ContentETag(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(sum[:]))
+}
+
+// MetadataPath returns the sidecar path of a cached variant.
+func MetadataPath(cachePath string) string {
+	return cachePath + metadataExt
+}
+
+// metaIndexCapacity bounds the metadata index. Evicted entries are read from
+// their sidecar again on the next hit, so only hot variants stay indexed.
+const metaIndexCapacity = 16384
+
+// metaIndex keeps the metadata of recently used cache files in memory so hits
+// neither read the sidecar nor rehash the file. It is an LRU of at most
+// capacity entries, and entries are only trusted while the variant's size and
+// modification time still match.
+type metaIndex struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type metaEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+	meta    Metadata
+	// recorded is false for entries cached without a sidecar, whose metadata
+	// only carries the ETag.
+	recorded bool
+}
+
+func newMetaIndex(capacity int) *metaIndex {
+	return &metaIndex{capacity: capacity, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (x *metaIndex) lookup(path string, info os.FileInfo) (metaEntry, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	elem, ok := x.entries[path]
+	if !ok {
+		return metaEntry{}, false
+	}
+	entry := elem.Value.(*metaEntry)
+	if entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+		return metaEntry{}, false
+	}
+	x.order.MoveToFront(elem)
+	return *entry, true
+}
+
+func (x *metaIndex) store(path string, info os.FileInfo, meta Metadata, recorded bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if elem, ok := x.entries[path]; ok {
+		x.order.Remove(elem)
+	}
+	x.entries[path] = x.order.PushFront(&metaEntry{path: path, size: info.Size(), modTime: info.ModTime(), meta: meta, recorded: recorded})
+	for x.order.Len() > x.capacity {
+		entry := x.order.Remove(x.order.Back()).(*metaEntry)
+		delete(x.entries, entry.path)
+	}
+}
+
+func (x *metaIndex) forget(path string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if elem, ok := x.entries[path]; ok {
+		x.order.Remove(elem)
+		delete(x.entries, path)
+	}
+}
+
+// storedMetadata returns the metadata recorded for a variant, from the index
+// or its sidecar. ok is false for entries written without metadata.
+func (m *Manager) storedMetadata(cachePath string, info os.FileInfo) (Metadata, bool) {
+	if entry, ok := m.meta.lookup(cachePath, info); ok {
+		return entry.meta, entry.recorded
+	}
+	meta, err := readMetadata(MetadataPath(cachePath))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			m.logger.Warn("read cache metadata", "path", cachePath, "error", err)
+		}
+		return Metadata{}, false
+	}
+	m.meta.store(cachePath, info, meta, true)
+	return meta, true
+}
+
+// Metadata returns the metadata of an open cache file. Entries cached without
+// a sidecar are hashed once to obtain their ETag.
+func (m *Manager) Metadata(cachePath string, info os.FileInfo, file io.ReaderAt) (Metadata, error) {
+	if entry, ok := m.meta.lookup(cachePath, info); ok {
+		return entry.meta, nil
+	}
+	if meta, ok := m.storedMetadata(cachePath, info); ok {
+		return meta, nil
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, info.Size())); err != nil {
+		return Metadata{}, fmt.Errorf("hash cache file: %w", err)
+	}
+	meta := Metadata{ETag: fmt.Sprintf("\"%s\"", hex.EncodeToString(hash.Sum(nil)))}
+	m.meta.store(cachePath, info, meta, false)
+	return meta, nil
+}
+
+func readMetadata(path string) (Metadata, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return Metadata{}, err
+	}
+	var meta Metadata
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return Metadata{}, fmt.Errorf("decode %s: %w", path, err)
+	}
+	return meta, nil
+}
+
+func writeMetadata(path string, meta Metadata) error {
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("encode metadata: %w", err)
+	}
+	if err := writeFileAtomic(path, raw); err != nil {
+		return fmt.Errorf("store metadata: %w", err)
+	}
+	return nil
+}
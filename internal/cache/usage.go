@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// evictionTarget is the fraction of each limit the cache is shrunk to once a
+// limit is exceeded, so eviction does not run on every write near the limit.
+const evictionTarget = 0.9
+
+// lfuHalfLife is how long it takes an idle variant's hit count to halve under
+// the lfu policy, so past popularity does not protect an entry forever and a
+// fresh variant is not outranked by every long-lived one.
+const lfuHalfLife = time.Hour
+
+// usageTracker records the size and accesses of cached variants so the cache
+// can be kept within cache.max_size and cache.max_files.
+type usageTracker struct {
+	mu      sync.Mutex
+	policy  string
+	entries map[string]*usageEntry
+	bytes   int64
+}
+
+type usageEntry struct {
+	size       int64
+	lastAccess time.Time
+	// hits is the access count as of lastAccess; it decays with lfuHalfLife.
+	hits float64
+}
+
+// frequency returns the entry's hit count decayed to at.
+func (e *usageEntry) frequency(at time.Time) float64 {
+	idle := at.Sub(e.lastAccess)
+	if idle <= 0 {
+		return e.hits
+	}
+	return e.hits * math.Exp2(-float64(idle)/float64(lfuHalfLife))
+}
+
+// evictionCandidate is a variant selected for removal.
+type evictionCandidate struct {
+	path string
+	size int64
+}
+
+func newUsageTracker(policy string) *usageTracker {
+	return &usageTracker{policy: policy, entries: make(map[string]*usageEntry)}
+}
+
+// add records a freshly written variant, replacing any previous entry. The
+// write counts as its first access.
+func (u *usageTracker) add(path string, size int64, at time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if prev, ok := u.entries[path]; ok {
+		u.bytes -= prev.size
+	}
+	u.entries[path] = &usageEntry{size: size, lastAccess: at, hits: 1}
+	u.bytes += size
+}
+
+// seed records a variant found on disk unless it is already tracked.
+func (u *usageTracker) seed(path string, size int64, at time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.entries[path]; ok {
+		return
+	}
+	u.entries[path] = &usageEntry{size: size, lastAccess: at}
+	u.bytes += size
+}
+
+func (u *usageTracker) touch(path string, at time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if entry, ok := u.entries[path]; ok {
+		entry.hits = entry.frequency(at) + 1
+		entry.lastAccess = at
+	}
+}
+
+func (u *usageTracker) remove(path string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if entry, ok := u.entries[path]; ok {
+		u.bytes -= entry.size
+		delete(u.entries, path)
+	}
+}
+
+func (u *usageTracker) totals() (int, int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.entries), u.bytes
+}
+
+// victims returns the variants to remove, least valuable as of now first, when
+// the cache exceeds maxBytes or maxFiles (zero disables a limit). Removal
+// brings usage down to evictionTarget of each exceeded limit. keep, usually
+// the variant just written, is never selected.
+func (u *usageTracker) victims(maxBytes int64, maxFiles int, keep string, now time.Time) []evictionCandidate {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	overBytes := maxBytes > 0 && u.bytes > maxBytes
+	overFiles := maxFiles > 0 && len(u.entries) > maxFiles
+	if !overBytes && !overFiles {
+		return nil
+	}
+	targetBytes := u.bytes
+	if maxBytes > 0 {
+		targetBytes = int64(float64(maxBytes) * evictionTarget)
+	}
+	targetFiles := len(u.entries)
+	if maxFiles > 0 {
+		targetFiles = int(float64(maxFiles) * evictionTarget)
+	}
+
+	type ranked struct {
+		path      string
+		frequency float64
+		*usageEntry
+	}
+	all := make([]ranked, 0, len(u.entries))
+	for path, entry := range u.entries {
+		if path == keep {
+			continue
+		}
+		all = append(all, ranked{path: path, frequency: entry.frequency(now), usageEntry: entry})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if u.policy == "lfu" && a.frequency != b.frequency {
+			return a.frequency < b.frequency
+		}
+		return a.lastAccess.Before(b.lastAccess)
+	})
+
+	bytes, files := u.bytes, len(u.entries)
+	var out []evictionCandidate
+	for _, entry := range all {
+		if bytes <= targetBytes && files <= targetFiles {
+			break
+		}
+		out = append(out, evictionCandidate{path: entry.path, size: entry.size})
+		bytes -= entry.size
+		files--
+	}
+	return out
+}
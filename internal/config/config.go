@@ -1,6 +1,9 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -8,6 +11,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -27,19 +31,67 @@ import (
 var (
 	errEmptyConfigPath      = errors.New("config path is empty")
 	errInvalidGeometryLimit = errors.New("resize max dimensions must be positive")
-	envPathLookup           = buildEnvPathLookup()
-	envShortcutLookup       = map[string]string{
+	knownGravities          = map[string]struct{}{
+		"centre":    {},
+		"center":    {},
+		"north":     {},
+		"south":     {},
+		"east":      {},
+		"west":      {},
+		"attention": {},
+		"entropy":   {},
+	}
+	knownPositions = map[string]struct{}{
+		"centre":     {},
+		"center":     {},
+		"north":      {},
+		"south":      {},
+		"east":       {},
+		"west":       {},
+		"north-east": {},
+		"north-west": {},
+		"south-east": {},
+		"south-west": {},
+	}
+	knownPaddings = map[string]struct{}{
+		"solid":  {},
+		"blur":   {},
+		"edge":   {},
+		"mirror": {},
+	}
+	knownFits = map[string]struct{}{
+		"contain": {},
+		"cover":   {},
+		"fill":    {},
+		"inside":  {},
+	}
+	outputFormats = map[string]struct{}{
+		"avif": {},
+		"webp": {},
+		"png":  {},
+		"jpeg": {},
+		"jpg":  {},
+		"gif":  {},
+		"jxl":  {},
+	}
+	presetNameRe      = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	envPathLookup     = buildEnvPathLookup()
+	envShortcutLookup = map[string]string{
 		"HOST":             "server.host",
 		"PORT":             "server.port",
 		"IMAGES_BASE_DIR":  "storage.base_dir",
 		"CACHE_DIR":        "storage.cache_dir",
 		"MAX_WIDTH":        "resize.max_width",
 		"MAX_HEIGHT":       "resize.max_height",
+		"MAX_DPR":          "resize.max_dpr",
 		"JPG_QUALITY":      "resize.jpg_quality",
 		"WEBP_QUALITY":     "resize.webp_quality",
 		"AVIF_QUALITY":     "resize.avif_quality",
 		"PNG_COMPRESSION":  "resize.png_compression",
 		"AVIF_SPEED":       "resize.avif_speed",
+		"JXL_QUALITY":      "resize.jxl_quality",
+		"JXL_EFFORT":       "resize.jxl_effort",
+		"GIF_QUALITY":      "resize.gif_quality",
 		"GOMAXPROCS":       "runtime.gomaxprocs",
 		"VIPS_CONCURRENCY": "runtime.vips_concurrency",
 		"TTL":              "cache.ttl",
@@ -49,12 +101,20 @@ var (
 
 // Config represents the full service configuration loaded from YAML.
 type Config struct {
-	Server   ServerConfig  `yaml:"server"`
-	Storage  StorageConfig `yaml:"storage"`
-	Resize   ResizeConfig  `yaml:"resize"`
-	Cache    CacheConfig   `yaml:"cache"`
-	Runtime  RuntimeConfig `yaml:"runtime"`
-	Rewrites []RewriteRule `yaml:"rewrites"`
+	Server      ServerConfig            `yaml:"server"`
+	Storage     StorageConfig           `yaml:"storage"`
+	Resize      ResizeConfig            `yaml:"resize"`
+	Negotiation NegotiationConfig       `yaml:"negotiation"`
+	Signing     SigningConfig           `yaml:"signing"`
+	Operations  OperationsConfig        `yaml:"operations"`
+	Sizes       SizesConfig             `yaml:"sizes"`
+	Cache       CacheConfig             `yaml:"cache"`
+	Admission   AdmissionConfig         `yaml:"admission"`
+	Runtime     RuntimeConfig           `yaml:"runtime"`
+	Rewrites    []RewriteRule           `yaml:"rewrites"`
+	Paths       []PathConfig            `yaml:"paths"`
+	Presets     map[string]PresetConfig `yaml:"presets"`
+	Watermarks  []WatermarkRule         `yaml:"watermarks"`
 }
 
 // ServerConfig describes HTTP server binding parameters.
@@ -75,26 +135,255 @@ type StorageConfig struct {
 }
 
 // ResizeConfig combines resize limits and encoding parameters.
+// MaxSourceBytes and MaxSourcePixels refuse originals too large to decode
+// safely; zero disables either limit. Background is the default canvas colour
+// as hex (rgb, rgba, rrggbb or rrggbbaa); empty keeps white for opaque output
+// and transparent padding otherwise. Padding is the default letterbox fill:
+// solid (the background colour), blur, edge or mirror. Upscale is the default
+// policy for sources smaller than the requested geometry: pad, none, always
+// or a maximum factor such as "2x". Trim crops near-uniform borders before
+// fitting: pixels within TrimThreshold of TrimBackground (hex; empty takes the
+// top-left pixel) count as border. Animated sources keep every frame in WebP,
+// GIF and AVIF output unless Poster asks for the first frame only; MaxFrames
+// refuses longer animations, zero disables the limit. JXLEffort trades JPEG XL
+// encoding speed (1) for size (9). GIFQuality sizes the GIF palette: 100 keeps
+// 256 colours and lower values use fewer.
 type ResizeConfig struct {
-	MaxWidth       int `yaml:"max_width"`
-	MaxHeight      int `yaml:"max_height"`
-	JPGQuality     int `yaml:"jpg_quality"`
-	WebPQuality    int `yaml:"webp_quality"`
-	AVIFQuality    int `yaml:"avif_quality"`
-	PNGCompression int `yaml:"png_compression"`
-	AVIFSpeed      int `yaml:"avif_speed"`
+	MaxWidth        int      `yaml:"max_width"`
+	MaxHeight       int      `yaml:"max_height"`
+	MaxDPR          float64  `yaml:"max_dpr"`
+	JPGQuality      int      `yaml:"jpg_quality"`
+	WebPQuality     int      `yaml:"webp_quality"`
+	AVIFQuality     int      `yaml:"avif_quality"`
+	PNGCompression  int      `yaml:"png_compression"`
+	AVIFSpeed       int      `yaml:"avif_speed"`
+	JXLQuality      int      `yaml:"jxl_quality"`
+	JXLEffort       int      `yaml:"jxl_effort"`
+	GIFQuality      int      `yaml:"gif_quality"`
+	MaxSourceBytes  ByteSize `yaml:"max_source_bytes"`
+	MaxSourcePixels int64    `yaml:"max_source_pixels"`
+	Background      string   `yaml:"background"`
+	Padding         string   `yaml:"padding"`
+	Upscale         string   `yaml:"upscale"`
+	Trim            bool     `yaml:"trim"`
+	TrimThreshold   float64  `yaml:"trim_threshold"`
+	TrimBackground  string   `yaml:"trim_background"`
+	Poster          bool     `yaml:"poster"`
+	MaxFrames       int      `yaml:"max_frames"`
+}
+
+// NegotiationConfig controls Accept-header driven output format selection.
+// When enabled, plain JPEG/PNG requests and `.auto` URLs are served in the
+// first format from Formats that the client accepts, else in the source format.
+type NegotiationConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Formats []string `yaml:"formats"`
+}
+
+// SigningConfig controls HMAC URL signing. Every listed secret is accepted so
+// keys can be rotated; clients should sign with the first one.
+type SigningConfig struct {
+	Enforce bool     `yaml:"enforce"`
+	Secrets []string `yaml:"secrets"`
 }
 
-// RuntimeConfig controls Go scheduler and libvips concurrency.
+// OperationsConfig controls the `ops` query parameter of `/resize`, which
+// applies image operations such as blur or grayscale. It is rejected unless
+// Enabled; a non-empty Allowed list limits which operations may be used.
+type OperationsConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Allowed []string `yaml:"allowed"`
+}
+
+// SizesConfig restricts `/resize` to an allow-list of output sizes (after the
+// pixel ratio is applied). Requests for other sizes are rejected, or snapped
+// to the nearest allowed size of the same shape and optionally redirected to
+// its canonical URL. Path prefixes may replace the list via PathConfig.Sizes.
+type SizesConfig struct {
+	Allowed  []string `yaml:"allowed"`
+	Policy   string   `yaml:"policy"`
+	Redirect int      `yaml:"redirect"`
+	allowed  []Size
+}
+
+// Size is an allowed output geometry; zero leaves a side free.
+type Size struct {
+	Width  int
+	Height int
+}
+
+const (
+	SizePolicyReject = "reject"
+	SizePolicySnap   = "snap"
+)
+
+// RuntimeConfig controls Go scheduler and libvips concurrency. Concurrent
+// requests for the same variant share one generation; CoalesceTimeout bounds
+// how long a request waits for it and ProcessingTimeout how long a generation
+// may queue and run (zero disables either bound).
 type RuntimeConfig struct {
-	GOMAXPROCS      int `yaml:"gomaxprocs"`
-	VIPSConcurrency int `yaml:"vips_concurrency"`
+	GOMAXPROCS        int      `yaml:"gomaxprocs"`
+	VIPSConcurrency   int      `yaml:"vips_concurrency"`
+	CoalesceTimeout   Duration `yaml:"coalesce_timeout"`
+	ProcessingTimeout Duration `yaml:"processing_timeout"`
 }
 
-// CacheConfig stores cache retention settings.
+// CacheConfig stores cache retention settings. MaxSize and MaxFiles bound the
+// cache (zero disables a limit); Eviction picks what goes first when a limit
+// is hit: "lru" (least recently used) or "lfu" (least frequently used).
+// MemorySize enables an in-process tier for hot variants with that budget.
+// StatsInterval logs usage and memory tier counters periodically (zero
+// disables).
 type CacheConfig struct {
 	TTL             Duration `yaml:"ttl"`
 	CleanupInterval Duration `yaml:"cleanup_interval"`
+	MaxSize         ByteSize `yaml:"max_size"`
+	MaxFiles        int      `yaml:"max_files"`
+	Eviction        string   `yaml:"eviction"`
+	MemorySize      ByteSize `yaml:"memory_size"`
+	StatsInterval   Duration `yaml:"stats_interval"`
+}
+
+// AdmissionConfig bounds how many resizes run at once (zero MaxJobs uses
+// GOMAXPROCS). Further jobs wait in a queue of up to QueueSize for at most
+// QueueTimeout; requests that cannot be queued or time out get a 503 with a
+// RetryAfter hint. With JobPixels set, a job takes one slot per JobPixels of
+// source pixels (capped at MaxJobs), so huge originals count more.
+type AdmissionConfig struct {
+	MaxJobs      int      `yaml:"max_jobs"`
+	QueueSize    int      `yaml:"queue_size"`
+	QueueTimeout Duration `yaml:"queue_timeout"`
+	RetryAfter   Duration `yaml:"retry_after"`
+	JobPixels    int64    `yaml:"job_pixels"`
+}
+
+// PathConfig holds per-path-prefix defaults. The prefix is matched against the
+// resolved original path (after rewrites); the longest matching prefix wins.
+type PathConfig struct {
+	Prefix string `yaml:"prefix"`
+	// Gravity is the default crop gravity for cover requests: a direction,
+	// attention or entropy.
+	Gravity string `yaml:"gravity"`
+	// Focus is the default focal point as "fx,fy" fractions; it overrides Gravity.
+	Focus string `yaml:"focus"`
+	// Background replaces resize.background for this prefix.
+	Background string `yaml:"background"`
+	// Padding replaces resize.padding for this prefix.
+	Padding string `yaml:"padding"`
+	// Upscale replaces resize.upscale for this prefix.
+	Upscale string `yaml:"upscale"`
+	// Trim ("true" or "false") replaces resize.trim for this prefix.
+	Trim string `yaml:"trim"`
+	// TrimThreshold and TrimBackground replace resize.trim_threshold and
+	// resize.trim_background for this prefix; nil and empty inherit them.
+	TrimThreshold  *float64 `yaml:"trim_threshold"`
+	TrimBackground string   `yaml:"trim_background"`
+	// Poster ("true" or "false") replaces resize.poster for this prefix.
+	Poster string `yaml:"poster"`
+	// Sizes replaces the global sizes.allowed list for this prefix.
+	Sizes []string `yaml:"sizes"`
+	sizes []Size
+}
+
+// PresetConfig bundles the settings served under `/preset/{name}/{path}`.
+// Unset encoder settings (nil) inherit the matching resize setting, so a
+// preset may still ask for zero, e.g. png_compression: 0.
+type PresetConfig struct {
+	Width          int      `yaml:"width"`
+	Height         int      `yaml:"height"`
+	Fit            string   `yaml:"fit"`
+	Gravity        string   `yaml:"gravity"`
+	Focus          string   `yaml:"focus"`
+	Format         string   `yaml:"format"`
+	Background     string   `yaml:"background"`
+	Padding        string   `yaml:"padding"`
+	Upscale        string   `yaml:"upscale"`
+	Trim           string   `yaml:"trim"`
+	TrimThreshold  *float64 `yaml:"trim_threshold"`
+	TrimBackground string   `yaml:"trim_background"`
+	Poster         string   `yaml:"poster"`
+	Ops            string   `yaml:"ops"`
+	JPGQuality     *int     `yaml:"jpg_quality"`
+	WebPQuality    *int     `yaml:"webp_quality"`
+	AVIFQuality    *int     `yaml:"avif_quality"`
+	AVIFSpeed      *int     `yaml:"avif_speed"`
+	PNGCompression *int     `yaml:"png_compression"`
+	JXLQuality     *int     `yaml:"jxl_quality"`
+	JXLEffort      *int     `yaml:"jxl_effort"`
+	GIFQuality     *int     `yaml:"gif_quality"`
+}
+
+// WatermarkRule composites an overlay image onto the variants of matching
+// originals. A rule matches the resolved original path (after rewrites) by
+// Prefix or by the Pattern regex; the first matching rule wins. Variants
+// whose longer side is below MinSize are left alone. Position is a compass
+// direction (e.g. south-east) or centre, Margin keeps the overlay that many
+// pixels from the edges, Opacity (default 1) scales its alpha and Scale sizes
+// it as a fraction of the output width; zero keeps the overlay's own size.
+type WatermarkRule struct {
+	Prefix   string         `yaml:"prefix"`
+	Pattern  string         `yaml:"pattern"`
+	MinSize  int            `yaml:"min_size"`
+	Image    string         `yaml:"image"`
+	Position string         `yaml:"position"`
+	Margin   int            `yaml:"margin"`
+	Opacity  float64        `yaml:"opacity"`
+	Scale    float64        `yaml:"scale"`
+	re       *regexp.Regexp `yaml:"-"`
+}
+
+// Matches reports whether the rule applies to a resolved relative path.
+func (w WatermarkRule) Matches(relative string) bool {
+	if w.re != nil {
+		return w.re.MatchString(relative)
+	}
+	return hasPathPrefix(relative, w.Prefix)
+}
+
+// hasPathPrefix reports whether relative lies under prefix, comparing whole
+// path segments: "img/p" and "img/p/" match "img/p/1.jpg" but not
+// "img/pp/1.jpg". Leading and trailing slashes on prefix are ignored.
+func hasPathPrefix(relative, prefix string) bool {
+	prefix = strings.Trim(prefix, "/")
+	rest, ok := strings.CutPrefix(relative, prefix)
+	return ok && (prefix == "" || rest == "" || rest[0] == '/')
+}
+
+// Fingerprint returns a short hash of the rule settings, so editing a rule
+// stops serving variants rendered with the old ones.
+func (w WatermarkRule) Fingerprint() string {
+	w.re = nil
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%+v", w)))
+	return hex.EncodeToString(sum[:4])
+}
+
+func (w WatermarkRule) validate() error {
+	if (w.Prefix == "") == (w.Pattern == "") {
+		return errors.New("exactly one of prefix and pattern must be set")
+	}
+	if strings.TrimSpace(w.Image) == "" {
+		return errors.New("image must be set")
+	}
+	info, err := os.Stat(w.Image)
+	if err != nil {
+		return fmt.Errorf("image: %w", err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("image %s is a directory", w.Image)
+	}
+	if _, ok := knownPositions[w.Position]; !ok {
+		return fmt.Errorf("unknown position %q", w.Position)
+	}
+	if w.MinSize < 0 || w.Margin < 0 {
+		return errors.New("min_size and margin must be >= 0")
+	}
+	if w.Opacity <= 0 || w.Opacity > 1 {
+		return fmt.Errorf("opacity must be within 0-1, got %g", w.Opacity)
+	}
+	if w.Scale < 0 || w.Scale > 1 {
+		return fmt.Errorf("scale must be within 0-1, got %g", w.Scale)
+	}
+	return nil
 }
 
 // Duration wraps time.Duration to support YAML strings like "30d".
@@ -119,19 +408,40 @@ func defaultConfig() *Config {
 			CacheDir: "/data/cache",
 		},
 		Resize: ResizeConfig{
-			MaxWidth:       2000,
-			MaxHeight:      2000,
-			JPGQuality:     80,
-			WebPQuality:    75,
-			AVIFQuality:    75,
-			PNGCompression: 6,
-			AVIFSpeed:      6,
+			MaxWidth:        2000,
+			MaxHeight:       2000,
+			MaxDPR:          3,
+			JPGQuality:      80,
+			WebPQuality:     75,
+			AVIFQuality:     75,
+			PNGCompression:  6,
+			AVIFSpeed:       6,
+			JXLQuality:      75,
+			JXLEffort:       7,
+			GIFQuality:      100,
+			MaxSourceBytes:  ByteSize{100 << 20}, // 100mb
+			MaxSourcePixels: 100_000_000,         // 100 megapixels
+			TrimThreshold:   10,
+			MaxFrames:       200,
+		},
+		Negotiation: NegotiationConfig{
+			Formats: []string{"avif", "webp"},
 		},
 		Cache: CacheConfig{
 			TTL:             Duration{30 * 24 * time.Hour}, // 30d
 			CleanupInterval: Duration{24 * time.Hour},      // 24h
+			Eviction:        "lru",
+			StatsInterval:   Duration{time.Hour},
+		},
+		Admission: AdmissionConfig{
+			QueueSize:    64,
+			QueueTimeout: Duration{10 * time.Second},
+			RetryAfter:   Duration{5 * time.Second},
+		},
+		Runtime: RuntimeConfig{
+			CoalesceTimeout:   Duration{30 * time.Second},
+			ProcessingTimeout: Duration{25 * time.Second},
 		},
-		Runtime: RuntimeConfig{},
 	}
 }
 
@@ -375,6 +685,9 @@ func (c *Config) Validate() error {
 	if c.Resize.MaxWidth <= 0 || c.Resize.MaxHeight <= 0 {
 		return errInvalidGeometryLimit
 	}
+	if c.Resize.MaxDPR < 1 {
+		return fmt.Errorf("resize.max_dpr must be >= 1, got %g", c.Resize.MaxDPR)
+	}
 	if c.Resize.JPGQuality <= 0 || c.Resize.JPGQuality > 100 {
 		return fmt.Errorf("resize.jpg_quality must be within 1-100, got %d", c.Resize.JPGQuality)
 	}
@@ -390,15 +703,295 @@ func (c *Config) Validate() error {
 	if c.Resize.AVIFSpeed < 0 || c.Resize.AVIFSpeed > 8 {
 		return fmt.Errorf("resize.avif_speed must be within 0-8, got %d", c.Resize.AVIFSpeed)
 	}
+	if c.Resize.JXLQuality < 0 || c.Resize.JXLQuality > 100 {
+		return fmt.Errorf("resize.jxl_quality must be within 0-100, got %d", c.Resize.JXLQuality)
+	}
+	if c.Resize.JXLEffort < 1 || c.Resize.JXLEffort > 9 {
+		return fmt.Errorf("resize.jxl_effort must be within 1-9, got %d", c.Resize.JXLEffort)
+	}
+	if c.Resize.GIFQuality < 0 || c.Resize.GIFQuality > 100 {
+		return fmt.Errorf("resize.gif_quality must be within 0-100, got %d", c.Resize.GIFQuality)
+	}
+	if c.Resize.Background != "" {
+		if _, err := configutil.ParseColor(c.Resize.Background); err != nil {
+			return fmt.Errorf("resize.background: %w", err)
+		}
+	}
+	if c.Resize.Padding != "" {
+		if _, ok := knownPaddings[strings.ToLower(c.Resize.Padding)]; !ok {
+			return fmt.Errorf("resize.padding: unknown padding %q", c.Resize.Padding)
+		}
+	}
+	if c.Resize.Upscale != "" {
+		if _, _, err := configutil.ParseUpscale(c.Resize.Upscale); err != nil {
+			return fmt.Errorf("resize.upscale: %w", err)
+		}
+	}
+	if c.Resize.TrimThreshold < 0 || c.Resize.TrimThreshold > 255 {
+		return fmt.Errorf("resize.trim_threshold must be within 0-255, got %g", c.Resize.TrimThreshold)
+	}
+	if c.Resize.MaxFrames < 0 {
+		return fmt.Errorf("resize.max_frames must be >= 0, got %d", c.Resize.MaxFrames)
+	}
+	if c.Resize.TrimBackground != "" {
+		if _, err := configutil.ParseColor(c.Resize.TrimBackground); err != nil {
+			return fmt.Errorf("resize.trim_background: %w", err)
+		}
+	}
+	if c.Resize.MaxSourceBytes.Bytes < 0 || c.Resize.MaxSourcePixels < 0 {
+		return errors.New("resize.max_source_bytes and resize.max_source_pixels must be >= 0")
+	}
 	if c.Runtime.GOMAXPROCS < 0 {
 		return fmt.Errorf("runtime.gomaxprocs must be >= 0, got %d", c.Runtime.GOMAXPROCS)
 	}
 	if c.Runtime.VIPSConcurrency < 0 {
 		return fmt.Errorf("runtime.vips_concurrency must be >= 0, got %d", c.Runtime.VIPSConcurrency)
 	}
+	if c.Runtime.CoalesceTimeout.Duration < 0 {
+		return fmt.Errorf("runtime.coalesce_timeout must be >= 0, got %s", c.Runtime.CoalesceTimeout.Duration)
+	}
+	if c.Runtime.ProcessingTimeout.Duration < 0 {
+		return fmt.Errorf("runtime.processing_timeout must be >= 0, got %s", c.Runtime.ProcessingTimeout.Duration)
+	}
+	for _, name := range c.Negotiation.Formats {
+		if _, ok := outputFormats[name]; !ok {
+			return fmt.Errorf("negotiation.formats: unknown format %q", name)
+		}
+	}
+	if c.Cache.MaxSize.Bytes < 0 || c.Cache.MaxFiles < 0 || c.Cache.MemorySize.Bytes < 0 {
+		return errors.New("cache.max_size, cache.max_files and cache.memory_size must be >= 0")
+	}
+	if c.Cache.StatsInterval.Duration < 0 {
+		return fmt.Errorf("cache.stats_interval must be >= 0, got %s", c.Cache.StatsInterval.Duration)
+	}
+	if c.Cache.Eviction != "lru" && c.Cache.Eviction != "lfu" {
+		return fmt.Errorf("cache.eviction must be lru or lfu, got %q", c.Cache.Eviction)
+	}
+	if c.Admission.MaxJobs < 0 || c.Admission.QueueSize < 0 || c.Admission.JobPixels < 0 {
+		return errors.New("admission.max_jobs, admission.queue_size and admission.job_pixels must be >= 0")
+	}
+	if c.Admission.QueueTimeout.Duration < 0 || c.Admission.RetryAfter.Duration < 0 {
+		return errors.New("admission.queue_timeout and admission.retry_after must be >= 0")
+	}
+	for _, name := range c.Operations.Allowed {
+		if !slices.Contains(configutil.OpNames, name) {
+			return fmt.Errorf("operations.allowed: unknown operation %q", name)
+		}
+	}
+	if c.Signing.Enforce && len(c.Signing.Secrets) == 0 {
+		return errors.New("signing.secrets must be set when signing.enforce is true")
+	}
+	switch c.Sizes.Policy {
+	case SizePolicyReject, SizePolicySnap:
+	default:
+		return fmt.Errorf("sizes.policy must be reject or snap, got %q", c.Sizes.Policy)
+	}
+	switch c.Sizes.Redirect {
+	case 0:
+	case 301, 302:
+		if c.Sizes.Policy != SizePolicySnap {
+			return errors.New("sizes.redirect requires sizes.policy snap")
+		}
+	default:
+		return fmt.Errorf("sizes.redirect must be 0, 301 or 302, got %d", c.Sizes.Redirect)
+	}
+	if err := c.Resize.checkSizes(c.Sizes.allowed); err != nil {
+		return fmt.Errorf("sizes.allowed: %w", err)
+	}
+	for i, p := range c.Paths {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("paths[%d]: %w", i, err)
+		}
+		if err := c.Resize.checkSizes(p.sizes); err != nil {
+			return fmt.Errorf("paths[%d].sizes: %w", i, err)
+		}
+	}
+	for name, p := range c.Presets {
+		if !presetNameRe.MatchString(name) {
+			return fmt.Errorf("presets: invalid name %q", name)
+		}
+		if err := p.validate(c.Resize); err != nil {
+			return fmt.Errorf("presets.%s: %w", name, err)
+		}
+	}
+	for i, w := range c.Watermarks {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("watermarks[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (p PresetConfig) validate(limits ResizeConfig) error {
+	if p.Width < 0 || p.Height < 0 || (p.Width == 0 && p.Height == 0) {
+		return errors.New("width or height must be positive")
+	}
+	if p.Width > limits.MaxWidth || p.Height > limits.MaxHeight {
+		return fmt.Errorf("geometry %dx%d exceeds resize limits", p.Width, p.Height)
+	}
+	if p.Fit != "" {
+		if _, ok := knownFits[p.Fit]; !ok {
+			return fmt.Errorf("unknown fit %q", p.Fit)
+		}
+		if p.Fit != "contain" && (p.Width == 0 || p.Height == 0) {
+			return fmt.Errorf("fit %q requires both width and height", p.Fit)
+		}
+	}
+	if (p.Gravity != "" || p.Focus != "") && p.Fit != "cover" {
+		return errors.New("gravity and focus require fit cover")
+	}
+	if p.Padding != "" && p.Fit != "" && p.Fit != "contain" {
+		return errors.New("padding requires fit contain")
+	}
+	if p.Upscale != "" && (p.Fit == "cover" || p.Fit == "fill") {
+		return errors.New("upscale requires fit contain or inside")
+	}
+	if err := (PathConfig{Prefix: "-", Gravity: p.Gravity, Focus: p.Focus, Background: p.Background, Padding: p.Padding, Upscale: p.Upscale, Trim: p.Trim, TrimThreshold: p.TrimThreshold, TrimBackground: p.TrimBackground, Poster: p.Poster}).validate(); err != nil {
+		return err
+	}
+	if p.Format != "" {
+		if _, ok := outputFormats[p.Format]; !ok {
+			return fmt.Errorf("unknown format %q", p.Format)
+		}
+	}
+	if _, err := configutil.ParseOps(p.Ops); err != nil {
+		return fmt.Errorf("ops: %w", err)
+	}
+	// The ranges match the resize settings each one overrides.
+	for _, setting := range []struct {
+		name     string
+		value    *int
+		min, max int
+	}{
+		{"jpg_quality", p.JPGQuality, 1, 100},
+		{"webp_quality", p.WebPQuality, 0, 100},
+		{"avif_quality", p.AVIFQuality, 0, 100},
+		{"avif_speed", p.AVIFSpeed, 0, 8},
+		{"png_compression", p.PNGCompression, 0, 9},
+		{"jxl_quality", p.JXLQuality, 0, 100},
+		{"jxl_effort", p.JXLEffort, 1, 9},
+		{"gif_quality", p.GIFQuality, 0, 100},
+	} {
+		if setting.value != nil && (*setting.value < setting.min || *setting.value > setting.max) {
+			return fmt.Errorf("%s must be within %d-%d, got %d", setting.name, setting.min, setting.max, *setting.value)
+		}
+	}
+	return nil
+}
+
+// Encoding returns the resize settings with the preset's encoder overrides applied.
+func (p PresetConfig) Encoding(base ResizeConfig) ResizeConfig {
+	for _, override := range []struct {
+		value  *int
+		target *int
+	}{
+		{p.JPGQuality, &base.JPGQuality},
+		{p.WebPQuality, &base.WebPQuality},
+		{p.AVIFQuality, &base.AVIFQuality},
+		{p.AVIFSpeed, &base.AVIFSpeed},
+		{p.PNGCompression, &base.PNGCompression},
+		{p.JXLQuality, &base.JXLQuality},
+		{p.JXLEffort, &base.JXLEffort},
+		{p.GIFQuality, &base.GIFQuality},
+	} {
+		if override.value != nil {
+			*override.target = *override.value
+		}
+	}
+	return base
+}
+
+// Fingerprint returns a short hash of the preset settings. It is part of the
+// cache directory, so editing a preset stops serving its old variants.
+func (p PresetConfig) Fingerprint() string {
+	// JSON spells out the encoder overrides, where %v would print their
+	// addresses. Strings and ints always encode, so the error is nil.
+	raw, _ := json.Marshal(p)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:4])
+}
+
+func (r ResizeConfig) checkSizes(sizes []Size) error {
+	for _, size := range sizes {
+		if size.Width > r.MaxWidth || size.Height > r.MaxHeight {
+			return fmt.Errorf("size %dx%d exceeds resize limits", size.Width, size.Height)
+		}
+	}
 	return nil
 }
 
+func (p PathConfig) validate() error {
+	if strings.TrimSpace(p.Prefix) == "" {
+		return errors.New("prefix must be set")
+	}
+	if p.Gravity != "" {
+		if _, ok := knownGravities[strings.ToLower(p.Gravity)]; !ok {
+			return fmt.Errorf("unknown gravity %q", p.Gravity)
+		}
+	}
+	if p.Focus != "" {
+		if _, _, err := configutil.ParseFocalPoint(p.Focus); err != nil {
+			return err
+		}
+	}
+	if p.Background != "" {
+		if _, err := configutil.ParseColor(p.Background); err != nil {
+			return err
+		}
+	}
+	if p.Padding != "" {
+		if _, ok := knownPaddings[strings.ToLower(p.Padding)]; !ok {
+			return fmt.Errorf("unknown padding %q", p.Padding)
+		}
+	}
+	if p.Upscale != "" {
+		if _, _, err := configutil.ParseUpscale(p.Upscale); err != nil {
+			return err
+		}
+	}
+	if p.Trim != "" {
+		if _, err := strconv.ParseBool(p.Trim); err != nil {
+			return fmt.Errorf("invalid trim %q: expected true or false", p.Trim)
+		}
+	}
+	if p.TrimThreshold != nil && (*p.TrimThreshold < 0 || *p.TrimThreshold > 255) {
+		return fmt.Errorf("trim_threshold must be within 0-255, got %g", *p.TrimThreshold)
+	}
+	if p.TrimBackground != "" {
+		if _, err := configutil.ParseColor(p.TrimBackground); err != nil {
+			return fmt.Errorf("trim_background: %w", err)
+		}
+	}
+	if p.Poster != "" {
+		if _, err := strconv.ParseBool(p.Poster); err != nil {
+			return fmt.Errorf("invalid poster %q: expected true or false", p.Poster)
+		}
+	}
+	return nil
+}
+
+// PathSettings returns the defaults of the longest path prefix matching the
+// resolved relative path, or a zero value when none matches.
+func (c *Config) PathSettings(relative string) PathConfig {
+	var best PathConfig
+	for _, p := range c.Paths {
+		if hasPathPrefix(relative, p.Prefix) && len(strings.Trim(p.Prefix, "/")) >= len(strings.Trim(best.Prefix, "/")) {
+			best = p
+		}
+	}
+	return best
+}
+
+// AllowedSizes returns the size allow-list for a resolved relative path: the
+// matching prefix's list when it has one, else the global list. An empty
+// result means every size within the resize limits is allowed.
+func (c *Config) AllowedSizes(relative string) []Size {
+	if p := c.PathSettings(relative); len(p.sizes) > 0 {
+		return p.sizes
+	}
+	return c.Sizes.allowed
+}
+
 // ApplyRewrites passes the input through rewrite rules until a match occurs.
 func (c *Config) ApplyRewrites(input string) string {
 	target := input
@@ -410,7 +1003,79 @@ func (c *Config) ApplyRewrites(input string) string {
 	return target
 }
 
+// Watermark returns the first watermark rule matching the resolved relative
+// path.
+func (c *Config) Watermark(relative string) (WatermarkRule, bool) {
+	for _, w := range c.Watermarks {
+		if w.Matches(relative) {
+			return w, true
+		}
+	}
+	return WatermarkRule{}, false
+}
+
+// SigningSecrets returns the configured signing secrets as byte slices.
+func (c *Config) SigningSecrets() [][]byte {
+	secrets := make([][]byte, 0, len(c.Signing.Secrets))
+	for _, secret := range c.Signing.Secrets {
+		secrets = append(secrets, []byte(secret))
+	}
+	return secrets
+}
+
 func (c *Config) compile() error {
+	// Lists may arrive as a single comma separated string from env vars.
+	c.Negotiation.Formats = splitList(c.Negotiation.Formats)
+	for i, name := range c.Negotiation.Formats {
+		c.Negotiation.Formats[i] = strings.ToLower(name)
+	}
+	c.Signing.Secrets = splitList(c.Signing.Secrets)
+	c.Operations.Allowed = splitList(c.Operations.Allowed)
+	for i, name := range c.Operations.Allowed {
+		c.Operations.Allowed[i] = strings.ToLower(name)
+		if c.Operations.Allowed[i] == "greyscale" {
+			c.Operations.Allowed[i] = "grayscale"
+		}
+	}
+	c.Cache.Eviction = strings.ToLower(strings.TrimSpace(c.Cache.Eviction))
+	c.Sizes.Policy = strings.ToLower(strings.TrimSpace(c.Sizes.Policy))
+	if c.Sizes.Policy == "" {
+		c.Sizes.Policy = SizePolicyReject
+	}
+	sizes, err := parseSizes(splitList(c.Sizes.Allowed))
+	if err != nil {
+		return fmt.Errorf("sizes.allowed: %w", err)
+	}
+	c.Sizes.allowed = sizes
+	for i := range c.Paths {
+		sizes, err := parseSizes(c.Paths[i].Sizes)
+		if err != nil {
+			return fmt.Errorf("paths[%d].sizes: %w", i, err)
+		}
+		c.Paths[i].sizes = sizes
+	}
+	for name, p := range c.Presets {
+		p.Fit = strings.ToLower(strings.TrimSpace(p.Fit))
+		p.Format = strings.ToLower(strings.TrimSpace(p.Format))
+		c.Presets[name] = p
+	}
+	for i := range c.Watermarks {
+		w := &c.Watermarks[i]
+		w.Position = strings.ToLower(strings.TrimSpace(w.Position))
+		if w.Position == "" {
+			w.Position = "south-east"
+		}
+		if w.Opacity == 0 {
+			w.Opacity = 1
+		}
+		if w.Pattern != "" {
+			re, err := regexp.Compile(w.Pattern)
+			if err != nil {
+				return fmt.Errorf("compile watermarks[%d] pattern: %w", i, err)
+			}
+			w.re = re
+		}
+	}
 	for i := range c.Rewrites {
 		if strings.TrimSpace(c.Rewrites[i].Pattern) == "" {
 			return fmt.Errorf("rewrite rule %d has empty pattern", i)
@@ -424,6 +1089,30 @@ func (c *Config) compile() error {
 	return nil
 }
 
+func parseSizes(entries []string) ([]Size, error) {
+	sizes := make([]Size, 0, len(entries))
+	for _, entry := range entries {
+		width, height, err := configutil.ParseSize(entry)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, Size{Width: width, Height: height})
+	}
+	return sizes, nil
+}
+
+func splitList(entries []string) []string {
+	result := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		for _, item := range strings.Split(entry, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
 func ensureDirExists(path string) error {
 	sanitized := strings.TrimSpace(path)
 	if sanitized == "" {
@@ -469,8 +1158,24 @@ func (c *Config) ResolveOriginalPath(relative string) (string, error) {
 }
 
 // CachePath returns the computed cache path for requested geometry and asset.
-func (c *Config) CachePath(width, height int, relative string) string {
-	prefix := formatGeometryPrefix(width, height)
+// Optional qualifiers (fit mode, etc.) are appended to the geometry directory
+// so variants of the same size never share a cache entry.
+func (c *Config) CachePath(width, height int, relative string, qualifiers ...string) string {
+	return c.cachePath(formatGeometryPrefix(width, height), relative, qualifiers)
+}
+
+// PresetCachePath returns the cache path of a preset variant. The directory
+// combines the preset name with its settings fingerprint.
+func (c *Config) PresetCachePath(name string, preset PresetConfig, relative string, qualifiers ...string) string {
+	return c.cachePath("preset-"+name+"-"+preset.Fingerprint(), relative, qualifiers)
+}
+
+func (c *Config) cachePath(prefix, relative string, qualifiers []string) string {
+	for _, q := range qualifiers {
+		if q != "" {
+			prefix += "-" + q
+		}
+	}
 	prepared := strings.TrimPrefix(relative, "/")
 	clean := filepath.Clean(prepared)
 	return filepath.Join(c.Storage.CacheDir, prefix, filepath.FromSlash(clean))
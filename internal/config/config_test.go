@@ -2,7 +2,10 @@ package config
 
 import (
 	"fmt"
+	"image/color"
+	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -41,6 +44,65 @@ func TestParseByteSizeInvalid(t *testing.T) {
 	}
 }
 
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		input string
+		want  color.NRGBA
+	}{
+		{"fff", color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}},
+		{"#0f08", color.NRGBA{R: 0x00, G: 0xff, B: 0x00, A: 0x88}},
+		{"1a2b3c", color.NRGBA{R: 0x1a, G: 0x2b, B: 0x3c, A: 0xff}},
+		{"#1A2B3C00", color.NRGBA{R: 0x1a, G: 0x2b, B: 0x3c, A: 0x00}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := configutil.ParseColor(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("expected %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+	for _, input := range []string{"", "#", "ff", "fffff", "ggg", "#1a2b3c4d5e"} {
+		if _, err := configutil.ParseColor(input); err == nil {
+			t.Fatalf("expected error for %q", input)
+		}
+	}
+}
+
+func TestParseOps(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", ""},
+		{"grayscale", "grayscale"},
+		{"blur:4.0, Greyscale", "grayscale,blur:4"},
+		{"rotate:-90,flop,flip", "rotate:270,flip,flop"},
+		{"rotate:360", ""},
+		{"tint:#FA0,sharpen", "tint:ffaa00,sharpen:1"},
+		{"contrast:1.2,brightness:0.8,sharpen:2", "brightness:0.8,contrast:1.2,sharpen:2"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := configutil.ParseOps(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.String() != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got.String())
+			}
+		})
+	}
+	for _, input := range []string{"sepia", "blur", "blur:0", "blur:500", "rotate:45", "flip:1", "tint:red", "brightness:-1", "grayscale,greyscale", "sharpen:20"} {
+		if _, err := configutil.ParseOps(input); err == nil {
+			t.Fatalf("expected error for %q", input)
+		}
+	}
+}
+
 func TestLoadFromEnvOrFileLegacyEnv(t *testing.T) {
 	baseDir := t.TempDir()
 	cacheDir := filepath.Join(t.TempDir(), "cache")
@@ -51,11 +113,14 @@ func TestLoadFromEnvOrFileLegacyEnv(t *testing.T) {
 	t.Setenv("CACHE_DIR", cacheDir)
 	t.Setenv("MAX_WIDTH", "1500")
 	t.Setenv("MAX_HEIGHT", "800")
+	t.Setenv("MAX_DPR", "2.5")
 	t.Setenv("JPG_QUALITY", "90")
 	t.Setenv("WEBP_QUALITY", "88")
 	t.Setenv("AVIF_QUALITY", "55")
 	t.Setenv("PNG_COMPRESSION", "4")
 	t.Setenv("AVIF_SPEED", "6")
+	t.Setenv("JXL_QUALITY", "65")
+	t.Setenv("JXL_EFFORT", "4")
 	t.Setenv("GOMAXPROCS", "6")
 	t.Setenv("VIPS_CONCURRENCY", "5")
 	t.Setenv("TTL", "24h")
@@ -76,7 +141,7 @@ func TestLoadFromEnvOrFileLegacyEnv(t *testing.T) {
 	if cfg.Storage.CacheDir != cacheDir {
 		t.Fatalf("unexpected cache dir: %s", cfg.Storage.CacheDir)
 	}
-	if cfg.Resize.MaxWidth != 1500 || cfg.Resize.MaxHeight != 800 {
+	if cfg.Resize.MaxWidth != 1500 || cfg.Resize.MaxHeight != 800 || cfg.Resize.MaxDPR != 2.5 {
 		t.Fatalf("unexpected resize limits: %+v", cfg.Resize)
 	}
 	if cfg.Resize.JPGQuality != 90 || cfg.Resize.WebPQuality != 88 || cfg.Resize.AVIFQuality != 55 || cfg.Resize.PNGCompression != 4 {
@@ -85,6 +150,9 @@ func TestLoadFromEnvOrFileLegacyEnv(t *testing.T) {
 	if cfg.Resize.AVIFSpeed != 6 {
 		t.Fatalf("unexpected avif speed: %d", cfg.Resize.AVIFSpeed)
 	}
+	if cfg.Resize.JXLQuality != 65 || cfg.Resize.JXLEffort != 4 {
+		t.Fatalf("unexpected jxl settings: %+v", cfg.Resize)
+	}
 	if cfg.Cache.TTL.Duration != 24*time.Hour {
 		t.Fatalf("unexpected cache TTL: %s", cfg.Cache.TTL)
 	}
@@ -112,8 +180,18 @@ func TestLoadFromEnvOrFileWithPrefixedKeys(t *testing.T) {
 	t.Setenv("FARS_RESIZE__MAX_WIDTH", "1800")
 	t.Setenv("FARS_RESIZE__MAX_HEIGHT", "900")
 	t.Setenv("FARS_RESIZE__AVIF_SPEED", "4")
+	t.Setenv("FARS_RESIZE__MAX_SOURCE_BYTES", "20mb")
+	t.Setenv("FARS_RESIZE__MAX_SOURCE_PIXELS", "50000000")
 	t.Setenv("FARS_RUNTIME__GOMAXPROCS", "3")
 	t.Setenv("FARS_RUNTIME__VIPS_CONCURRENCY", "7")
+	t.Setenv("FARS_RUNTIME__COALESCE_TIMEOUT", "5s")
+	t.Setenv("FARS_RUNTIME__PROCESSING_TIMEOUT", "10s")
+	t.Setenv("FARS_NEGOTIATION__ENABLED", "true")
+	t.Setenv("FARS_NEGOTIATION__FORMATS", "webp, avif")
+	t.Setenv("FARS_OPERATIONS__ENABLED", "true")
+	t.Setenv("FARS_OPERATIONS__ALLOWED", "Greyscale, blur")
+	t.Setenv("FARS_SIGNING__ENFORCE", "true")
+	t.Setenv("FARS_SIGNING__SECRETS", "current,previous")
 
 	cfg, err := LoadFromEnvOrFile("")
 	if err != nil {
@@ -137,9 +215,21 @@ func TestLoadFromEnvOrFileWithPrefixedKeys(t *testing.T) {
 	if cfg.Resize.AVIFSpeed != 4 {
 		t.Fatalf("unexpected avif speed: %d", cfg.Resize.AVIFSpeed)
 	}
-	if cfg.Runtime.GOMAXPROCS != 3 || cfg.Runtime.VIPSConcurrency != 7 {
+	if cfg.Resize.MaxSourceBytes.Bytes != 20<<20 || cfg.Resize.MaxSourcePixels != 50_000_000 {
+		t.Fatalf("unexpected source limits: %+v", cfg.Resize)
+	}
+	if cfg.Runtime.GOMAXPROCS != 3 || cfg.Runtime.VIPSConcurrency != 7 || cfg.Runtime.CoalesceTimeout.Duration != 5*time.Second || cfg.Runtime.ProcessingTimeout.Duration != 10*time.Second {
 		t.Fatalf("unexpected runtime config: %+v", cfg.Runtime)
 	}
+	if !cfg.Operations.Enabled || !reflect.DeepEqual(cfg.Operations.Allowed, []string{"grayscale", "blur"}) {
+		t.Fatalf("unexpected operations config: %+v", cfg.Operations)
+	}
+	if !cfg.Negotiation.Enabled || !reflect.DeepEqual(cfg.Negotiation.Formats, []string{"webp", "avif"}) {
+		t.Fatalf("unexpected negotiation config: %+v", cfg.Negotiation)
+	}
+	if !cfg.Signing.Enforce || !reflect.DeepEqual(cfg.Signing.Secrets, []string{"current", "previous"}) {
+		t.Fatalf("unexpected signing config: %+v", cfg.Signing)
+	}
 }
 
 func TestParseFlexibleDuration(t *testing.T) {
@@ -246,6 +336,13 @@ func TestCachePathFormatsSingleDimension(t *testing.T) {
 		},
 	}
 
+	if got := cfg.CachePath(200, 200, "foo/bar.jpg", "cover"); got != filepath.Join(cache, "200x200-cover", "foo", "bar.jpg") {
+		t.Fatalf("unexpected qualified cache path: %s", got)
+	}
+	if got := cfg.CachePath(200, 200, "foo/bar.jpg", ""); got != filepath.Join(cache, "200x200", "foo", "bar.jpg") {
+		t.Fatalf("empty qualifier should keep bare geometry: %s", got)
+	}
+
 	for _, tc := range testCases {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
@@ -277,6 +374,10 @@ resize:
 cache:
   ttl: "30d"
   cleanup_interval: "24h"
+  max_size: "10gb"
+  max_files: 50000
+  eviction: LFU
+  stats_interval: "15m"
 `, filepath.ToSlash(base), filepath.ToSlash(cache))
 
 	cfg, err := LoadReader(strings.NewReader(yamlConfig))
@@ -289,4 +390,300 @@ cache:
 	if cfg.Cache.CleanupInterval.Duration != 24*time.Hour {
 		t.Fatalf("unexpected cleanup interval: %s", cfg.Cache.CleanupInterval)
 	}
+	if cfg.Cache.MaxSize.Bytes != 10<<30 || cfg.Cache.MaxFiles != 50000 || cfg.Cache.Eviction != "lfu" {
+		t.Fatalf("unexpected cache limits: %+v", cfg.Cache)
+	}
+	if cfg.Cache.StatsInterval.Duration != 15*time.Minute {
+		t.Fatalf("unexpected stats interval: %s", cfg.Cache.StatsInterval)
+	}
+}
+
+func TestPathSettingsLongestPrefix(t *testing.T) {
+	base := t.TempDir()
+	cache := t.TempDir()
+	yamlConfig := fmt.Sprintf(`
+storage:
+  base_dir: %q
+  cache_dir: %q
+paths:
+  - prefix: "img/"
+    gravity: north
+  - prefix: "/img/p/"
+    gravity: attention
+  - prefix: "img/b"
+    gravity: south
+  - prefix: "img/c/"
+    focus: "0.5,0.2"
+    trim: true
+    trim_threshold: 0
+    trim_background: "#fff"
+`, filepath.ToSlash(base), filepath.ToSlash(cache))
+
+	cfg, err := LoadReader(strings.NewReader(yamlConfig))
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if got := cfg.PathSettings("img/p/1/1.jpg").Gravity; got != "attention" {
+		t.Fatalf("expected longest prefix gravity, got %q", got)
+	}
+	if got := cfg.PathSettings("img/c/3.jpg").Focus; got != "0.5,0.2" {
+		t.Fatalf("unexpected focus: %q", got)
+	}
+	// YAML booleans reach string fields as "1"/"0".
+	if got := cfg.PathSettings("img/c/3.jpg").Trim; got != "1" {
+		t.Fatalf("unexpected trim: %q", got)
+	}
+	if got := cfg.PathSettings("img/c/3.jpg"); got.TrimThreshold == nil || *got.TrimThreshold != 0 || got.TrimBackground != "#fff" {
+		t.Fatalf("unexpected trim settings: %v %q", got.TrimThreshold, got.TrimBackground)
+	}
+	if got := cfg.PathSettings("img/p/3.jpg").TrimThreshold; got != nil {
+		t.Fatalf("expected an unset trim threshold to stay nil, got %v", *got)
+	}
+	if got := cfg.PathSettings("img/m/3.jpg").Gravity; got != "north" {
+		t.Fatalf("unexpected fallback gravity: %q", got)
+	}
+	if got := cfg.PathSettings("other/3.jpg"); got.Prefix != "" {
+		t.Fatalf("expected no match, got %+v", got)
+	}
+	// Prefixes match whole path segments, with or without a trailing slash.
+	if got := cfg.PathSettings("img/b/3.jpg").Gravity; got != "south" {
+		t.Fatalf("expected img/b to match img/b/, got gravity %q", got)
+	}
+	if got := cfg.PathSettings("img/banner.jpg").Gravity; got != "north" {
+		t.Fatalf("expected img/b not to match img/banner.jpg, got gravity %q", got)
+	}
+	if got := cfg.PathSettings("imgs/3.jpg"); got.Prefix != "" {
+		t.Fatalf("expected img/ not to match imgs/, got %+v", got)
+	}
+}
+
+func TestPathSettingsValidation(t *testing.T) {
+	base := t.TempDir()
+	cache := t.TempDir()
+	for _, entry := range []string{
+		`{prefix: "img/", gravity: "sideways"}`,
+		`{prefix: "img/", focus: "2,0"}`,
+		`{prefix: "img/", focus: "nan,0"}`,
+		`{prefix: "img/", background: "red"}`,
+		`{prefix: "img/", padding: "stripes"}`,
+		`{prefix: "img/", upscale: "0.5x"}`,
+		`{prefix: "img/", trim: "sometimes"}`,
+		`{prefix: "img/", trim_threshold: 300}`,
+		`{prefix: "img/", trim_background: "white"}`,
+		`{prefix: "img/", poster: "first"}`,
+		`{gravity: "north"}`,
+	} {
+		yamlConfig := fmt.Sprintf("storage:\n  base_dir: %q\n  cache_dir: %q\npaths:\n  - %s\n", filepath.ToSlash(base), filepath.ToSlash(cache), entry)
+		if _, err := LoadReader(strings.NewReader(yamlConfig)); err == nil {
+			t.Fatalf("expected validation error for %s", entry)
+		}
+	}
+}
+
+func TestWatermarksFromYAML(t *testing.T) {
+	base := t.TempDir()
+	cache := t.TempDir()
+	logo := filepath.Join(t.TempDir(), "logo.png")
+	if err := os.WriteFile(logo, []byte("png"), 0o644); err != nil {
+		t.Fatalf("write logo: %v", err)
+	}
+	yamlConfig := fmt.Sprintf(`
+storage:
+  base_dir: %q
+  cache_dir: %q
+watermarks:
+  - pattern: "^img/p/.+-large"
+    image: %q
+    position: North-West
+    opacity: 0.4
+  - prefix: "img/p/"
+    min_size: 600
+    image: %q
+    margin: 16
+    scale: 0.2
+`, filepath.ToSlash(base), filepath.ToSlash(cache), filepath.ToSlash(logo), filepath.ToSlash(logo))
+	cfg, err := LoadReader(strings.NewReader(yamlConfig))
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	rule, ok := cfg.Watermark("img/p/1/1-large.jpg")
+	if !ok || rule.Position != "north-west" || rule.Opacity != 0.4 {
+		t.Fatalf("expected the pattern rule first, got %+v (ok=%v)", rule, ok)
+	}
+	rule, ok = cfg.Watermark("img/p/1/1.jpg")
+	if !ok || rule.Position != "south-east" || rule.Opacity != 1 || rule.MinSize != 600 {
+		t.Fatalf("expected the prefix rule with defaults, got %+v (ok=%v)", rule, ok)
+	}
+	if _, ok := cfg.Watermark("img/c/1.jpg"); ok {
+		t.Fatalf("expected no rule for other paths")
+	}
+	edited := rule
+	edited.Margin = 8
+	if edited.Fingerprint() == rule.Fingerprint() {
+		t.Fatalf("expected fingerprint to change with rule settings")
+	}
+}
+
+func TestWatermarkValidation(t *testing.T) {
+	base := t.TempDir()
+	cache := t.TempDir()
+	logo := filepath.ToSlash(filepath.Join(t.TempDir(), "logo.png"))
+	if err := os.WriteFile(logo, []byte("png"), 0o644); err != nil {
+		t.Fatalf("write logo: %v", err)
+	}
+	for _, entry := range []string{
+		fmt.Sprintf(`{image: %q}`, logo),
+		fmt.Sprintf(`{prefix: "img/", pattern: "^img/", image: %q}`, logo),
+		fmt.Sprintf(`{pattern: "img/(", image: %q}`, logo),
+		`{prefix: "img/"}`,
+		`{prefix: "img/", image: "/does/not/exist.png"}`,
+		fmt.Sprintf(`{prefix: "img/", image: %q, position: "top"}`, logo),
+		fmt.Sprintf(`{prefix: "img/", image: %q, opacity: 1.5}`, logo),
+		fmt.Sprintf(`{prefix: "img/", image: %q, scale: 2}`, logo),
+		fmt.Sprintf(`{prefix: "img/", image: %q, margin: -1}`, logo),
+	} {
+		yamlConfig := fmt.Sprintf("storage:\n  base_dir: %q\n  cache_dir: %q\nwatermarks:\n  - %s\n", filepath.ToSlash(base), filepath.ToSlash(cache), entry)
+		if _, err := LoadReader(strings.NewReader(yamlConfig)); err == nil {
+			t.Fatalf("expected validation error for %s", entry)
+		}
+	}
+}
+
+func TestPresetsFromYAML(t *testing.T) {
+	base := t.TempDir()
+	cache := t.TempDir()
+	yamlConfig := fmt.Sprintf(`
+storage:
+  base_dir: %q
+  cache_dir: %q
+resize:
+  webp_quality: 75
+presets:
+  thumb:
+    width: 120
+    height: 120
+    fit: Cover
+    gravity: north
+    format: WEBP
+    webp_quality: 60
+    png_compression: 0
+  hero:
+    width: 1600
+    format: jxl
+    jxl_effort: 9
+    gif_quality: 50
+`, filepath.ToSlash(base), filepath.ToSlash(cache))
+	cfg, err := LoadReader(strings.NewReader(yamlConfig))
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	thumb, ok := cfg.Presets["thumb"]
+	if !ok {
+		t.Fatalf("missing preset: %+v", cfg.Presets)
+	}
+	if thumb.Fit != "cover" || thumb.Format != "webp" {
+		t.Fatalf("expected normalised preset, got %+v", thumb)
+	}
+	// An explicit zero overrides the resize setting; unset fields inherit it.
+	if enc := thumb.Encoding(cfg.Resize); enc.WebPQuality != 60 || enc.PNGCompression != 0 || enc.JPGQuality != cfg.Resize.JPGQuality {
+		t.Fatalf("unexpected encoding overrides: %+v", enc)
+	}
+	if enc := cfg.Presets["hero"].Encoding(cfg.Resize); enc.JXLEffort != 9 || enc.JXLQuality != 75 || enc.GIFQuality != 50 {
+		t.Fatalf("unexpected jxl overrides: %+v", enc)
+	}
+
+	path := cfg.PresetCachePath("thumb", thumb, "img/p/1.jpg.webp")
+	expected := filepath.Join(cache, "preset-thumb-"+thumb.Fingerprint(), "img", "p", "1.jpg.webp")
+	if path != expected {
+		t.Fatalf("unexpected preset cache path: %s", path)
+	}
+	edited := thumb
+	edited.Width = 150
+	if edited.Fingerprint() == thumb.Fingerprint() {
+		t.Fatalf("expected fingerprint to change with preset settings")
+	}
+	quality := 61
+	edited = thumb
+	edited.WebPQuality = &quality
+	if edited.Fingerprint() == thumb.Fingerprint() {
+		t.Fatalf("expected fingerprint to change with encoder overrides")
+	}
+	same := 60
+	edited.WebPQuality = &same
+	if edited.Fingerprint() != thumb.Fingerprint() {
+		t.Fatalf("expected fingerprint to depend on override values only")
+	}
+}
+
+func TestPresetValidation(t *testing.T) {
+	base := t.TempDir()
+	cache := t.TempDir()
+	for _, entry := range []string{
+		`thumb: {width: 0, height: 0}`,
+		`thumb: {width: 5000, height: 100}`,
+		`thumb: {width: 100, fit: cover}`,
+		`thumb: {width: 100, height: 100, fit: squash}`,
+		`thumb: {width: 100, height: 100, gravity: north}`,
+		`thumb: {width: 100, height: 100, fit: cover, padding: blur}`,
+		`thumb: {width: 100, height: 100, fit: fill, upscale: always}`,
+		`thumb: {width: 100, format: bmp}`,
+		`thumb: {width: 100, webp_quality: 120}`,
+		`thumb: {width: 100, jxl_effort: 10}`,
+		`thumb: {width: 100, jxl_effort: 0}`,
+		`thumb: {width: 100, jpg_quality: 0}`,
+		`thumb: {width: 100, ops: "blur:0"}`,
+		`"../thumb": {width: 100}`,
+	} {
+		yamlConfig := fmt.Sprintf("storage:\n  base_dir: %q\n  cache_dir: %q\npresets:\n  %s\n", filepath.ToSlash(base), filepath.ToSlash(cache), entry)
+		if _, err := LoadReader(strings.NewReader(yamlConfig)); err == nil {
+			t.Fatalf("expected validation error for %s", entry)
+		}
+	}
+}
+
+func TestAllowedSizes(t *testing.T) {
+	base := t.TempDir()
+	cache := t.TempDir()
+	yamlConfig := fmt.Sprintf(`
+storage:
+  base_dir: %q
+  cache_dir: %q
+sizes:
+  allowed: ["200x200", "x120"]
+  policy: Snap
+  redirect: 301
+paths:
+  - prefix: "img/c/"
+    sizes: ["800x"]
+`, filepath.ToSlash(base), filepath.ToSlash(cache))
+	cfg, err := LoadReader(strings.NewReader(yamlConfig))
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.Sizes.Policy != SizePolicySnap {
+		t.Fatalf("unexpected policy: %q", cfg.Sizes.Policy)
+	}
+	if got := cfg.AllowedSizes("img/p/1.jpg"); !reflect.DeepEqual(got, []Size{{200, 200}, {0, 120}}) {
+		t.Fatalf("unexpected global sizes: %+v", got)
+	}
+	if got := cfg.AllowedSizes("img/c/3.jpg"); !reflect.DeepEqual(got, []Size{{800, 0}}) {
+		t.Fatalf("unexpected prefix sizes: %+v", got)
+	}
+}
+
+func TestSizesValidation(t *testing.T) {
+	base := t.TempDir()
+	cache := t.TempDir()
+	for _, entry := range []string{
+		`{allowed: ["200by200"]}`,
+		`{allowed: ["5000x200"]}`,
+		`{policy: shrink}`,
+		`{policy: reject, redirect: 301}`,
+		`{policy: snap, redirect: 307}`,
+	} {
+		yamlConfig := fmt.Sprintf("storage:\n  base_dir: %q\n  cache_dir: %q\nsizes: %s\n", filepath.ToSlash(base), filepath.ToSlash(cache), entry)
+		if _, err := LoadReader(strings.NewReader(yamlConfig)); err == nil {
+			t.Fatalf("expected validation error for %s", entry)
+		}
+	}
 }
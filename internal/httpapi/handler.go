@@ -1,15 +1,21 @@
 package httpapi
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"image/color"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -18,26 +24,97 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"fars/internal/admission"
 	"fars/internal/cache"
 	"fars/internal/config"
 	"fars/internal/locker"
 	"fars/internal/processor"
 	"fars/internal/version"
+	"fars/pkg/configutil"
+	"fars/pkg/urlsign"
 )
 
 var (
-	extensionToFormat = map[string]processor.Format{
+	errSourceTooLarge      = errors.New("source file exceeds resize.max_source_bytes")
+	errSourceTooManyPixels = errors.New("source image exceeds resize.max_source_pixels")
+	errSourceTooManyFrames = errors.New("source animation exceeds resize.max_frames")
+	extensionToFormat      = map[string]processor.Format{
 		".jpg":  processor.FormatJPEG,
 		".jpeg": processor.FormatJPEG,
 		".png":  processor.FormatPNG,
 		".webp": processor.FormatWEBP,
 		".avif": processor.FormatAVIF,
+		".gif":  processor.FormatGIF,
+		".jxl":  processor.FormatJXL,
 	}
 	formatContentType = map[processor.Format]string{
 		processor.FormatJPEG: "image/jpeg",
 		processor.FormatPNG:  "image/png",
 		processor.FormatWEBP: "image/webp",
 		processor.FormatAVIF: "image/avif",
+		processor.FormatGIF:  "image/gif",
+		processor.FormatJXL:  "image/jxl",
+	}
+	formatExtension = map[processor.Format]string{
+		processor.FormatJPEG: ".jpg",
+		processor.FormatPNG:  ".png",
+		processor.FormatWEBP: ".webp",
+		processor.FormatAVIF: ".avif",
+		processor.FormatGIF:  ".gif",
+		processor.FormatJXL:  ".jxl",
+	}
+	// sourceExtensions lists the originals the handler resolves. Formats that
+	// are never written back (HEIC, TIFF, BMP, SVG) are decoded from
+	// their content and served as outputFor picks.
+	sourceExtensions = map[string]struct{}{
+		".jpg":  {},
+		".jpeg": {},
+		".png":  {},
+		".webp": {},
+		".avif": {},
+		".gif":  {},
+		".heic": {},
+		".heif": {},
+		".tif":  {},
+		".tiff": {},
+		".bmp":  {},
+		".jxl":  {},
+		".svg":  {},
+	}
+	// fitSuffixes maps the optional geometry suffix (e.g. `200x200c`) to a fit mode.
+	fitSuffixes = map[byte]processor.Fit{
+		'c': processor.FitCover,
+		'f': processor.FitFill,
+		'i': processor.FitInside,
+	}
+	gravityNames = map[string]processor.Gravity{
+		"centre":    processor.GravityCentre,
+		"center":    processor.GravityCentre,
+		"north":     processor.GravityNorth,
+		"south":     processor.GravitySouth,
+		"east":      processor.GravityEast,
+		"west":      processor.GravityWest,
+		"attention": processor.GravityAttention,
+		"entropy":   processor.GravityEntropy,
+	}
+	// watermarkAnchors maps watermark positions to processor anchors.
+	watermarkAnchors = map[string][2]float64{
+		"centre":     {0.5, 0.5},
+		"center":     {0.5, 0.5},
+		"north":      {0.5, 0},
+		"south":      {0.5, 1},
+		"east":       {1, 0.5},
+		"west":       {0, 0.5},
+		"north-east": {1, 0},
+		"north-west": {0, 0},
+		"south-east": {1, 1},
+		"south-west": {0, 1},
+	}
+	paddingNames = map[string]processor.Padding{
+		"solid":  processor.PaddingSolid,
+		"blur":   processor.PaddingBlur,
+		"edge":   processor.PaddingEdge,
+		"mirror": processor.PaddingMirror,
 	}
 )
 
@@ -46,17 +123,19 @@ type Handler struct {
 	cfg       *config.Config
 	cache     *cache.Manager
 	processor *processor.Processor
-	locks     *locker.KeyedLocker
+	flights   *locker.Group
+	admission *admission.Controller
 	logger    *slog.Logger
 }
 
 // NewHandler constructs the HTTP handler.
-func NewHandler(cfg *config.Config, cache *cache.Manager, processor *processor.Processor, locks *locker.KeyedLocker, logger *slog.Logger) *Handler {
+func NewHandler(cfg *config.Config, cache *cache.Manager, processor *processor.Processor, flights *locker.Group, admission *admission.Controller, logger *slog.Logger) *Handler {
 	return &Handler{
 		cfg:       cfg,
 		cache:     cache,
 		processor: processor,
-		locks:     locks,
+		flights:   flights,
+		admission: admission,
 		logger:    logger.With("component", "handler"),
 	}
 }
@@ -64,21 +143,120 @@ func NewHandler(cfg *config.Config, cache *cache.Manager, processor *processor.P
 // Register attaches routes to gin engine.
 func (h *Handler) Register(r *gin.Engine) {
 	r.GET("/resize/:geometry/*filepath", h.handleResize)
+	r.HEAD("/resize/:geometry/*filepath", h.handleResize)
+	r.GET("/preset/:name/*filepath", h.handlePreset)
+	r.HEAD("/preset/:name/*filepath", h.handlePreset)
 }
 
 func (h *Handler) handleResize(c *gin.Context) {
 	start := time.Now()
-	geometry := c.Param("geometry")
-	width, height, err := parseGeometry(geometry)
+	if err := h.verifySignature(c); err != nil {
+		h.respondError(c, http.StatusForbidden, err)
+		return
+	}
+	geom, err := parseGeometry(c.Param("geometry"))
 	if err != nil {
 		h.respondError(c, http.StatusBadRequest, err)
 		return
 	}
+	if geom.dpr > 1 && geom.dpr > h.cfg.Resize.MaxDPR {
+		h.respondError(c, http.StatusBadRequest, fmt.Errorf("pixel ratio %gx exceeds limit %gx", geom.dpr, h.cfg.Resize.MaxDPR))
+		return
+	}
+	width, height := geom.pixelSize()
 	if err := h.validateDimensions(width, height); err != nil {
 		h.respondError(c, http.StatusBadRequest, err)
 		return
 	}
+	ops, err := h.parseOps(c.Query("ops"))
+	if err != nil {
+		h.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	h.serveVariant(c, start, variantSpec{
+		width:      width,
+		height:     height,
+		fit:        geom.fit,
+		gravity:    c.Query("gravity"),
+		focus:      c.Query("focus"),
+		background: c.Query("bg"),
+		padding:    c.Query("pad"),
+		upscale:    c.Query("upscale"),
+		trim:       c.Query("trim"),
+		poster:     c.Query("poster"),
+		ops:        ops,
+		encoding:   h.cfg.Resize,
+		checkSize:  true,
+		cachePath: func(width, height int, rel string, qualifiers ...string) string {
+			return h.cfg.CachePath(width, height, rel, append([]string{fitQualifier(geom.fit)}, qualifiers...)...)
+		},
+	})
+}
+
+func (h *Handler) handlePreset(c *gin.Context) {
+	start := time.Now()
+	if err := h.verifySignature(c); err != nil {
+		h.respondError(c, http.StatusForbidden, err)
+		return
+	}
+	name := c.Param("name")
+	preset, ok := h.cfg.Presets[name]
+	if !ok {
+		h.respondError(c, http.StatusNotFound, fmt.Errorf("unknown preset %q", name))
+		return
+	}
+	spec := variantSpec{
+		width:          preset.Width,
+		height:         preset.Height,
+		fit:            processor.FitContain,
+		gravity:        preset.Gravity,
+		focus:          preset.Focus,
+		background:     preset.Background,
+		padding:        preset.Padding,
+		upscale:        preset.Upscale,
+		trim:           preset.Trim,
+		trimThreshold:  preset.TrimThreshold,
+		trimBackground: preset.TrimBackground,
+		poster:         preset.Poster,
+		encoding:       preset.Encoding(h.cfg.Resize),
+		cachePath: func(_, _ int, rel string, qualifiers ...string) string {
+			return h.cfg.PresetCachePath(name, preset, rel, qualifiers...)
+		},
+	}
+	if preset.Fit != "" {
+		spec.fit = processor.Fit(preset.Fit)
+	}
+	if preset.Format != "" {
+		spec.format = extensionToFormat["."+preset.Format]
+	}
+	// Validated at load.
+	spec.ops, _ = configutil.ParseOps(preset.Ops)
+	h.serveVariant(c, start, spec)
+}
 
+// variantSpec describes the variant a route asks for; serveVariant resolves
+// the source, serves the cache or renders it the same way for every route.
+type variantSpec struct {
+	width          int
+	height         int
+	fit            processor.Fit
+	format         processor.Format // forces the output format when set
+	gravity        string           // explicit crop gravity; empty falls back to path defaults
+	focus          string           // explicit focal point; empty falls back to path defaults
+	background     string           // explicit canvas colour; empty falls back to path and global defaults
+	padding        string           // explicit letterbox fill; empty falls back to path and global defaults
+	upscale        string           // explicit upscaling policy; empty falls back to path and global defaults
+	trim           string           // explicit border trimming (true/false); empty falls back to path and global defaults
+	trimThreshold  *float64         // explicit trim threshold; nil falls back to path and global defaults
+	trimBackground string           // explicit trim border colour; empty falls back to path and global defaults
+	poster         string           // explicit first-frame poster of animations (true/false); empty falls back to path and global defaults
+	ops            configutil.Ops   // image operations
+	encoding       config.ResizeConfig
+	checkSize      bool // applies the sizes allow-list
+	cachePath      func(width, height int, rel string, qualifiers ...string) string
+}
+
+func (h *Handler) serveVariant(c *gin.Context, start time.Time, spec variantSpec) {
 	relative := c.Param("filepath")
 	if relative == "" {
 		h.respondError(c, http.StatusBadRequest, errors.New("path is required"))
@@ -97,17 +275,21 @@ func (h *Handler) handleResize(c *gin.Context) {
 	rawExt := filepath.Ext(relative)
 	ext := strings.ToLower(rawExt)
 	format, ok := extensionToFormat[ext]
-	if !ok {
+	_, sourceOnly := sourceExtensions[ext]
+	sourceOnly = sourceOnly && !ok
+	auto := ext == autoExtension && h.cfg.Negotiation.Enabled
+	if !ok && !auto && !sourceOnly {
 		h.respondError(c, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported extension %q", ext))
 		return
 	}
 	candidates := buildSourceCandidates(relative, rawExt)
 	var (
 		cacheRel     string
+		sourceRel    string
 		originalPath string
 		originalInfo os.FileInfo
 		lastClean    string
-		ensureOpaque bool
+		negotiate    bool
 	)
 	for i, cand := range candidates {
 		cleanCandidate, candidatePath, err := h.cfg.ResolvePaths(cand.relative)
@@ -130,11 +312,12 @@ func (h *Handler) handleResize(c *gin.Context) {
 		}
 		originalPath = candidatePath
 		originalInfo = info
+		sourceRel = cleanCandidate
 		cacheRel = cleanCandidate
 		if cand.cacheSuffix != "" {
 			cacheRel = cleanCandidate + cand.cacheSuffix
 		}
-		ensureOpaque = hasJPEGExtension(cleanCandidate)
+		negotiate = spec.format == "" && (auto || (cand.cacheSuffix == "" && h.cfg.Negotiation.Enabled && isNegotiableSource(cleanCandidate)))
 		break
 	}
 	if originalInfo == nil {
@@ -146,90 +329,330 @@ func (h *Handler) handleResize(c *gin.Context) {
 		return
 	}
 
-	cachePath := h.cfg.CachePath(width, height, cacheRel)
-	if h.cache.IsFresh(cachePath, originalInfo) {
-		if served := h.tryServeFromCache(c, cachePath, format, originalInfo); served {
-			h.logAccess(c, width, height, cacheRel, originalInfo.ModTime(), true, time.Since(start), nil)
-			return
+	if spec.checkSize {
+		if allowed := h.cfg.AllowedSizes(sourceRel); len(allowed) > 0 {
+			size, exact := snapSize(allowed, spec.width, spec.height)
+			switch {
+			case exact:
+			case h.cfg.Sizes.Policy != config.SizePolicySnap || size == (config.Size{}):
+				h.respondError(c, http.StatusBadRequest, fmt.Errorf("size %dx%d is not allowed", spec.width, spec.height))
+				return
+			case h.cfg.Sizes.Redirect != 0:
+				c.Redirect(h.cfg.Sizes.Redirect, h.canonicalURL(c, size, spec.fit))
+				return
+			default:
+				spec.width, spec.height = size.Width, size.Height
+			}
 		}
 	}
+	width, height := spec.width, spec.height
 
-	release := h.locks.Lock(cachePath)
-	defer release()
-	if h.cache.IsFresh(cachePath, originalInfo) {
-		if served := h.tryServeFromCache(c, cachePath, format, originalInfo); served {
-			h.logAccess(c, width, height, cacheRel, originalInfo.ModTime(), true, time.Since(start), nil)
-			return
-		}
+	switch {
+	case spec.format != "":
+		format = spec.format
+		cacheRel = variantRel(sourceRel, format)
+	case negotiate:
+		format = negotiateFormat(c.GetHeader("Accept"), h.cfg.Negotiation.Formats, outputFor(sourceRel))
+		cacheRel = variantRel(sourceRel, format)
+		c.Header("Vary", "Accept")
+	case sourceOnly:
+		format = outputFor(sourceRel)
+		cacheRel = variantRel(sourceRel, format)
 	}
 
-	source, err := os.ReadFile(originalPath)
+	pathSettings := h.cfg.PathSettings(sourceRel)
+	crop, err := resolveCrop(spec.gravity, spec.focus, spec.fit, pathSettings)
+	if err != nil {
+		h.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	background, err := resolveBackground(spec.background, pathSettings, h.cfg.Resize.Background)
+	if err != nil {
+		h.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	padding, err := resolvePadding(spec.padding, spec.fit, pathSettings, h.cfg.Resize.Padding)
+	if err != nil {
+		h.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	upscale, err := resolveUpscale(spec.upscale, spec.fit, pathSettings, h.cfg.Resize.Upscale)
+	if err != nil {
+		h.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	trim, err := resolveFlag("trim", spec.trim, pathSettings.Trim, h.cfg.Resize.Trim)
+	if err != nil {
+		h.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	poster, err := resolveFlag("poster", spec.poster, pathSettings.Poster, h.cfg.Resize.Poster)
 	if err != nil {
-		h.respondError(c, http.StatusInternalServerError, fmt.Errorf("read original: %w", err))
+		h.respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	watermark, err := resolveWatermark(h.cfg, sourceRel, width, height)
+	if err != nil {
+		h.respondError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	payload, err := h.processor.Resize(source, processor.Options{
+	opts := processor.Options{
 		Width:          width,
 		Height:         height,
 		Format:         format,
-		JPEGQuality:    h.cfg.Resize.JPGQuality,
-		WebPQuality:    h.cfg.Resize.WebPQuality,
-		AVIFQuality:    h.cfg.Resize.AVIFQuality,
-		AVIFSpeed:      h.cfg.Resize.AVIFSpeed,
-		PNGCompression: h.cfg.Resize.PNGCompression,
-		EnsureOpaque:   ensureOpaque,
+		Fit:            spec.fit,
+		Gravity:        crop.gravity,
+		FocalX:         crop.focalX,
+		FocalY:         crop.focalY,
+		JPEGQuality:    spec.encoding.JPGQuality,
+		WebPQuality:    spec.encoding.WebPQuality,
+		AVIFQuality:    spec.encoding.AVIFQuality,
+		AVIFSpeed:      spec.encoding.AVIFSpeed,
+		PNGCompression: spec.encoding.PNGCompression,
+		JXLQuality:     spec.encoding.JXLQuality,
+		JXLEffort:      spec.encoding.JXLEffort,
+		GIFQuality:     spec.encoding.GIFQuality,
+		Background:     background,
+		Padding:        padding,
+		Upscale:        upscale.mode,
+		UpscaleLimit:   upscale.limit,
+		Trim:           trim,
+		Animated:       !poster,
+		Adjust:         adjustments(spec.ops),
+		Watermark:      watermark.mark,
+		// Vector sources never need rendering beyond the largest output.
+		MaxRasterWidth:  h.cfg.Resize.MaxWidth,
+		MaxRasterHeight: h.cfg.Resize.MaxHeight,
+	}
+	if trim {
+		opts.TrimThreshold, opts.TrimBackground = resolveTrim(spec, pathSettings, h.cfg.Resize)
+	}
+	settings := opts.Fingerprint()
+
+	cachePath := spec.cachePath(width, height, cacheRel, crop.qualifier(), backgroundQualifier(background), paddingQualifier(padding), upscale.qualifier(), trimQualifier(trim), posterQualifier(opts), opsQualifier(spec.ops), watermark.qualifier())
+	if h.serveCached(c, cachePath, format, originalInfo, settings) {
+		h.logAccess(c, width, height, cacheRel, originalInfo.ModTime(), true, time.Since(start), nil)
+		return
+	}
+
+	// Oversized originals are refused before anything is read or decoded.
+	if limit := h.cfg.Resize.MaxSourceBytes.Bytes; limit > 0 && originalInfo.Size() > limit {
+		h.respondError(c, http.StatusRequestEntityTooLarge, fmt.Errorf("%w: %s is %d bytes, limit %d", errSourceTooLarge, sourceRel, originalInfo.Size(), limit))
+		return
+	}
+
+	// Concurrent requests for this variant share one generation. It stores
+	// the variant before answering, so a late request finds it cached.
+	payload, _, err := h.flights.Do(c.Request.Context(), cachePath, func(ctx context.Context) ([]byte, error) {
+		if timeout := h.cfg.Runtime.ProcessingTimeout.Duration; timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		// The header alone gives the decoded size, so the limits and the
+		// admission weight are known before the original is read.
+		probe, err := processor.ProbeFile(originalPath)
+		if err != nil {
+			return nil, fmt.Errorf("probe original: %w", err)
+		}
+		pixels, err := h.checkSource(sourceRel, probe, opts)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := h.resizeAdmitted(ctx, sourceRel, originalPath, watermark.image, pixels, opts)
+		if err != nil {
+			return nil, err
+		}
+		// A failed store is logged but does not fail the requests.
+		meta := cache.Metadata{
+			SourcePath:  sourceRel,
+			SourceMTime: originalInfo.ModTime(),
+			SourceSize:  originalInfo.Size(),
+			Settings:    settings,
+		}
+		if err := h.cache.Write(cachePath, payload, meta); err != nil {
+			h.logger.Error("cache store failed",
+				"path", cachePath,
+				"error", err,
+				"origin_mtime", originalInfo.ModTime().UTC(),
+				"width", width,
+				"height", height,
+				"source_path", originalPath,
+			)
+		}
+		return payload, nil
 	})
-	if err != nil {
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client went away; there is nobody left to answer.
+		c.Abort()
+		h.logAccess(c, width, height, cacheRel, originalInfo.ModTime(), false, time.Since(start), err)
+		return
+	case errors.Is(err, errSourceTooLarge):
+		h.respondError(c, http.StatusRequestEntityTooLarge, err)
+		return
+	case errors.Is(err, errSourceTooManyPixels), errors.Is(err, errSourceTooManyFrames):
+		h.respondError(c, http.StatusUnprocessableEntity, err)
+		return
+	case errors.Is(err, processor.ErrUnsupportedSource):
+		h.respondError(c, http.StatusUnsupportedMediaType, err)
+		return
+	case errors.Is(err, admission.ErrQueueFull), errors.Is(err, admission.ErrQueueTimeout):
+		if retry := h.admission.RetryAfter(); retry > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		}
+		h.respondError(c, http.StatusServiceUnavailable, err)
+		return
+	case errors.Is(err, locker.ErrWaitTimeout), errors.Is(err, context.DeadlineExceeded):
+		h.respondError(c, http.StatusGatewayTimeout, err)
+		return
+	case err != nil:
 		h.respondError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	// Serve generated content FIRST with strong caching headers.
-	etag := buildContentETag(payload)
-	modTime := originalInfo.ModTime().UTC()
-
-	if matchETag(c.GetHeader("If-None-Match"), etag) {
-		c.Header("Cache-Control", cacheControlImmutable)
-		c.Header("ETag", etag)
-		c.Header("Last-Modified", modTime.Format(http.TimeFormat))
-		c.Status(http.StatusNotModified)
-	} else if ifModifiedSince := c.GetHeader("If-Modified-Since"); ifModifiedSince != "" {
-		if t, err := http.ParseTime(ifModifiedSince); err == nil && !modTime.After(t.UTC()) {
-			c.Header("Cache-Control", cacheControlImmutable)
-			c.Header("ETag", etag)
-			c.Header("Last-Modified", modTime.Format(http.TimeFormat))
-			c.Status(http.StatusNotModified)
-		} else {
-			c.Header("Content-Type", formatContentType[format])
-			c.Header("Cache-Control", cacheControlImmutable)
-			c.Header("ETag", etag)
-			c.Header("Last-Modified", modTime.Format(http.TimeFormat))
-			c.Header("Content-Length", strconv.Itoa(len(payload)))
-			c.Data(http.StatusOK, formatContentType[format], payload)
-		}
-	} else {
-		c.Header("Content-Type", formatContentType[format])
-		c.Header("Cache-Control", cacheControlImmutable)
-		c.Header("ETag", etag)
-		c.Header("Last-Modified", modTime.Format(http.TimeFormat))
-		c.Header("Content-Length", strconv.Itoa(len(payload)))
-		c.Data(http.StatusOK, formatContentType[format], payload)
-	}
-
-	// THEN try to save to cache; if it fails, log an error but do not fail the request.
-	if err := h.cache.Write(cachePath, payload); err != nil {
-		h.logger.Error("cache store failed",
-			"path", cachePath,
-			"error", err,
-			"origin_mtime", originalInfo.ModTime().UTC(),
-			"width", width,
-			"height", height,
-			"source_path", originalPath,
-		)
+	h.writeVariant(c, format, cache.ContentETag(payload), originalInfo.ModTime(), bytes.NewReader(payload))
+	h.logAccess(c, width, height, cacheRel, originalInfo.ModTime(), false, time.Since(start), nil)
+}
+
+// readSource reads an original, failing with errSourceTooLarge as soon as it
+// turns out longer than limit bytes (zero disables the limit). This also
+// covers files that grew after they were stat'ed.
+func readSource(path string, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return os.ReadFile(path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	source, err := io.ReadAll(io.LimitReader(file, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(source)) > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", errSourceTooLarge, limit)
+	}
+	return source, nil
+}
+
+// checkSource applies max_frames and max_source_pixels to a probed original
+// and returns the pixel count decoding it for opts produces. Animations
+// decode every frame, so they count frames times pixels; SVGs count the size
+// they are rendered at.
+func (h *Handler) checkSource(sourceRel string, probe processor.Probe, opts processor.Options) (int64, error) {
+	if opts.Animates() {
+		if limit := h.cfg.Resize.MaxFrames; limit > 0 && probe.Frames > limit {
+			return 0, fmt.Errorf("%w: %s has %d frames, limit %d", errSourceTooManyFrames, sourceRel, probe.Frames, limit)
+		}
+	}
+	pixels := probe.Pixels(opts)
+	if limit := h.cfg.Resize.MaxSourcePixels; limit > 0 && pixels > limit {
+		return 0, fmt.Errorf("%w: %s has %d pixels, limit %d", errSourceTooManyPixels, sourceRel, pixels, limit)
+	}
+	return pixels, nil
+}
+
+// resizeAdmitted runs a resize once the admission controller has a slot for
+// it. Cache hits never get here, so only real work is queued, and the original
+// and watermark overlay are only read once admitted, so queued jobs hold no
+// image data. A queued job is dropped when ctx ends (its clients left or the
+// deadline passed); once started, the flight keeps it registered and only the
+// deadline stops it, so its result can still be cached and later requests
+// join it.
+func (h *Handler) resizeAdmitted(ctx context.Context, sourceRel, originalPath, watermarkPath string, pixels int64, opts processor.Options) ([]byte, error) {
+	weight := h.admission.Weight(pixels)
+	release, err := h.admission.Acquire(ctx, weight)
+	if err != nil {
+		return nil, err
 	}
+	defer release()
 
-	h.logAccess(c, width, height, cacheRel, originalInfo.ModTime(), false, time.Since(start), nil)
+	if !locker.Start(ctx) {
+		return nil, ctx.Err()
+	}
+	source, err := readSource(originalPath, h.cfg.Resize.MaxSourceBytes.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("read original: %w", err)
+	}
+	// The file may have been replaced since it was probed, so the bytes
+	// that are decoded face the limits again.
+	probe, err := processor.ProbeSource(source)
+	if err != nil {
+		return nil, fmt.Errorf("probe original: %w", err)
+	}
+	if _, err := h.checkSource(sourceRel, probe, opts); err != nil {
+		return nil, err
+	}
+	if watermarkPath != "" {
+		if opts.Watermark.Image, err = readSource(watermarkPath, h.cfg.Resize.MaxSourceBytes.Bytes); err != nil {
+			return nil, fmt.Errorf("read watermark: %w", err)
+		}
+	}
+	return h.processor.Resize(ctx, source, opts)
+}
+
+// snapSize reports whether width x height is allowed, and otherwise returns
+// the nearest allowed size of the same shape (free sides must match), or a
+// zero Size when none exists. Ties go to the larger size.
+func snapSize(allowed []config.Size, width, height int) (config.Size, bool) {
+	var (
+		best     config.Size
+		bestDist = -1
+	)
+	for _, size := range allowed {
+		if size.Width == width && size.Height == height {
+			return size, true
+		}
+		if (size.Width == 0) != (width == 0) || (size.Height == 0) != (height == 0) {
+			continue
+		}
+		dist := absInt(size.Width-width) + absInt(size.Height-height)
+		if bestDist < 0 || dist < bestDist || (dist == bestDist && size.Width+size.Height > best.Width+best.Height) {
+			best, bestDist = size, dist
+		}
+	}
+	return best, false
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// canonicalURL rebuilds the request URL for a snapped size. The pixel ratio
+// is folded into the size, and the URL is re-signed when signing is enforced.
+func (h *Handler) canonicalURL(c *gin.Context, size config.Size, fit processor.Fit) string {
+	geometry := formatGeometry(size.Width, size.Height, fit)
+	target := url.URL{Path: "/resize/" + geometry + c.Param("filepath")}
+	query := c.Request.URL.Query()
+	if h.cfg.Signing.Enforce {
+		query.Set(urlsign.SignatureParam, urlsign.Signature(h.cfg.SigningSecrets()[0], target.Path, query))
+	}
+	target.RawQuery = query.Encode()
+	return target.String()
+}
+
+// formatGeometry renders a geometry segment, e.g. `200x200c` or `x120`.
+func formatGeometry(width, height int, fit processor.Fit) string {
+	var b strings.Builder
+	if width > 0 {
+		b.WriteString(strconv.Itoa(width))
+	}
+	b.WriteByte('x')
+	if height > 0 {
+		b.WriteString(strconv.Itoa(height))
+	}
+	for suffix, mode := range fitSuffixes {
+		if mode == fit {
+			b.WriteByte(suffix)
+		}
+	}
+	return b.String()
 }
 
 type sourceCandidate struct {
@@ -265,7 +688,7 @@ func buildSourceCandidates(relative, rawExt string) []sourceCandidate {
 		return candidates
 	}
 	baseExt := strings.ToLower(filepath.Ext(base))
-	if _, ok := extensionToFormat[baseExt]; ok {
+	if _, ok := sourceExtensions[baseExt]; ok {
 		candidates = append(candidates, sourceCandidate{
 			relative:    base,
 			cacheSuffix: strings.ToLower(rawExt),
@@ -274,9 +697,79 @@ func buildSourceCandidates(relative, rawExt string) []sourceCandidate {
 	return candidates
 }
 
-func hasJPEGExtension(path string) bool {
+// autoExtension requests Accept-header negotiation (`13.jpg.auto`).
+const autoExtension = ".auto"
+
+// isNegotiableSource reports whether a plain request for the path may be
+// answered in a negotiated format.
+func isNegotiableSource(path string) bool {
 	ext := strings.ToLower(filepath.Ext(path))
-	return ext == ".jpg" || ext == ".jpeg"
+	format, ok := extensionToFormat[ext]
+	if !ok {
+		_, ok = sourceExtensions[ext]
+		return ok
+	}
+	return format == processor.FormatJPEG || format == processor.FormatPNG
+}
+
+// outputFor returns the format a source is served in when nothing else picks
+// one: its own format when it can be written, PNG for SVG so transparency
+// survives, and JPEG for the other source-only formats.
+func outputFor(sourceRel string) processor.Format {
+	ext := strings.ToLower(filepath.Ext(sourceRel))
+	if format, ok := extensionToFormat[ext]; ok {
+		return format
+	}
+	if ext == ".svg" {
+		return processor.FormatPNG
+	}
+	return processor.FormatJPEG
+}
+
+// negotiateFormat returns the first preferred format the Accept header allows,
+// falling back to the source format.
+func negotiateFormat(accept string, preferred []string, fallback processor.Format) processor.Format {
+	for _, name := range preferred {
+		format, ok := extensionToFormat["."+name]
+		if !ok {
+			continue
+		}
+		if format == fallback || acceptsMediaType(accept, formatContentType[format]) {
+			return format
+		}
+	}
+	return fallback
+}
+
+// acceptsMediaType reports whether the Accept header explicitly lists the media
+// type with a non-zero quality. Wildcards are ignored on purpose: clients that
+// send only */* cannot be assumed to decode modern formats.
+func acceptsMediaType(accept, mediaType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), mediaType) {
+			continue
+		}
+		for _, param := range fields[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(key, "q") {
+				if q, err := strconv.ParseFloat(value, 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// variantRel returns the cache path of a source rendered in format, adding a
+// double extension when the format differs from the source (`13.jpg.webp`).
+func variantRel(sourceRel string, format processor.Format) string {
+	if extensionToFormat[strings.ToLower(filepath.Ext(sourceRel))] == format {
+		return sourceRel
+	}
+	return sourceRel + formatExtension[format]
 }
 
 func (h *Handler) validateDimensions(width, height int) error {
@@ -292,48 +785,63 @@ func (h *Handler) validateDimensions(width, height int) error {
 	return nil
 }
 
-func (h *Handler) tryServeFromCache(c *gin.Context, cachePath string, format processor.Format, originalInfo os.FileInfo) bool {
+func (h *Handler) tryServeFromCache(c *gin.Context, cachePath string, format processor.Format) bool {
 	info, file, err := h.cache.ServeFileStats(cachePath)
 	if err != nil {
 		return false
 	}
 	defer file.Close()
 
-	payload, err := io.ReadAll(file)
+	meta, err := h.cache.Metadata(cachePath, info, file)
 	if err != nil {
 		return false
 	}
-	etag := buildContentETag(payload)
-	modTime := info.ModTime().UTC()
-
-	if matchETag(c.GetHeader("If-None-Match"), etag) {
-		c.Header("Cache-Control", cacheControlImmutable)
-		c.Header("ETag", etag)
-		c.Header("Last-Modified", modTime.Format(http.TimeFormat))
-		c.Status(http.StatusNotModified)
+	// Entries with metadata report the source mtime, like a fresh render does.
+	modTime := info.ModTime()
+	if !meta.SourceMTime.IsZero() {
+		modTime = meta.SourceMTime
+	}
+	if payload, ok := h.cache.Promote(cachePath, info, file, meta); ok {
+		h.writeVariant(c, format, meta.ETag, modTime, bytes.NewReader(payload))
 		return true
 	}
+	h.writeVariant(c, format, meta.ETag, modTime, file)
+	return true
+}
 
-	ifModifiedSince := c.GetHeader("If-Modified-Since")
-	if ifModifiedSince != "" {
-		if t, err := http.ParseTime(ifModifiedSince); err == nil {
-			if !modTime.After(t.UTC()) {
-				c.Header("Cache-Control", cacheControlImmutable)
-				c.Header("ETag", etag)
-				c.Header("Last-Modified", modTime.Format(http.TimeFormat))
-				c.Status(http.StatusNotModified)
-				return true
-			}
-		}
+// serveCached serves a fresh variant from the memory tier or, failing that,
+// from the disk cache.
+func (h *Handler) serveCached(c *gin.Context, cachePath string, format processor.Format, originalInfo os.FileInfo, settings string) bool {
+	if payload, meta, ok := h.cache.Memory(cachePath, originalInfo, settings); ok {
+		h.writeVariant(c, format, meta.ETag, meta.SourceMTime, bytes.NewReader(payload))
+		return true
 	}
+	return h.cache.IsFresh(cachePath, originalInfo, settings) && h.tryServeFromCache(c, cachePath, format)
+}
 
+// writeVariant sends a variant with its validators; http.ServeContent handles
+// conditional requests, ranges and HEAD.
+func (h *Handler) writeVariant(c *gin.Context, format processor.Format, etag string, modTime time.Time, content io.ReadSeeker) {
 	c.Header("Content-Type", formatContentType[format])
-	c.Header("Cache-Control", cacheControlImmutable)
+	c.Header("Cache-Control", h.cacheControlFor(c))
 	c.Header("ETag", etag)
-	c.Header("Last-Modified", modTime.Format(http.TimeFormat))
-	c.Header("Content-Length", strconv.Itoa(len(payload)))
-	c.Data(http.StatusOK, formatContentType[format], payload)
-	return true
+	http.ServeContent(sendfileWriter{c.Writer}, c.Request, "", modTime, content)
+}
+
+// sendfileWriter lets http.ServeContent reach the connection's io.ReaderFrom,
+// so file bodies go out via sendfile; gin's writer does not expose it.
+type sendfileWriter struct {
+	gin.ResponseWriter
+}
+
+func (w sendfileWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.WriteHeaderNow()
+	if u, ok := w.ResponseWriter.(interface{ Unwrap() http.ResponseWriter }); ok {
+		if rf, ok := u.Unwrap().(io.ReaderFrom); ok {
+			return rf.ReadFrom(r)
+		}
+	}
+	return io.Copy(w.ResponseWriter, r)
 }
 
 func (h *Handler) respondError(c *gin.Context, code int, err error) {
@@ -350,20 +858,376 @@ func (h *Handler) respondError(c *gin.Context, code int, err error) {
 	c.Abort()
 }
 
-func parseGeometry(geometry string) (int, int, error) {
-	parts := strings.SplitN(geometry, "x", 2)
+// geometry is the parsed form of the `{width}x{height}{fit}@{dpr}x` URL segment.
+type geometry struct {
+	width  int
+	height int
+	fit    processor.Fit
+	dpr    float64
+}
+
+// pixelSize returns the output dimensions after applying the pixel ratio.
+func (g geometry) pixelSize() (int, int) {
+	return int(math.Round(float64(g.width) * g.dpr)), int(math.Round(float64(g.height) * g.dpr))
+}
+
+func parseGeometry(raw string) (geometry, error) {
+	dpr := 1.0
+	if size, ratio, ok := strings.Cut(raw, "@"); ok {
+		value, err := parseDPR(ratio)
+		if err != nil {
+			return geometry{}, err
+		}
+		raw, dpr = size, value
+	}
+	parts := strings.SplitN(raw, "x", 2)
 	if len(parts) != 2 {
-		return 0, 0, fmt.Errorf("invalid geometry %q", geometry)
+		return geometry{}, fmt.Errorf("invalid geometry %q", raw)
+	}
+	heightPart := parts[1]
+	fit := processor.FitContain
+	if n := len(heightPart); n > 0 {
+		if mode, ok := fitSuffixes[heightPart[n-1]]; ok {
+			fit = mode
+			heightPart = heightPart[:n-1]
+		}
 	}
 	width, err := parseDimension(parts[0])
 	if err != nil {
-		return 0, 0, fmt.Errorf("invalid width: %w", err)
+		return geometry{}, fmt.Errorf("invalid width: %w", err)
 	}
-	height, err := parseDimension(parts[1])
+	height, err := parseDimension(heightPart)
 	if err != nil {
-		return 0, 0, fmt.Errorf("invalid height: %w", err)
+		return geometry{}, fmt.Errorf("invalid height: %w", err)
+	}
+	if fit != processor.FitContain && (width == 0 || height == 0) {
+		return geometry{}, fmt.Errorf("fit mode %q requires both width and height", fit)
+	}
+	return geometry{width: width, height: height, fit: fit, dpr: dpr}, nil
+}
+
+// parseDPR parses a device pixel ratio suffix such as `2x` or `1.5x`.
+func parseDPR(raw string) (float64, error) {
+	trimmed, ok := strings.CutSuffix(raw, "x")
+	if !ok {
+		return 0, fmt.Errorf("invalid pixel ratio %q", raw)
+	}
+	value, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || math.IsNaN(value) || value < 1 {
+		return 0, fmt.Errorf("invalid pixel ratio %q", raw)
+	}
+	return value, nil
+}
+
+// fitQualifier returns the cache directory qualifier for a fit mode. Contain
+// keeps the bare geometry so existing cache entries stay valid.
+func fitQualifier(fit processor.Fit) string {
+	if fit == "" || fit == processor.FitContain {
+		return ""
+	}
+	return string(fit)
+}
+
+// cropSettings describes which part of the image a cover crop keeps.
+type cropSettings struct {
+	gravity processor.Gravity
+	focalX  float64
+	focalY  float64
+}
+
+// resolveCrop picks the crop from an explicit gravity / focus (the query
+// parameters or a preset), falling back to the defaults of the matching path
+// prefix. Gravity only applies to cover crops; other fit modes reject explicit
+// values and ignore the defaults.
+func resolveCrop(gravity, focus string, fit processor.Fit, defaults config.PathConfig) (cropSettings, error) {
+	if fit != processor.FitCover {
+		if gravity != "" || focus != "" {
+			return cropSettings{}, errors.New("gravity and focus require the cover fit mode")
+		}
+		return cropSettings{}, nil
+	}
+	if gravity == "" && focus == "" {
+		gravity, focus = defaults.Gravity, defaults.Focus
+	}
+	if focus != "" {
+		x, y, err := configutil.ParseFocalPoint(focus)
+		if err != nil {
+			return cropSettings{}, err
+		}
+		return cropSettings{
+			gravity: processor.GravityFocal,
+			focalX:  math.Round(x*1000) / 1000,
+			focalY:  math.Round(y*1000) / 1000,
+		}, nil
+	}
+	if gravity == "" {
+		return cropSettings{gravity: processor.GravityCentre}, nil
+	}
+	named, ok := gravityNames[strings.ToLower(gravity)]
+	if !ok {
+		return cropSettings{}, fmt.Errorf("unknown gravity %q", gravity)
+	}
+	return cropSettings{gravity: named}, nil
+}
+
+// qualifier returns the cache directory qualifier for the crop settings.
+// Centre crops keep the bare fit directory.
+func (s cropSettings) qualifier() string {
+	switch s.gravity {
+	case "", processor.GravityCentre:
+		return ""
+	case processor.GravityFocal:
+		return fmt.Sprintf("focus-%.3f-%.3f", s.focalX, s.focalY)
+	default:
+		return string(s.gravity)
+	}
+}
+
+// resolveBackground picks the canvas colour from an explicit value (the bg
+// query parameter or a preset), falling back to the matching path prefix and
+// then resize.background. The zero colour keeps the processor defaults.
+func resolveBackground(explicit string, defaults config.PathConfig, global string) (color.NRGBA, error) {
+	for _, raw := range []string{explicit, defaults.Background, global} {
+		if raw != "" {
+			return configutil.ParseColor(raw)
+		}
+	}
+	return color.NRGBA{}, nil
+}
+
+// backgroundQualifier returns the cache directory qualifier for a canvas
+// colour. The default keeps the bare directory.
+func backgroundQualifier(bg color.NRGBA) string {
+	if bg == (color.NRGBA{}) {
+		return ""
 	}
-	return width, height, nil
+	return fmt.Sprintf("bg-%02x%02x%02x%02x", bg.R, bg.G, bg.B, bg.A)
+}
+
+// resolvePadding picks the letterbox fill from an explicit value (the pad
+// query parameter or a preset), falling back to the matching path prefix and
+// then resize.padding. Only contain fits have a canvas, so other fits reject
+// an explicit value and ignore the defaults.
+func resolvePadding(explicit string, fit processor.Fit, defaults config.PathConfig, global string) (processor.Padding, error) {
+	if fit != processor.FitContain {
+		if explicit != "" {
+			return "", errors.New("padding requires the contain fit mode")
+		}
+		return "", nil
+	}
+	for _, raw := range []string{explicit, defaults.Padding, global} {
+		if raw == "" {
+			continue
+		}
+		padding, ok := paddingNames[strings.ToLower(raw)]
+		if !ok {
+			return "", fmt.Errorf("unknown padding %q", raw)
+		}
+		return padding, nil
+	}
+	return processor.PaddingSolid, nil
+}
+
+// paddingQualifier returns the cache directory qualifier for a letterbox
+// fill. Solid padding keeps the bare directory.
+func paddingQualifier(padding processor.Padding) string {
+	if padding == "" || padding == processor.PaddingSolid {
+		return ""
+	}
+	return "pad-" + string(padding)
+}
+
+// upscaleSettings is a resolved upscaling policy.
+type upscaleSettings struct {
+	mode  processor.Upscale
+	limit float64
+}
+
+// resolveUpscale picks the upscaling policy from an explicit value (the
+// upscale query parameter or a preset), falling back to the matching path
+// prefix and then resize.upscale. Cover and fill always scale to the box, so
+// they reject an explicit value and ignore the defaults.
+func resolveUpscale(explicit string, fit processor.Fit, defaults config.PathConfig, global string) (upscaleSettings, error) {
+	if fit == processor.FitCover || fit == processor.FitFill {
+		if explicit != "" {
+			return upscaleSettings{}, errors.New("upscale requires the contain or inside fit mode")
+		}
+		return upscaleSettings{}, nil
+	}
+	for _, raw := range []string{explicit, defaults.Upscale, global} {
+		if raw == "" {
+			continue
+		}
+		mode, limit, err := configutil.ParseUpscale(raw)
+		if err != nil {
+			return upscaleSettings{}, err
+		}
+		return upscaleSettings{mode: processor.Upscale(mode), limit: math.Round(limit*100) / 100}, nil
+	}
+	return upscaleSettings{mode: processor.UpscalePad}, nil
+}
+
+// qualifier returns the cache directory qualifier for the policy. Padding,
+// the default, keeps the bare directory.
+func (s upscaleSettings) qualifier() string {
+	switch {
+	case s.mode == "" || s.mode == processor.UpscalePad:
+		return ""
+	case s.limit > 0:
+		return fmt.Sprintf("up-%gx", s.limit)
+	default:
+		return "up-" + string(s.mode)
+	}
+}
+
+// resolveFlag resolves an on/off setting such as trim from an explicit value
+// (a query parameter or a preset), falling back to the matching path prefix
+// and then the global resize setting.
+func resolveFlag(name, explicit, prefix string, global bool) (bool, error) {
+	for _, raw := range []string{explicit, prefix} {
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s %q: expected true or false", name, raw)
+		}
+		return value, nil
+	}
+	return global, nil
+}
+
+// posterQualifier marks posters in formats that could animate, so a poster
+// never shares a cache entry with the animation.
+func posterQualifier(opts processor.Options) string {
+	if opts.Animated || !opts.Format.CanAnimate() {
+		return ""
+	}
+	return "poster"
+}
+
+// parseOps parses the `ops` query parameter, refusing it unless operations
+// are enabled and every operation is on the allow-list (when one is set).
+func (h *Handler) parseOps(raw string) (configutil.Ops, error) {
+	if raw == "" {
+		return configutil.Ops{}, nil
+	}
+	if !h.cfg.Operations.Enabled {
+		return configutil.Ops{}, errors.New("image operations are disabled")
+	}
+	ops, err := configutil.ParseOps(raw)
+	if err != nil {
+		return configutil.Ops{}, err
+	}
+	if allowed := h.cfg.Operations.Allowed; len(allowed) > 0 {
+		for _, name := range ops.Names() {
+			if !slices.Contains(allowed, name) {
+				return configutil.Ops{}, fmt.Errorf("operation %q is not allowed", name)
+			}
+		}
+	}
+	return ops, nil
+}
+
+// adjustments maps parsed operations onto processor options.
+func adjustments(ops configutil.Ops) processor.Adjustments {
+	return processor.Adjustments{
+		Rotate:     ops.Rotate,
+		Flip:       ops.Flip,
+		Flop:       ops.Flop,
+		Grayscale:  ops.Grayscale,
+		Tint:       ops.Tint,
+		Brightness: ops.Brightness,
+		Contrast:   ops.Contrast,
+		Blur:       ops.Blur,
+		Sharpen:    ops.Sharpen,
+	}
+}
+
+// opsQualifier returns the cache directory qualifier for image operations,
+// a hash of their canonical form, so every spelling and order of the same
+// operations shares one cache entry.
+func opsQualifier(ops configutil.Ops) string {
+	canonical := ops.String()
+	if canonical == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return "ops-" + hex.EncodeToString(sum[:4])
+}
+
+// watermarkSettings is the watermark applied to a variant; the zero value
+// applies none.
+type watermarkSettings struct {
+	image string // overlay path, read on a cache miss
+	mark  processor.Watermark
+}
+
+// resolveWatermark returns the watermark rule matching the source unless the
+// requested geometry is below its minimum size. The overlay's mtime and size
+// and the rule settings make up the asset identity, so editing either renders
+// fresh variants.
+func resolveWatermark(cfg *config.Config, sourceRel string, width, height int) (watermarkSettings, error) {
+	rule, ok := cfg.Watermark(sourceRel)
+	if !ok || max(width, height) < rule.MinSize {
+		return watermarkSettings{}, nil
+	}
+	info, err := os.Stat(rule.Image)
+	if err != nil {
+		return watermarkSettings{}, fmt.Errorf("stat watermark: %w", err)
+	}
+	anchor := watermarkAnchors[rule.Position]
+	return watermarkSettings{
+		image: rule.Image,
+		mark: processor.Watermark{
+			Asset:   fmt.Sprintf("%s@%d-%d/%s", rule.Image, info.ModTime().UnixNano(), info.Size(), rule.Fingerprint()),
+			MinSize: rule.MinSize,
+			Scale:   rule.Scale,
+			AnchorX: anchor[0],
+			AnchorY: anchor[1],
+			Margin:  rule.Margin,
+			Opacity: rule.Opacity,
+		},
+	}, nil
+}
+
+// qualifier returns the cache directory qualifier, a hash of the asset
+// identity.
+func (w watermarkSettings) qualifier() string {
+	if w.image == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(w.mark.Asset))
+	return "wm-" + hex.EncodeToString(sum[:4])
+}
+
+// resolveTrim returns the trim threshold and border colour from the route,
+// then the path defaults, then the resize settings. An empty colour leaves
+// the zero value, which samples the top-left pixel.
+func resolveTrim(spec variantSpec, defaults config.PathConfig, resize config.ResizeConfig) (float64, color.NRGBA) {
+	threshold := resize.TrimThreshold
+	for _, candidate := range []*float64{defaults.TrimThreshold, spec.trimThreshold} {
+		if candidate != nil {
+			threshold = *candidate
+		}
+	}
+	var background color.NRGBA
+	for _, raw := range []string{spec.trimBackground, defaults.TrimBackground, resize.TrimBackground} {
+		if raw != "" {
+			// Validated at load.
+			background, _ = configutil.ParseColor(raw)
+			break
+		}
+	}
+	return threshold, background
+}
+
+// trimQualifier returns the cache directory qualifier for border trimming.
+func trimQualifier(trim bool) string {
+	if !trim {
+		return ""
+	}
+	return "trim"
 }
 
 func parseDimension(raw string) (int, error) {
@@ -379,21 +1243,29 @@ func parseDimension(raw string) (int, error) {
 
 const cacheControlImmutable = "public, max-age=31536000, immutable, s-maxage=31536000"
 
-func buildContentETag(payload []byte) string {
-	sum := sha256.Sum256(payload)
-	return fmt.Sprintf("\"%s\"", hex.EncodeToString(sum[:]))
+// verifySignature checks the URL signature when signing is enforced.
+func (h *Handler) verifySignature(c *gin.Context) error {
+	if !h.cfg.Signing.Enforce {
+		return nil
+	}
+	return urlsign.Verify(c.Request.URL.Path, c.Request.URL.Query(), h.cfg.SigningSecrets(), time.Now())
 }
 
-func matchETag(header string, etag string) bool {
-	if header == "" {
-		return false
+// cacheControlFor keeps shared caches from serving an expiring URL past its
+// expiry; everything else is immutable. The expiry only counts when signing
+// is enforced, i.e. when verifySignature has checked it: otherwise any client
+// could append one and opt a variant out of CDN caching.
+func (h *Handler) cacheControlFor(c *gin.Context) string {
+	raw := c.Query(urlsign.ExpiresParam)
+	if raw == "" || !h.cfg.Signing.Enforce {
+		return cacheControlImmutable
 	}
-	for _, candidate := range strings.Split(header, ",") {
-		if strings.TrimSpace(candidate) == etag {
-			return true
-		}
+	expires, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return cacheControlImmutable
 	}
-	return false
+	remaining := max(expires-time.Now().Unix(), 0)
+	return fmt.Sprintf("public, max-age=%d", remaining)
 }
 
 func (h *Handler) logAccess(c *gin.Context, width, height int, rel string, originalMod time.Time, cached bool, dur time.Duration, err error) {
@@ -1,17 +1,25 @@
 package httpapi
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -19,11 +27,14 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"fars/internal/admission"
 	"fars/internal/cache"
 	"fars/internal/config"
 	"fars/internal/locker"
 	"fars/internal/processor"
 	"fars/internal/version"
+	"fars/pkg/configutil"
+	"fars/pkg/urlsign"
 )
 
 func TestBuildSourceCandidates(t *testing.T) {
@@ -62,13 +73,40 @@ func TestBuildSourceCandidates(t *testing.T) {
 		},
 		{
 			name:   "unsupported base",
-			input:  "foo.gif.webp",
+			input:  "foo.txt.webp",
 			rawExt: ".webp",
 			want: []sourceCandidate{{
-				relative:    "foo.gif.webp",
+				relative:    "foo.txt.webp",
 				cacheSuffix: "",
 			}},
 		},
+		{
+			name:   "source only base",
+			input:  "photos/IMG_1.HEIC.webp",
+			rawExt: ".webp",
+			want: []sourceCandidate{
+				{relative: "photos/IMG_1.HEIC.webp", cacheSuffix: ""},
+				{relative: "photos/IMG_1.HEIC", cacheSuffix: ".webp"},
+			},
+		},
+		{
+			name:   "svg base",
+			input:  "logo.svg.png",
+			rawExt: ".png",
+			want: []sourceCandidate{
+				{relative: "logo.svg.png", cacheSuffix: ""},
+				{relative: "logo.svg", cacheSuffix: ".png"},
+			},
+		},
+		{
+			name:   "auto extension",
+			input:  "test/13.jpg.auto",
+			rawExt: ".auto",
+			want: []sourceCandidate{
+				{relative: "test/13.jpg.auto", cacheSuffix: ""},
+				{relative: "test/13.jpg", cacheSuffix: ".auto"},
+			},
+		},
 		{
 			name:   "no extension",
 			input:  "img/item/13",
@@ -127,12 +165,34 @@ func TestBuildSourceCandidates(t *testing.T) {
 	}
 }
 
+func TestOutputFor(t *testing.T) {
+	tests := []struct {
+		source string
+		want   processor.Format
+	}{
+		{"13.jpg", processor.FormatJPEG},
+		{"13.PNG", processor.FormatPNG},
+		{"anim.gif", processor.FormatGIF},
+		{"logo.svg", processor.FormatPNG},
+		{"IMG_1.HEIC", processor.FormatJPEG},
+		{"scan.tiff", processor.FormatJPEG},
+		{"photo.jxl", processor.FormatJXL},
+		{"img/c/13", processor.FormatJPEG},
+	}
+	for _, tt := range tests {
+		if got := outputFor(tt.source); got != tt.want {
+			t.Errorf("outputFor(%q) = %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
+
 func TestParseGeometry(t *testing.T) {
 	tests := []struct {
 		name      string
 		input     string
 		width     int
 		height    int
+		fit       processor.Fit
 		expectErr bool
 	}{
 		{
@@ -140,18 +200,83 @@ func TestParseGeometry(t *testing.T) {
 			input:  "200x300",
 			width:  200,
 			height: 300,
+			fit:    processor.FitContain,
 		},
 		{
 			name:   "missing height",
 			input:  "120x",
 			width:  120,
 			height: 0,
+			fit:    processor.FitContain,
 		},
 		{
 			name:   "missing width",
 			input:  "x480",
 			width:  0,
 			height: 480,
+			fit:    processor.FitContain,
+		},
+		{
+			name:   "cover suffix",
+			input:  "200x200c",
+			width:  200,
+			height: 200,
+			fit:    processor.FitCover,
+		},
+		{
+			name:   "fill suffix",
+			input:  "300x100f",
+			width:  300,
+			height: 100,
+			fit:    processor.FitFill,
+		},
+		{
+			name:   "inside suffix",
+			input:  "640x480i",
+			width:  640,
+			height: 480,
+			fit:    processor.FitInside,
+		},
+		{
+			name:   "pixel ratio",
+			input:  "200x100@2x",
+			width:  400,
+			height: 200,
+			fit:    processor.FitContain,
+		},
+		{
+			name:   "fractional pixel ratio with fit",
+			input:  "101x50c@1.5x",
+			width:  152,
+			height: 75,
+			fit:    processor.FitCover,
+		},
+		{
+			name:   "pixel ratio single side",
+			input:  "x120@3x",
+			width:  0,
+			height: 360,
+			fit:    processor.FitContain,
+		},
+		{
+			name:      "pixel ratio without x",
+			input:     "200x200@2",
+			expectErr: true,
+		},
+		{
+			name:      "pixel ratio below one",
+			input:     "200x200@0.5x",
+			expectErr: true,
+		},
+		{
+			name:      "fit without height",
+			input:     "200xc",
+			expectErr: true,
+		},
+		{
+			name:      "unknown suffix",
+			input:     "200x200z",
+			expectErr: true,
 		},
 		{
 			name:      "invalid width",
@@ -163,7 +288,7 @@ func TestParseGeometry(t *testing.T) {
 	for _, tc := range tests {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
-			w, h, err := parseGeometry(tc.input)
+			g, err := parseGeometry(tc.input)
 			if tc.expectErr {
 				if err == nil {
 					t.Fatalf("expected error, got nil")
@@ -173,8 +298,9 @@ func TestParseGeometry(t *testing.T) {
 			if err != nil {
 				t.Fatalf("unexpected error: %v", err)
 			}
-			if w != tc.width || h != tc.height {
-				t.Fatalf("parseGeometry(%q) = (%d,%d), want (%d,%d)", tc.input, w, h, tc.width, tc.height)
+			width, height := g.pixelSize()
+			if width != tc.width || height != tc.height || g.fit != tc.fit {
+				t.Fatalf("parseGeometry(%q) = (%d,%d,%s), want (%d,%d,%s)", tc.input, width, height, g.fit, tc.width, tc.height, tc.fit)
 			}
 		})
 	}
@@ -182,11 +308,10 @@ func TestParseGeometry(t *testing.T) {
 
 func TestTryServeFromCacheHeaders(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	baseDir := t.TempDir()
-	cacheDir := t.TempDir()
+	handler := newTestHandler(t, nil)
 
-	origPath := filepath.Join(baseDir, "img", "photo.jpg")
-	cachePath := filepath.Join(cacheDir, "200x200", "img", "photo.jpg")
+	origPath := filepath.Join(handler.cfg.Storage.BaseDir, "img", "photo.jpg")
+	cachePath := filepath.Join(handler.cfg.Storage.CacheDir, "200x200", "img", "photo.jpg")
 	if err := os.MkdirAll(filepath.Dir(origPath), 0o755); err != nil {
 		t.Fatalf("mkdir base: %v", err)
 	}
@@ -202,28 +327,12 @@ func TestTryServeFromCacheHeaders(t *testing.T) {
 		t.Fatalf("write cache: %v", err)
 	}
 
-	cfg := &config.Config{
-		Storage: config.StorageConfig{BaseDir: baseDir, CacheDir: cacheDir},
-		Resize:  config.ResizeConfig{MaxWidth: 2000, MaxHeight: 2000},
-		Cache:   config.CacheConfig{TTL: config.Duration{Duration: time.Hour}},
-	}
-	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
-	handler := &Handler{
-		cfg:    cfg,
-		cache:  cache.NewManager(cfg, logger),
-		locks:  locker.New(),
-		logger: logger,
-	}
-
 	recorder := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(recorder)
-	c.Request = httptest.NewRequest(http.MethodGet, "/resize/200x200/img/photo.jpg", nil)
+	// Without enforced signing, an unchecked expiry must not shorten caching.
+	c.Request = httptest.NewRequest(http.MethodGet, "/resize/200x200/img/photo.jpg?expires=0", nil)
 
-	originalInfo, err := os.Stat(origPath)
-	if err != nil {
-		t.Fatalf("stat original: %v", err)
-	}
-	if !handler.tryServeFromCache(c, cachePath, processor.FormatJPEG, originalInfo) {
+	if !handler.tryServeFromCache(c, cachePath, processor.FormatJPEG) {
 		t.Fatalf("expected cache serve to succeed")
 	}
 
@@ -248,11 +357,10 @@ func TestTryServeFromCacheHeaders(t *testing.T) {
 
 func TestTryServeFromCacheConditional(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	baseDir := t.TempDir()
-	cacheDir := t.TempDir()
+	handler := newTestHandler(t, nil)
 
-	origPath := filepath.Join(baseDir, "img", "photo.jpg")
-	cachePath := filepath.Join(cacheDir, "200x200", "img", "photo.jpg")
+	origPath := filepath.Join(handler.cfg.Storage.BaseDir, "img", "photo.jpg")
+	cachePath := filepath.Join(handler.cfg.Storage.CacheDir, "200x200", "img", "photo.jpg")
 	if err := os.MkdirAll(filepath.Dir(origPath), 0o755); err != nil {
 		t.Fatalf("mkdir base: %v", err)
 	}
@@ -267,23 +375,6 @@ func TestTryServeFromCacheConditional(t *testing.T) {
 		t.Fatalf("write cache: %v", err)
 	}
 
-	cfg := &config.Config{
-		Storage: config.StorageConfig{BaseDir: baseDir, CacheDir: cacheDir},
-		Resize:  config.ResizeConfig{MaxWidth: 2000, MaxHeight: 2000},
-		Cache:   config.CacheConfig{TTL: config.Duration{Duration: time.Hour}},
-	}
-	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
-	handler := &Handler{
-		cfg:    cfg,
-		cache:  cache.NewManager(cfg, logger),
-		locks:  locker.New(),
-		logger: logger,
-	}
-
-	originalInfo, err := os.Stat(origPath)
-	if err != nil {
-		t.Fatalf("stat original: %v", err)
-	}
 	sum := sha256.Sum256(cachedPayload)
 	etag := "\"" + hex.EncodeToString(sum[:]) + "\""
 
@@ -292,14 +383,8 @@ func TestTryServeFromCacheConditional(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/resize/200x200/img/photo.jpg", nil)
 	req.Header.Set("If-None-Match", etag)
 	c.Request = req
-	if !matchETag(req.Header.Get("If-None-Match"), etag) {
-		t.Fatalf("matchETag failed for header %q", req.Header.Get("If-None-Match"))
-	}
-	if !matchETag(c.GetHeader("If-None-Match"), etag) {
-		t.Fatalf("context header missing: %q", c.GetHeader("If-None-Match"))
-	}
 
-	if !handler.tryServeFromCache(c, cachePath, processor.FormatJPEG, originalInfo) {
+	if !handler.tryServeFromCache(c, cachePath, processor.FormatJPEG) {
 		t.Fatalf("expected cache serve to succeed")
 	}
 	c.Writer.WriteHeaderNow()
@@ -318,6 +403,90 @@ func TestTryServeFromCacheConditional(t *testing.T) {
 	}
 }
 
+func TestTryServeFromCacheRangeAndHead(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := newTestHandler(t, nil)
+	cachePath := filepath.Join(handler.cfg.Storage.CacheDir, "200x200", "img", "photo.jpg")
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0o755); err != nil {
+		t.Fatalf("mkdir cache: %v", err)
+	}
+	cachedPayload := []byte("0123456789")
+	if err := os.WriteFile(cachePath, cachedPayload, 0o644); err != nil {
+		t.Fatalf("write cache: %v", err)
+	}
+	sum := sha256.Sum256(cachedPayload)
+	etag := "\"" + hex.EncodeToString(sum[:]) + "\""
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		status  int
+		body    string
+	}{
+		{name: "range", method: http.MethodGet, headers: map[string]string{"Range": "bytes=2-5"}, status: http.StatusPartialContent, body: "2345"},
+		{name: "if-range match", method: http.MethodGet, headers: map[string]string{"Range": "bytes=0-1", "If-Range": etag}, status: http.StatusPartialContent, body: "01"},
+		{name: "if-range mismatch", method: http.MethodGet, headers: map[string]string{"Range": "bytes=0-1", "If-Range": `"stale"`}, status: http.StatusOK, body: "0123456789"},
+		{name: "head", method: http.MethodHead, status: http.StatusOK},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			req := httptest.NewRequest(tc.method, "/resize/200x200/img/photo.jpg", nil)
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+			c.Request = req
+
+			if !handler.tryServeFromCache(c, cachePath, processor.FormatJPEG) {
+				t.Fatalf("expected cache serve to succeed")
+			}
+			c.Writer.WriteHeaderNow()
+
+			if recorder.Code != tc.status {
+				t.Fatalf("unexpected status: %d", recorder.Code)
+			}
+			if got := recorder.Header().Get("ETag"); got != etag {
+				t.Fatalf("unexpected ETag: %q", got)
+			}
+			if got := recorder.Body.String(); got != tc.body {
+				t.Fatalf("unexpected body: %q", got)
+			}
+			if tc.method == http.MethodHead {
+				if got := recorder.Header().Get("Content-Length"); got != strconv.Itoa(len(cachedPayload)) {
+					t.Fatalf("unexpected HEAD Content-Length: %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestTryServeFromCacheUsesMetadata(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := newTestHandler(t, nil)
+
+	sourceMTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cachePath := filepath.Join(handler.cfg.Storage.CacheDir, "200x200", "img", "photo.jpg")
+	if err := handler.cache.Write(cachePath, []byte("variant"), cache.Metadata{SourcePath: "img/photo.jpg", SourceMTime: sourceMTime}); err != nil {
+		t.Fatalf("write cache: %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodGet, "/resize/200x200/img/photo.jpg", nil)
+	if !handler.tryServeFromCache(c, cachePath, processor.FormatJPEG) {
+		t.Fatalf("expected cache serve to succeed")
+	}
+	if got := recorder.Header().Get("Last-Modified"); got != sourceMTime.Format(http.TimeFormat) {
+		t.Fatalf("expected source mtime as Last-Modified, got %q", got)
+	}
+	if got := recorder.Header().Get("ETag"); got != cache.ContentETag([]byte("variant")) {
+		t.Fatalf("unexpected ETag: %q", got)
+	}
+}
+
 func TestRespondErrorHTML(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	recorder := httptest.NewRecorder()
@@ -346,8 +515,8 @@ func TestHandleResizeUnsupportedMediaType(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	recorder := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(recorder)
-	req := httptest.NewRequest(http.MethodGet, "/resize/200x200/foo.bmp", nil)
-	c.Params = gin.Params{{Key: "geometry", Value: "200x200"}, {Key: "filepath", Value: "/foo.bmp"}}
+	req := httptest.NewRequest(http.MethodGet, "/resize/200x200/foo.txt", nil)
+	c.Params = gin.Params{{Key: "geometry", Value: "200x200"}, {Key: "filepath", Value: "/foo.txt"}}
 	c.Request = req
 
 	version.Override("test-version")
@@ -367,3 +536,918 @@ func TestHandleResizeUnsupportedMediaType(t *testing.T) {
 		t.Fatalf("unexpected body: %q", body)
 	}
 }
+
+func TestResolveCrop(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name      string
+		query     string
+		fit       processor.Fit
+		defaults  config.PathConfig
+		want      cropSettings
+		qualifier string
+		expectErr bool
+	}{
+		{
+			name:      "cover defaults to centre",
+			fit:       processor.FitCover,
+			want:      cropSettings{gravity: processor.GravityCentre},
+			qualifier: "",
+		},
+		{
+			name:      "explicit gravity",
+			query:     "gravity=North",
+			fit:       processor.FitCover,
+			want:      cropSettings{gravity: processor.GravityNorth},
+			qualifier: "north",
+		},
+		{
+			name:      "prefix default",
+			fit:       processor.FitCover,
+			defaults:  config.PathConfig{Prefix: "img/p/", Gravity: "attention"},
+			want:      cropSettings{gravity: processor.GravityAttention},
+			qualifier: "attention",
+		},
+		{
+			name:      "request overrides prefix",
+			query:     "gravity=entropy",
+			fit:       processor.FitCover,
+			defaults:  config.PathConfig{Prefix: "img/p/", Focus: "0.1,0.1"},
+			want:      cropSettings{gravity: processor.GravityEntropy},
+			qualifier: "entropy",
+		},
+		{
+			name:      "focal point rounded",
+			query:     "focus=0.25,0.66666",
+			fit:       processor.FitCover,
+			want:      cropSettings{gravity: processor.GravityFocal, focalX: 0.25, focalY: 0.667},
+			qualifier: "focus-0.250-0.667",
+		},
+		{
+			name:     "contain ignores defaults",
+			fit:      processor.FitContain,
+			defaults: config.PathConfig{Prefix: "img/", Gravity: "north"},
+			want:     cropSettings{},
+		},
+		{
+			name:      "contain rejects explicit gravity",
+			query:     "gravity=north",
+			fit:       processor.FitContain,
+			expectErr: true,
+		},
+		{
+			name:      "unknown gravity",
+			query:     "gravity=up",
+			fit:       processor.FitCover,
+			expectErr: true,
+		},
+		{
+			name:      "focal point out of range",
+			query:     "focus=1.5,0.5",
+			fit:       processor.FitCover,
+			expectErr: true,
+		},
+		{
+			name:      "focal point not a number",
+			query:     "focus=NaN,0.5",
+			fit:       processor.FitCover,
+			expectErr: true,
+		},
+		{
+			name:      "focal point infinite",
+			query:     "focus=0.5,-Inf",
+			fit:       processor.FitCover,
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatalf("parse query: %v", err)
+			}
+			got, err := resolveCrop(query.Get("gravity"), query.Get("focus"), tc.fit, tc.defaults)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("resolveCrop = %+v, want %+v", got, tc.want)
+			}
+			if q := got.qualifier(); q != tc.qualifier {
+				t.Fatalf("qualifier = %q, want %q", q, tc.qualifier)
+			}
+		})
+	}
+}
+
+func TestResolveBackground(t *testing.T) {
+	tests := []struct {
+		name      string
+		explicit  string
+		defaults  config.PathConfig
+		global    string
+		want      color.NRGBA
+		qualifier string
+		expectErr bool
+	}{
+		{name: "processor default", want: color.NRGBA{}, qualifier: ""},
+		{name: "global", global: "fff", want: color.NRGBA{R: 255, G: 255, B: 255, A: 255}, qualifier: "bg-ffffffff"},
+		{name: "prefix overrides global", defaults: config.PathConfig{Prefix: "img/", Background: "#000"}, global: "fff", want: color.NRGBA{A: 255}, qualifier: "bg-000000ff"},
+		{name: "explicit overrides prefix", explicit: "ff000080", defaults: config.PathConfig{Prefix: "img/", Background: "000"}, want: color.NRGBA{R: 255, A: 0x80}, qualifier: "bg-ff000080"},
+		{name: "transparent", explicit: "00000000", want: color.NRGBA{}, qualifier: ""},
+		{name: "invalid", explicit: "white", expectErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveBackground(tc.explicit, tc.defaults, tc.global)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("resolveBackground = %+v, want %+v", got, tc.want)
+			}
+			if q := backgroundQualifier(got); q != tc.qualifier {
+				t.Fatalf("qualifier = %q, want %q", q, tc.qualifier)
+			}
+		})
+	}
+}
+
+func TestResolvePadding(t *testing.T) {
+	tests := []struct {
+		name      string
+		explicit  string
+		fit       processor.Fit
+		defaults  config.PathConfig
+		global    string
+		want      processor.Padding
+		qualifier string
+		expectErr bool
+	}{
+		{name: "solid by default", fit: processor.FitContain, want: processor.PaddingSolid},
+		{name: "global", fit: processor.FitContain, global: "edge", want: processor.PaddingEdge, qualifier: "pad-edge"},
+		{name: "prefix overrides global", fit: processor.FitContain, defaults: config.PathConfig{Prefix: "img/", Padding: "mirror"}, global: "edge", want: processor.PaddingMirror, qualifier: "pad-mirror"},
+		{name: "explicit overrides prefix", explicit: "Blur", fit: processor.FitContain, defaults: config.PathConfig{Prefix: "img/", Padding: "mirror"}, want: processor.PaddingBlur, qualifier: "pad-blur"},
+		{name: "cover ignores defaults", fit: processor.FitCover, global: "blur"},
+		{name: "cover rejects explicit", explicit: "blur", fit: processor.FitCover, expectErr: true},
+		{name: "unknown", explicit: "stripes", fit: processor.FitContain, expectErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolvePadding(tc.explicit, tc.fit, tc.defaults, tc.global)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("resolvePadding = %q, want %q", got, tc.want)
+			}
+			if q := paddingQualifier(got); q != tc.qualifier {
+				t.Fatalf("qualifier = %q, want %q", q, tc.qualifier)
+			}
+		})
+	}
+}
+
+func TestResolveUpscale(t *testing.T) {
+	tests := []struct {
+		name      string
+		explicit  string
+		fit       processor.Fit
+		defaults  config.PathConfig
+		global    string
+		want      upscaleSettings
+		qualifier string
+		expectErr bool
+	}{
+		{name: "pad by default", fit: processor.FitContain, want: upscaleSettings{mode: processor.UpscalePad}},
+		{name: "global", fit: processor.FitInside, global: "always", want: upscaleSettings{mode: processor.UpscaleAlways}, qualifier: "up-always"},
+		{name: "prefix overrides global", fit: processor.FitContain, defaults: config.PathConfig{Prefix: "img/", Upscale: "none"}, global: "always", want: upscaleSettings{mode: processor.UpscaleNone}, qualifier: "up-none"},
+		{name: "explicit factor", explicit: "1.5x", fit: processor.FitContain, defaults: config.PathConfig{Prefix: "img/", Upscale: "none"}, want: upscaleSettings{mode: processor.UpscaleAlways, limit: 1.5}, qualifier: "up-1.5x"},
+		{name: "factor rounded", explicit: "2.004", fit: processor.FitContain, want: upscaleSettings{mode: processor.UpscaleAlways, limit: 2}, qualifier: "up-2x"},
+		{name: "cover ignores defaults", fit: processor.FitCover, global: "none"},
+		{name: "fill rejects explicit", explicit: "always", fit: processor.FitFill, expectErr: true},
+		{name: "factor below one", explicit: "0.5", fit: processor.FitContain, expectErr: true},
+		{name: "unknown", explicit: "sometimes", fit: processor.FitContain, expectErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveUpscale(tc.explicit, tc.fit, tc.defaults, tc.global)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("resolveUpscale = %+v, want %+v", got, tc.want)
+			}
+			if q := got.qualifier(); q != tc.qualifier {
+				t.Fatalf("qualifier = %q, want %q", q, tc.qualifier)
+			}
+		})
+	}
+}
+
+func TestResolveFlag(t *testing.T) {
+	tests := []struct {
+		name      string
+		explicit  string
+		prefix    string
+		global    bool
+		want      bool
+		expectErr bool
+	}{
+		{name: "off by default"},
+		{name: "global", global: true, want: true},
+		{name: "prefix disables", prefix: "false", global: true},
+		{name: "explicit overrides prefix", explicit: "1", prefix: "false", want: true},
+		{name: "invalid", explicit: "sometimes", expectErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveFlag("trim", tc.explicit, tc.prefix, tc.global)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("resolveFlag = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveTrim(t *testing.T) {
+	zero, loose := 0.0, 40.0
+	resize := config.ResizeConfig{TrimThreshold: 10, TrimBackground: "#000"}
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	tests := []struct {
+		name          string
+		spec          variantSpec
+		defaults      config.PathConfig
+		resize        config.ResizeConfig
+		wantThreshold float64
+		wantColour    color.NRGBA
+	}{
+		{name: "global", resize: resize, wantThreshold: 10, wantColour: color.NRGBA{A: 255}},
+		{name: "sampled by default", resize: config.ResizeConfig{TrimThreshold: 10}, wantThreshold: 10},
+		{name: "prefix", defaults: config.PathConfig{TrimThreshold: &loose, TrimBackground: "#fff"}, resize: resize, wantThreshold: 40, wantColour: white},
+		{name: "preset over prefix", spec: variantSpec{trimThreshold: &zero}, defaults: config.PathConfig{TrimThreshold: &loose}, resize: resize, wantThreshold: 0, wantColour: color.NRGBA{A: 255}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			threshold, colour := resolveTrim(tc.spec, tc.defaults, tc.resize)
+			if threshold != tc.wantThreshold || colour != tc.wantColour {
+				t.Fatalf("resolveTrim = %g, %+v; want %g, %+v", threshold, colour, tc.wantThreshold, tc.wantColour)
+			}
+		})
+	}
+}
+
+func TestResolveWatermark(t *testing.T) {
+	logo := filepath.Join(t.TempDir(), "logo.png")
+	if err := os.WriteFile(logo, []byte("png"), 0o644); err != nil {
+		t.Fatalf("write logo: %v", err)
+	}
+	cfg := &config.Config{Watermarks: []config.WatermarkRule{{
+		Prefix:   "img/p/",
+		MinSize:  600,
+		Image:    logo,
+		Position: "south-east",
+		Margin:   16,
+		Opacity:  0.5,
+	}}}
+
+	if got, err := resolveWatermark(cfg, "img/p/1.jpg", 120, 120); err != nil || got.qualifier() != "" {
+		t.Fatalf("expected no watermark below min_size, got %+v (%v)", got, err)
+	}
+	if got, err := resolveWatermark(cfg, "img/c/1.jpg", 800, 800); err != nil || got.qualifier() != "" {
+		t.Fatalf("expected no watermark for other paths, got %+v (%v)", got, err)
+	}
+	got, err := resolveWatermark(cfg, "img/p/1.jpg", 800, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.image != logo || got.mark.AnchorX != 1 || got.mark.AnchorY != 1 || got.mark.Margin != 16 || got.mark.Opacity != 0.5 {
+		t.Fatalf("unexpected watermark: %+v", got)
+	}
+	qualifier := got.qualifier()
+	if !strings.HasPrefix(qualifier, "wm-") {
+		t.Fatalf("unexpected qualifier %q", qualifier)
+	}
+
+	cfg.Watermarks[0].Opacity = 0.8
+	if edited, _ := resolveWatermark(cfg, "img/p/1.jpg", 800, 0); edited.qualifier() == qualifier {
+		t.Fatalf("expected qualifier to change with the rule settings")
+	}
+	cfg.Watermarks[0].Opacity = 0.5
+	if err := os.Chtimes(logo, time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("touch logo: %v", err)
+	}
+	if touched, _ := resolveWatermark(cfg, "img/p/1.jpg", 800, 0); touched.qualifier() == qualifier {
+		t.Fatalf("expected qualifier to change with the watermark asset")
+	}
+}
+
+func TestParseOpsQuery(t *testing.T) {
+	h := &Handler{cfg: &config.Config{}}
+	if _, err := h.parseOps("grayscale"); err == nil {
+		t.Fatalf("expected operations to be refused while disabled")
+	}
+	if ops, err := h.parseOps(""); err != nil || ops != (configutil.Ops{}) {
+		t.Fatalf("expected no operations, got %+v (%v)", ops, err)
+	}
+
+	h.cfg.Operations = config.OperationsConfig{Enabled: true, Allowed: []string{"grayscale", "blur"}}
+	ops, err := h.parseOps("blur:3,greyscale")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if adjust := adjustments(ops); !adjust.Grayscale || adjust.Blur != 3 {
+		t.Fatalf("unexpected adjustments: %+v", adjust)
+	}
+	if _, err := h.parseOps("grayscale,rotate:90"); err == nil {
+		t.Fatalf("expected rotate to be refused by the allow-list")
+	}
+	if _, err := h.parseOps("blur:fast"); err == nil {
+		t.Fatalf("expected an invalid value to be refused")
+	}
+}
+
+func TestOpsQualifier(t *testing.T) {
+	a, _ := configutil.ParseOps("grayscale,blur:4")
+	b, _ := configutil.ParseOps("blur:4.0, greyscale")
+	c, _ := configutil.ParseOps("grayscale,blur:5")
+	if opsQualifier(configutil.Ops{}) != "" {
+		t.Fatalf("expected no qualifier without operations")
+	}
+	if got := opsQualifier(a); !strings.HasPrefix(got, "ops-") || got != opsQualifier(b) {
+		t.Fatalf("expected equal qualifiers for equivalent operations, got %q and %q", got, opsQualifier(b))
+	}
+	if opsQualifier(a) == opsQualifier(c) {
+		t.Fatalf("expected different qualifiers for different operations")
+	}
+}
+
+func TestPosterQualifier(t *testing.T) {
+	tests := []struct {
+		opts processor.Options
+		want string
+	}{
+		{opts: processor.Options{Format: processor.FormatWEBP, Animated: true}, want: ""},
+		{opts: processor.Options{Format: processor.FormatWEBP}, want: "poster"},
+		{opts: processor.Options{Format: processor.FormatGIF}, want: "poster"},
+		{opts: processor.Options{Format: processor.FormatJPEG}, want: ""},
+	}
+	for _, tc := range tests {
+		if got := posterQualifier(tc.opts); got != tc.want {
+			t.Fatalf("posterQualifier(%+v) = %q, want %q", tc.opts, got, tc.want)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	const chrome = "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8"
+	tests := []struct {
+		name      string
+		accept    string
+		preferred []string
+		fallback  processor.Format
+		want      processor.Format
+	}{
+		{name: "avif first", accept: chrome, preferred: []string{"avif", "webp"}, fallback: processor.FormatJPEG, want: processor.FormatAVIF},
+		{name: "preference order wins", accept: chrome, preferred: []string{"webp", "avif"}, fallback: processor.FormatJPEG, want: processor.FormatWEBP},
+		{name: "webp only", accept: "image/webp,*/*", preferred: []string{"avif", "webp"}, fallback: processor.FormatPNG, want: processor.FormatWEBP},
+		{name: "wildcards ignored", accept: "image/*,*/*", preferred: []string{"avif", "webp"}, fallback: processor.FormatJPEG, want: processor.FormatJPEG},
+		{name: "explicit zero quality", accept: "image/avif;q=0,image/webp", preferred: []string{"avif", "webp"}, fallback: processor.FormatJPEG, want: processor.FormatWEBP},
+		{name: "no accept header", accept: "", preferred: []string{"avif", "webp"}, fallback: processor.FormatJPEG, want: processor.FormatJPEG},
+		{name: "source format preferred", accept: chrome, preferred: []string{"jpeg", "avif"}, fallback: processor.FormatJPEG, want: processor.FormatJPEG},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := negotiateFormat(tc.accept, tc.preferred, tc.fallback); got != tc.want {
+				t.Fatalf("negotiateFormat(%q) = %s, want %s", tc.accept, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleResizeNegotiatesFromCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := newTestHandler(t, func(cfg *config.Config) {
+		cfg.Negotiation = config.NegotiationConfig{Enabled: true, Formats: []string{"avif", "webp"}}
+	})
+
+	origPath := filepath.Join(handler.cfg.Storage.BaseDir, "img", "photo.jpg")
+	if err := os.MkdirAll(filepath.Dir(origPath), 0o755); err != nil {
+		t.Fatalf("mkdir base: %v", err)
+	}
+	if err := os.WriteFile(origPath, []byte("original"), 0o644); err != nil {
+		t.Fatalf("write original: %v", err)
+	}
+	variants := map[string][]byte{
+		"photo.jpg":      []byte("jpeg-variant"),
+		"photo.jpg.webp": []byte("webp-variant"),
+	}
+	for name, payload := range variants {
+		cachePath := filepath.Join(handler.cfg.Storage.CacheDir, "200x200", "img", name)
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0o755); err != nil {
+			t.Fatalf("mkdir cache: %v", err)
+		}
+		if err := os.WriteFile(cachePath, payload, 0o644); err != nil {
+			t.Fatalf("write cache: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{name: "plain jpg negotiated", path: "/img/photo.jpg", accept: "image/webp,*/*", contentType: "image/webp", body: "webp-variant"},
+		{name: "plain jpg fallback", path: "/img/photo.jpg", accept: "*/*", contentType: "image/jpeg", body: "jpeg-variant"},
+		{name: "auto extension", path: "/img/photo.jpg.auto", accept: "image/webp", contentType: "image/webp", body: "webp-variant"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			req := httptest.NewRequest(http.MethodGet, "/resize/200x200"+tc.path, nil)
+			req.Header.Set("Accept", tc.accept)
+			c.Request = req
+			c.Params = gin.Params{{Key: "geometry", Value: "200x200"}, {Key: "filepath", Value: tc.path}}
+
+			handler.handleResize(c)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("unexpected status: %d", recorder.Code)
+			}
+			if got := recorder.Header().Get("Content-Type"); got != tc.contentType {
+				t.Fatalf("unexpected content type: %q", got)
+			}
+			if got := recorder.Header().Get("Vary"); got != "Accept" {
+				t.Fatalf("expected Vary: Accept, got %q", got)
+			}
+			if body := recorder.Body.String(); body != tc.body {
+				t.Fatalf("unexpected body: %q", body)
+			}
+		})
+	}
+}
+
+func TestHandleResizePixelRatioLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := &Handler{
+		cfg:    &config.Config{Resize: config.ResizeConfig{MaxWidth: 1000, MaxHeight: 1000, MaxDPR: 2}},
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	for _, geometry := range []string{"200x200@3x", "600x600@2x"} {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodGet, "/resize/"+geometry+"/foo.jpg", nil)
+		c.Params = gin.Params{{Key: "geometry", Value: geometry}, {Key: "filepath", Value: "/foo.jpg"}}
+
+		handler.handleResize(c)
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s: unexpected status: %d", geometry, recorder.Code)
+		}
+	}
+}
+
+func TestHandleResizeSignedURLs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := newTestHandler(t, func(cfg *config.Config) {
+		cfg.Signing = config.SigningConfig{Enforce: true, Secrets: []string{"current", "previous"}}
+	})
+
+	origPath := filepath.Join(handler.cfg.Storage.BaseDir, "img", "photo.jpg")
+	cachePath := filepath.Join(handler.cfg.Storage.CacheDir, "200x200", "img", "photo.jpg")
+	// The original is written first so the cached variant is never older.
+	for _, file := range []struct{ path, payload string }{{origPath, "original"}, {cachePath, "variant"}} {
+		if err := os.MkdirAll(filepath.Dir(file.path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(file.path, []byte(file.payload), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	sign := func(secret string, expires time.Time) string {
+		signer := urlsign.New(secret)
+		var (
+			signed string
+			err    error
+		)
+		if expires.IsZero() {
+			signed, err = signer.Sign("/resize/200x200/img/photo.jpg")
+		} else {
+			signed, err = signer.SignWithExpiry("/resize/200x200/img/photo.jpg", expires)
+		}
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{name: "current secret", target: sign("current", time.Time{}), status: http.StatusOK},
+		{name: "rotated secret", target: sign("previous", time.Time{}), status: http.StatusOK},
+		{name: "unexpired", target: sign("current", time.Now().Add(time.Hour)), status: http.StatusOK},
+		{name: "unsigned", target: "/resize/200x200/img/photo.jpg", status: http.StatusForbidden},
+		{name: "unknown secret", target: sign("other", time.Time{}), status: http.StatusForbidden},
+		{name: "tampered", target: sign("current", time.Time{}) + "&gravity=north", status: http.StatusForbidden},
+		{name: "expired", target: sign("current", time.Now().Add(-time.Minute)), status: http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodGet, tc.target, nil)
+			c.Params = gin.Params{{Key: "geometry", Value: "200x200"}, {Key: "filepath", Value: "/img/photo.jpg"}}
+
+			handler.handleResize(c)
+
+			if recorder.Code != tc.status {
+				t.Fatalf("unexpected status: %d", recorder.Code)
+			}
+			if tc.status == http.StatusOK && strings.Contains(tc.target, urlsign.ExpiresParam+"=") {
+				if got := recorder.Header().Get("Cache-Control"); strings.Contains(got, "immutable") {
+					t.Fatalf("expiring url must not be cached as immutable: %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlePresetServesFromCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	thumb := config.PresetConfig{Width: 120, Height: 120, Fit: "cover", Format: "webp"}
+	handler := newTestHandler(t, func(cfg *config.Config) {
+		cfg.Presets = map[string]config.PresetConfig{"thumb": thumb}
+	})
+
+	origPath := filepath.Join(handler.cfg.Storage.BaseDir, "img", "photo.jpg")
+	cachePath := handler.cfg.PresetCachePath("thumb", thumb, "img/photo.jpg.webp")
+	// The original is written first so the cached variant is never older.
+	for _, file := range []struct{ path, payload string }{{origPath, "original"}, {cachePath, "thumb-variant"}} {
+		if err := os.MkdirAll(filepath.Dir(file.path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(file.path, []byte(file.payload), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		preset string
+		status int
+		body   string
+	}{
+		{name: "known preset", preset: "thumb", status: http.StatusOK, body: "thumb-variant"},
+		{name: "unknown preset", preset: "huge", status: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodGet, "/preset/"+tc.preset+"/img/photo.jpg", nil)
+			c.Params = gin.Params{{Key: "name", Value: tc.preset}, {Key: "filepath", Value: "/img/photo.jpg"}}
+
+			handler.handlePreset(c)
+
+			if recorder.Code != tc.status {
+				t.Fatalf("unexpected status: %d", recorder.Code)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			if got := recorder.Header().Get("Content-Type"); got != "image/webp" {
+				t.Fatalf("expected preset format override, got %q", got)
+			}
+			if body := recorder.Body.String(); body != tc.body {
+				t.Fatalf("unexpected body: %q", body)
+			}
+		})
+	}
+}
+
+func TestSnapSize(t *testing.T) {
+	allowed := []config.Size{{Width: 100, Height: 100}, {Width: 300, Height: 300}, {Width: 0, Height: 120}}
+	tests := []struct {
+		width, height int
+		want          config.Size
+		exact         bool
+	}{
+		{width: 100, height: 100, want: config.Size{Width: 100, Height: 100}, exact: true},
+		{width: 0, height: 120, want: config.Size{Width: 0, Height: 120}, exact: true},
+		{width: 120, height: 110, want: config.Size{Width: 100, Height: 100}},
+		{width: 200, height: 200, want: config.Size{Width: 300, Height: 300}},
+		{width: 0, height: 500, want: config.Size{Width: 0, Height: 120}},
+		{width: 500, height: 0, want: config.Size{}},
+	}
+	for _, tc := range tests {
+		got, exact := snapSize(allowed, tc.width, tc.height)
+		if got != tc.want || exact != tc.exact {
+			t.Fatalf("snapSize(%d, %d) = %+v, %v; want %+v, %v", tc.width, tc.height, got, exact, tc.want, tc.exact)
+		}
+	}
+}
+
+func TestHandleResizeAllowedSizes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	baseDir := t.TempDir()
+	cacheDir := t.TempDir()
+
+	origPath := filepath.Join(baseDir, "img", "photo.jpg")
+	cachePath := filepath.Join(cacheDir, "200x200-cover", "img", "photo.jpg")
+	// The original is written first so the cached variant is never older.
+	for _, file := range []struct{ path, payload string }{{origPath, "original"}, {cachePath, "variant"}} {
+		if err := os.MkdirAll(filepath.Dir(file.path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(file.path, []byte(file.payload), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	yamlConfig := fmt.Sprintf("storage:\n  base_dir: %q\n  cache_dir: %q\nsizes:\n  allowed: [\"200x200\"]\n", filepath.ToSlash(baseDir), filepath.ToSlash(cacheDir))
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	newHandler := func(t *testing.T, extra string) *Handler {
+		cfg, err := config.LoadReader(strings.NewReader(yamlConfig + extra))
+		if err != nil {
+			t.Fatalf("load config: %v", err)
+		}
+		return &Handler{cfg: cfg, cache: cache.NewManager(cfg, logger), flights: locker.New(cfg), logger: logger}
+	}
+	serve := func(handler *Handler, geometry string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodGet, "/resize/"+geometry+"/img/photo.jpg?gravity=centre", nil)
+		c.Params = gin.Params{{Key: "geometry", Value: geometry}, {Key: "filepath", Value: "/img/photo.jpg"}}
+		handler.handleResize(c)
+		return recorder
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		handler := newHandler(t, "")
+		if code := serve(handler, "200x200c").Code; code != http.StatusOK {
+			t.Fatalf("allowed size: unexpected status %d", code)
+		}
+		if code := serve(handler, "210x190c").Code; code != http.StatusBadRequest {
+			t.Fatalf("disallowed size: unexpected status %d", code)
+		}
+	})
+	t.Run("snap", func(t *testing.T) {
+		recorder := serve(newHandler(t, "  policy: snap\n"), "210x190c")
+		if recorder.Code != http.StatusOK || recorder.Body.String() != "variant" {
+			t.Fatalf("expected snapped variant, got %d %q", recorder.Code, recorder.Body.String())
+		}
+	})
+	t.Run("redirect", func(t *testing.T) {
+		recorder := serve(newHandler(t, "  policy: snap\n  redirect: 301\n"), "105x95c@2x")
+		if recorder.Code != http.StatusMovedPermanently {
+			t.Fatalf("unexpected status: %d", recorder.Code)
+		}
+		if got := recorder.Header().Get("Location"); got != "/resize/200x200c/img/photo.jpg?gravity=centre" {
+			t.Fatalf("unexpected location: %q", got)
+		}
+	})
+}
+
+func TestHandleResizeShedsLoad(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := newTestHandler(t, func(cfg *config.Config) {
+		cfg.Admission.MaxJobs = 1
+		cfg.Admission.QueueSize = 0
+		cfg.Admission.RetryAfter = config.Duration{Duration: 3 * time.Second}
+	})
+
+	origPath := filepath.Join(handler.cfg.Storage.BaseDir, "img", "photo.jpg")
+	if err := os.MkdirAll(filepath.Dir(origPath), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(origPath, testJPEG(t, 40, 30), 0o644); err != nil {
+		t.Fatalf("write original: %v", err)
+	}
+
+	release, err := handler.admission.Acquire(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer release()
+
+	serve := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodGet, "/resize/200x/img/photo.jpg", nil)
+		c.Params = gin.Params{{Key: "geometry", Value: "200x"}, {Key: "filepath", Value: "/img/photo.jpg"}}
+		handler.handleResize(c)
+		return recorder
+	}
+
+	recorder := serve()
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while saturated, got %d", recorder.Code)
+	}
+	if got := recorder.Header().Get("Retry-After"); got != "3" {
+		t.Fatalf("unexpected Retry-After: %q", got)
+	}
+
+	// Cache hits bypass admission.
+	cachePath := filepath.Join(handler.cfg.Storage.CacheDir, "200x", "img", "photo.jpg")
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0o755); err != nil {
+		t.Fatalf("mkdir cache: %v", err)
+	}
+	if err := os.WriteFile(cachePath, []byte("variant"), 0o644); err != nil {
+		t.Fatalf("write cache: %v", err)
+	}
+	if recorder := serve(); recorder.Code != http.StatusOK || recorder.Body.String() != "variant" {
+		t.Fatalf("expected cached variant, got %d %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestHandleResizeSourceLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewGray(image.Rect(0, 0, 100, 80))); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+
+	serve := func(t *testing.T, source []byte, limit func(*config.ResizeConfig)) int {
+		handler := newTestHandler(t, func(cfg *config.Config) { limit(&cfg.Resize) })
+		origPath := filepath.Join(handler.cfg.Storage.BaseDir, "img", "photo.png")
+		if err := os.MkdirAll(filepath.Dir(origPath), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(origPath, source, 0o644); err != nil {
+			t.Fatalf("write original: %v", err)
+		}
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodGet, "/resize/50x/img/photo.png", nil)
+		c.Params = gin.Params{{Key: "geometry", Value: "50x"}, {Key: "filepath", Value: "/img/photo.png"}}
+		handler.handleResize(c)
+		return recorder.Code
+	}
+
+	maxBytes := func(r *config.ResizeConfig) { r.MaxSourceBytes = config.ByteSize{Bytes: 10} }
+	maxPixels := func(r *config.ResizeConfig) { r.MaxSourcePixels = 7999 }
+	if code := serve(t, encoded.Bytes(), maxBytes); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized file: expected 413, got %d", code)
+	}
+	if code := serve(t, encoded.Bytes(), maxPixels); code != http.StatusUnprocessableEntity {
+		t.Fatalf("oversized image: expected 422, got %d", code)
+	}
+
+	// A header that cannot be read is refused rather than let through with
+	// an unknown pixel count.
+	if code := serve(t, []byte("\x89PNG\r\n\x1a\ngarbage"), maxPixels); code != http.StatusUnsupportedMediaType {
+		t.Fatalf("unreadable header: expected 415, got %d", code)
+	}
+}
+
+func TestReadSourceLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "source.bin")
+	if err := os.WriteFile(path, []byte("0123456789"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if source, err := readSource(path, 10); err != nil || len(source) != 10 {
+		t.Fatalf("expected full read at the limit, got %d bytes, %v", len(source), err)
+	}
+	if _, err := readSource(path, 9); !errors.Is(err, errSourceTooLarge) {
+		t.Fatalf("expected errSourceTooLarge, got %v", err)
+	}
+}
+
+func TestHandleResizeProcessingDeadline(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := newTestHandler(t, func(cfg *config.Config) {
+		cfg.Admission.MaxJobs = 1
+		cfg.Admission.QueueTimeout = config.Duration{}
+		cfg.Runtime.ProcessingTimeout = config.Duration{Duration: time.Second}
+	})
+
+	origPath := filepath.Join(handler.cfg.Storage.BaseDir, "img", "photo.jpg")
+	if err := os.MkdirAll(filepath.Dir(origPath), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(origPath, testJPEG(t, 40, 30), 0o644); err != nil {
+		t.Fatalf("write original: %v", err)
+	}
+
+	// Holding the only slot keeps every job queued.
+	release, err := handler.admission.Acquire(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer release()
+
+	serve := func(ctx context.Context) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodGet, "/resize/200x/img/photo.jpg", nil).WithContext(ctx)
+		c.Params = gin.Params{{Key: "geometry", Value: "200x"}, {Key: "filepath", Value: "/img/photo.jpg"}}
+		handler.handleResize(c)
+		return recorder
+	}
+
+	t.Run("client gone", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			serve(ctx)
+		}()
+		waitForQueued(t, handler.admission, 1)
+		cancel()
+		<-done
+		// The abandoned job leaves the queue without ever starting.
+		waitForQueued(t, handler.admission, 0)
+		if stats := handler.admission.Stats(); stats.Admitted != 1 {
+			t.Fatalf("abandoned job was admitted: %+v", stats)
+		}
+	})
+	t.Run("deadline", func(t *testing.T) {
+		if code := serve(context.Background()).Code; code != http.StatusGatewayTimeout {
+			t.Fatalf("expected 504, got %d", code)
+		}
+	})
+}
+
+// newTestHandler builds a handler over fresh base and cache directories with
+// the default configuration, adjusted by mutate when it is non-nil.
+func newTestHandler(t *testing.T, mutate func(*config.Config)) *Handler {
+	t.Helper()
+	yamlConfig := fmt.Sprintf("storage:\n  base_dir: %q\n  cache_dir: %q\n", filepath.ToSlash(t.TempDir()), filepath.ToSlash(t.TempDir()))
+	cfg, err := config.LoadReader(strings.NewReader(yamlConfig))
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if mutate != nil {
+		mutate(cfg)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return NewHandler(cfg, cache.NewManager(cfg, logger), nil, locker.New(cfg), admission.New(cfg), logger)
+}
+
+func waitForQueued(t *testing.T, controller *admission.Controller, queued int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for controller.Stats().Queued != queued {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued jobs, have %+v", queued, controller.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// testJPEG encodes a blank width x height JPEG, so originals pass the header
+// probe.
+func testJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatalf("encode jpeg: %v", err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,176 @@
+package locker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fars/internal/config"
+)
+
+// ErrWaitTimeout is returned when a caller gives up waiting for a shared result.
+var ErrWaitTimeout = errors.New("timed out waiting for in-flight generation")
+
+// Group coalesces concurrent work per cache key: the first caller starts the
+// work and every caller arriving before it finishes receives the same result.
+// The work runs detached from the callers, so it completes (and can populate
+// the cache) even when the caller that started it goes away. Until the work
+// reports that it has started (see Start), its context is canceled once every
+// caller has stopped waiting, which lets queued work be dropped. Started work
+// stays registered until it returns, so later callers join it rather than
+// running a second generation next to it.
+type Group struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*call
+
+	leaders   atomic.Int64
+	coalesced atomic.Int64
+	canceled  atomic.Int64
+	timedOut  atomic.Int64
+}
+
+// Stats reports contention counters since startup.
+type Stats struct {
+	// Leaders counts calls that started work.
+	Leaders int64
+	// Coalesced counts calls that joined work already in flight.
+	Coalesced int64
+	// Canceled counts calls abandoned because their context ended.
+	Canceled int64
+	// TimedOut counts calls that exceeded the wait timeout.
+	TimedOut int64
+}
+
+type call struct {
+	done    chan struct{}
+	val     []byte
+	err     error
+	waiters int
+	started bool
+	cancel  context.CancelFunc
+}
+
+type callKey struct{}
+
+// callRef ties a work context to its call.
+type callRef struct {
+	g *Group
+	c *call
+}
+
+// New creates a group using runtime.coalesce_timeout as the wait timeout.
+func New(cfg *config.Config) *Group {
+	return &Group{
+		timeout: cfg.Runtime.CoalesceTimeout.Duration,
+		calls:   make(map[string]*call),
+	}
+}
+
+// Do runs fn once per key among concurrent callers and waits for its result.
+// shared reports whether the result came from work started by another call.
+// The wait ends early with ctx.Err() or ErrWaitTimeout; fn keeps running,
+// but its context is canceled when no caller is left waiting and fn has not
+// called Start yet.
+func (g *Group) Do(ctx context.Context, key string, fn func(ctx context.Context) ([]byte, error)) (val []byte, shared bool, err error) {
+	g.mu.Lock()
+	c, shared := g.calls[key]
+	if shared {
+		g.coalesced.Add(1)
+	} else {
+		workCtx, cancel := context.WithCancel(context.Background())
+		c = &call{done: make(chan struct{}), cancel: cancel}
+		workCtx = context.WithValue(workCtx, callKey{}, callRef{g: g, c: c})
+		g.calls[key] = c
+		g.leaders.Add(1)
+		go g.run(workCtx, key, c, fn)
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if g.timeout > 0 {
+		timer := time.NewTimer(g.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-c.done:
+		return c.val, shared, c.err
+	case <-ctx.Done():
+		g.canceled.Add(1)
+		g.leave(key, c)
+		return nil, shared, ctx.Err()
+	case <-timeout:
+		g.timedOut.Add(1)
+		g.leave(key, c)
+		return nil, shared, ErrWaitTimeout
+	}
+}
+
+// Start marks the work owning ctx as started: from then on it keeps its
+// context and registration when its callers leave. It reports false when the
+// work was already canceled, in which case it should not start. Contexts not
+// created by a Group always report true.
+func Start(ctx context.Context) bool {
+	ref, ok := ctx.Value(callKey{}).(callRef)
+	if !ok {
+		return true
+	}
+	ref.g.mu.Lock()
+	defer ref.g.mu.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	ref.c.started = true
+	return true
+}
+
+// leave drops a caller that stopped waiting. The last one cancels queued work
+// and unregisters it, so later callers start afresh instead of joining work
+// that may be abandoned. Started work is left to finish and unregister itself.
+func (g *Group) leave(key string, c *call) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c.waiters--
+	if c.waiters > 0 || c.started {
+		return
+	}
+	c.cancel()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
+
+// run executes fn outside any request goroutine, so a panic is turned into
+// an error instead of reaching the server's recovery middleware.
+func (g *Group) run(ctx context.Context, key string, c *call, fn func(ctx context.Context) ([]byte, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.val, c.err = nil, fmt.Errorf("generation panicked: %v", r)
+		}
+		c.cancel()
+		g.mu.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.val, c.err = fn(ctx)
+}
+
+// Stats returns a snapshot of the contention counters.
+func (g *Group) Stats() Stats {
+	return Stats{
+		Leaders:   g.leaders.Load(),
+		Coalesced: g.coalesced.Load(),
+		Canceled:  g.canceled.Load(),
+		TimedOut:  g.timedOut.Load(),
+	}
+}
@@ -0,0 +1,204 @@
+package locker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fars/internal/config"
+)
+
+func newTestGroup(timeout time.Duration) *Group {
+	cfg := &config.Config{}
+	cfg.Runtime.CoalesceTimeout.Duration = timeout
+	return New(cfg)
+}
+
+func TestGroupSharesResult(t *testing.T) {
+	g := newTestGroup(0)
+	var runs atomic.Int32
+	release := make(chan struct{})
+	fn := func(context.Context) ([]byte, error) {
+		runs.Add(1)
+		<-release
+		return []byte("payload"), nil
+	}
+
+	const callers = 8
+	var wg sync.WaitGroup
+	results := make(chan bool, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, shared, err := g.Do(context.Background(), "key", fn)
+			if err != nil || string(val) != "payload" {
+				t.Errorf("unexpected result %q, %v", val, err)
+			}
+			results <- shared
+		}()
+	}
+	waitFor(t, func() bool { return g.Stats().Leaders+g.Stats().Coalesced == callers })
+	close(release)
+	wg.Wait()
+	close(results)
+
+	leaders := 0
+	for shared := range results {
+		if !shared {
+			leaders++
+		}
+	}
+	if runs.Load() != 1 || leaders != 1 {
+		t.Fatalf("expected one generation, got runs=%d leaders=%d", runs.Load(), leaders)
+	}
+	if stats := g.Stats(); stats.Leaders != 1 || stats.Coalesced != callers-1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// Once finished, the key starts fresh work.
+	if _, shared, _ := g.Do(context.Background(), "key", fn); shared || runs.Load() != 2 {
+		t.Fatalf("expected a new generation, shared=%v runs=%d", shared, runs.Load())
+	}
+}
+
+func TestGroupWaitEndsEarly(t *testing.T) {
+	g := newTestGroup(200 * time.Millisecond)
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	var workErr error
+	fn := func(ctx context.Context) ([]byte, error) {
+		defer close(finished)
+		<-release
+		workErr = ctx.Err()
+		return []byte("late"), nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, _, err := g.Do(ctx, "key", fn)
+		leader <- err
+	}()
+	waitFor(t, func() bool { return g.Stats().Leaders == 1 })
+	waiter := make(chan error, 1)
+	go func() {
+		_, shared, err := g.Do(context.Background(), "key", fn)
+		if !shared {
+			t.Error("expected the waiter to join the leader's work")
+		}
+		waiter <- err
+	}()
+	waitFor(t, func() bool { return g.Stats().Coalesced == 1 })
+
+	cancel()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if err := <-waiter; !errors.Is(err, ErrWaitTimeout) {
+		t.Fatalf("expected ErrWaitTimeout, got %v", err)
+	}
+
+	// The work outlives the callers that gave up, but learns they are gone.
+	close(release)
+	<-finished
+	if !errors.Is(workErr, context.Canceled) {
+		t.Fatalf("expected the work context to be canceled, got %v", workErr)
+	}
+	if stats := g.Stats(); stats.Canceled != 1 || stats.TimedOut != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestGroupKeepsStartedWork(t *testing.T) {
+	g := newTestGroup(0)
+	var runs atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var workErr error
+	fn := func(ctx context.Context) ([]byte, error) {
+		runs.Add(1)
+		if !Start(ctx) {
+			return nil, ctx.Err()
+		}
+		close(started)
+		<-release
+		workErr = ctx.Err()
+		return []byte("payload"), nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, _, err := g.Do(ctx, "key", fn)
+		leader <- err
+	}()
+	<-started
+	cancel()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// The only waiter left, but the started work is still registered: a new
+	// request joins it instead of starting a second generation.
+	joined := make(chan error, 1)
+	go func() {
+		val, shared, err := g.Do(context.Background(), "key", fn)
+		if !shared || string(val) != "payload" {
+			t.Errorf("expected to join the running work, got %q shared=%v", val, shared)
+		}
+		joined <- err
+	}()
+	waitFor(t, func() bool { return g.Stats().Coalesced == 1 })
+	close(release)
+	if err := <-joined; err != nil {
+		t.Fatal(err)
+	}
+	if runs.Load() != 1 || workErr != nil {
+		t.Fatalf("expected one uncanceled generation, got runs=%d err=%v", runs.Load(), workErr)
+	}
+}
+
+func TestGroupStartAfterCancel(t *testing.T) {
+	g := newTestGroup(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	admitted := make(chan bool, 1)
+	fn := func(ctx context.Context) ([]byte, error) {
+		<-ctx.Done()
+		admitted <- Start(ctx)
+		return nil, ctx.Err()
+	}
+	go func() { _, _, _ = g.Do(ctx, "key", fn) }()
+	waitFor(t, func() bool { return g.Stats().Leaders == 1 })
+	cancel()
+	if <-admitted {
+		t.Fatal("expected Start to refuse work whose callers all left")
+	}
+	if !Start(context.Background()) {
+		t.Fatal("expected contexts outside a group to start")
+	}
+}
+
+func TestGroupRecoversPanics(t *testing.T) {
+	g := newTestGroup(0)
+	_, _, err := g.Do(context.Background(), "key", func(context.Context) ([]byte, error) {
+		panic("boom")
+	})
+	if err == nil {
+		t.Fatal("expected panic to surface as an error")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
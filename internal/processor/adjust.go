@@ -0,0 +1,223 @@
+package processor
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+// fars_reorient applies the EXIF orientation, then rotates an encoded image
+// clockwise by angle and mirrors it, and saves the result as an
+// uncompressed PNG.
+static int
+fars_reorient(void *buf, size_t len, VipsAngle angle, int flip, int flop, void **out, size_t *outlen)
+{
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 5);
+	int err;
+
+	if (!(t[0] = vips_image_new_from_buffer(buf, len, "", NULL)) ||
+		vips_autorot(t[0], &t[1], NULL) ||
+		vips_rot(t[1], &t[2], angle, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	if (flip) {
+		err = vips_flip(t[2], &t[3], VIPS_DIRECTION_VERTICAL, NULL);
+	} else {
+		err = vips_copy(t[2], &t[3], NULL);
+	}
+	if (!err && flop) {
+		err = vips_flip(t[3], &t[4], VIPS_DIRECTION_HORIZONTAL, NULL);
+	} else if (!err) {
+		err = vips_copy(t[3], &t[4], NULL);
+	}
+	err = err || vips_pngsave_buffer(t[4], out, outlen, "compression", 0, NULL);
+	g_object_unref(base);
+	return err;
+}
+
+// fars_adjust applies colour operations and filters to an encoded image and
+// saves the result as an uncompressed PNG. Alpha is set aside and rejoined
+// untouched. tint holds the Lab a and b of the tint colour, or NULL; the
+// tinted image keeps its own lightness. brightness and contrast of 1, and a
+// zero blur or sharpen sigma, leave the image alone.
+static int
+fars_adjust(void *buf, size_t len, int grayscale, double *tint, double brightness, double contrast, double blur, double sharpen, void **out, size_t *outlen)
+{
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 16);
+	VipsImage *in, *alpha = NULL;
+	int i = 2, err;
+
+	if (!(t[0] = vips_image_new_from_buffer(buf, len, "", NULL)) ||
+		vips_colourspace(t[0], &t[1], VIPS_INTERPRETATION_sRGB, NULL)) {
+		goto fail;
+	}
+	in = t[1];
+	if (vips_image_hasalpha(in)) {
+		if (vips_extract_band(in, &t[i], 0, "n", in->Bands - 1, NULL) ||
+			vips_extract_band(in, &t[i + 1], in->Bands - 1, NULL)) {
+			goto fail;
+		}
+		in = t[i];
+		alpha = t[i + 1];
+		i += 2;
+	}
+	if (grayscale) {
+		if (vips_colourspace(in, &t[i], VIPS_INTERPRETATION_B_W, NULL) ||
+			vips_colourspace(t[i], &t[i + 1], VIPS_INTERPRETATION_sRGB, NULL)) {
+			goto fail;
+		}
+		in = t[i + 1];
+		i += 2;
+	}
+	if (tint) {
+		if (vips_colourspace(in, &t[i], VIPS_INTERPRETATION_LAB, NULL) ||
+			vips_extract_band(t[i], &t[i + 1], 0, NULL) ||
+			vips_bandjoin_const(t[i + 1], &t[i + 2], tint, 2, NULL) ||
+			vips_colourspace(t[i + 2], &t[i + 3], VIPS_INTERPRETATION_sRGB,
+				"source_space", VIPS_INTERPRETATION_LAB, NULL)) {
+			goto fail;
+		}
+		in = t[i + 3];
+		i += 4;
+	}
+	if (brightness != 1 || contrast != 1) {
+		if (vips_linear1(in, &t[i], brightness * contrast, brightness * 128 * (1 - contrast), NULL)) {
+			goto fail;
+		}
+		in = t[i++];
+	}
+	if (blur > 0) {
+		if (vips_gaussblur(in, &t[i], blur, NULL)) {
+			goto fail;
+		}
+		in = t[i++];
+	}
+	if (sharpen > 0) {
+		if (vips_sharpen(in, &t[i], "sigma", sharpen, NULL)) {
+			goto fail;
+		}
+		in = t[i++];
+	}
+	if (vips_cast_uchar(in, &t[i], NULL)) {
+		goto fail;
+	}
+	in = t[i++];
+	if (alpha) {
+		if (vips_bandjoin2(in, alpha, &t[i], NULL)) {
+			goto fail;
+		}
+		in = t[i++];
+	}
+	err = vips_pngsave_buffer(in, out, outlen, "compression", 0, NULL);
+	g_object_unref(base);
+	return err;
+
+fail:
+	g_object_unref(base);
+	return -1;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image/color"
+	"math"
+	"unsafe"
+)
+
+var vipsAngles = map[int]C.VipsAngle{
+	0:   C.VIPS_ANGLE_D0,
+	90:  C.VIPS_ANGLE_D90,
+	180: C.VIPS_ANGLE_D180,
+	270: C.VIPS_ANGLE_D270,
+}
+
+// reorient rotates and mirrors the source before it is fitted, so the
+// requested geometry applies to the rotated image.
+func reorient(source []byte, adjust Adjustments) ([]byte, error) {
+	angle, ok := vipsAngles[adjust.Rotate]
+	if !ok {
+		return nil, errors.New("rotation must be 0, 90, 180 or 270 degrees")
+	}
+	if len(source) == 0 {
+		return nil, errors.New("reorient source is empty")
+	}
+	defer C.vips_thread_shutdown()
+	var (
+		out        unsafe.Pointer
+		outLen     C.size_t
+		flip, flop C.int
+	)
+	if adjust.Flip {
+		flip = 1
+	}
+	if adjust.Flop {
+		flop = 1
+	}
+	if C.fars_reorient(unsafe.Pointer(&source[0]), C.size_t(len(source)), angle, flip, flop, &out, &outLen) != 0 {
+		return nil, vipsError()
+	}
+	return takeVipsBuffer(out, outLen), nil
+}
+
+// adjustImage applies the colour operations and filters of adjust to a
+// rendered image.
+func adjustImage(source []byte, adjust Adjustments) ([]byte, error) {
+	if len(source) == 0 {
+		return nil, errors.New("adjust source is empty")
+	}
+	defer C.vips_thread_shutdown()
+	var (
+		out       unsafe.Pointer
+		outLen    C.size_t
+		grayscale C.int
+		tint      *C.double
+	)
+	if adjust.Grayscale {
+		grayscale = 1
+	}
+	chroma := [2]C.double{}
+	if adjust.Tint != (color.NRGBA{}) {
+		a, b := labChroma(adjust.Tint)
+		chroma = [2]C.double{C.double(a), C.double(b)}
+		tint = &chroma[0]
+	}
+	brightness, contrast := adjust.Brightness, adjust.Contrast
+	if brightness == 0 {
+		brightness = 1
+	}
+	if contrast == 0 {
+		contrast = 1
+	}
+	if C.fars_adjust(unsafe.Pointer(&source[0]), C.size_t(len(source)), grayscale, tint,
+		C.double(brightness), C.double(contrast), C.double(adjust.Blur), C.double(adjust.Sharpen), &out, &outLen) != 0 {
+		return nil, vipsError()
+	}
+	return takeVipsBuffer(out, outLen), nil
+}
+
+// labChroma returns the CIELAB a and b (D65) of an sRGB colour, matching
+// the Lab space libvips converts to.
+func labChroma(c color.NRGBA) (float64, float64) {
+	linear := func(v uint8) float64 {
+		s := float64(v) / 255
+		if s <= 0.04045 {
+			return s / 12.92
+		}
+		return math.Pow((s+0.055)/1.055, 2.4)
+	}
+	r, g, b := linear(c.R), linear(c.G), linear(c.B)
+	x := (0.4124*r + 0.3576*g + 0.1805*b) / 0.95047
+	y := 0.2126*r + 0.7152*g + 0.0722*b
+	z := (0.0193*r + 0.1192*g + 0.9505*b) / 1.08883
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	return 500 * (f(x) - f(y)), 200 * (f(y) - f(z))
+}
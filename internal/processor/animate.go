@@ -0,0 +1,405 @@
+package processor
+
+/*
+#cgo pkg-config: vips libheif
+#include <stdlib.h>
+#include <string.h>
+#include <vips/vips.h>
+#include <libheif/heif.h>
+
+// libvips writes multi-page AVIF as separate stills, so AVIF sequences are
+// encoded with libheif directly. Its sequence API arrived in 1.20.
+#if LIBHEIF_HAVE_VERSION(1, 20, 0)
+#include <libheif/heif_sequences.h>
+#define FARS_AVIF_SEQUENCES 1
+#else
+#define FARS_AVIF_SEQUENCES 0
+#endif
+
+enum {
+	FARS_ANIM_WEBP,
+	FARS_ANIM_GIF,
+	FARS_ANIM_AVIF
+};
+
+typedef struct {
+	// Frames are scaled to thumb_width x thumb_height, cropped to that box
+	// with the crop strategy (a VipsInteresting) or stretched to it when
+	// crop is -1, then centred on a canvas_width x canvas_height canvas.
+	int thumb_width, thumb_height;
+	int crop;
+	int canvas_width, canvas_height;
+	double colour[4];
+	int flatten;
+	int format;
+	// quality is the WebP or AVIF Q, or the GIF palette bit depth (zero
+	// keeps the GIF default); a negative speed keeps the AVIF default.
+	int quality;
+	int speed;
+} FarsAnimation;
+
+// fars_source_pages returns the number of frames (pages) of an encoded image.
+static int
+fars_source_pages(void *buf, size_t len)
+{
+	VipsImage *image = vips_image_new_from_buffer(buf, len, "", NULL);
+	int pages;
+
+	if (!image) {
+		vips_error_clear();
+		return 1;
+	}
+	pages = vips_image_get_n_pages(image);
+	g_object_unref(image);
+	return pages;
+}
+
+#if FARS_AVIF_SEQUENCES
+static struct heif_error
+fars_heif_write(struct heif_context *ctx, const void *data, size_t size, void *userdata)
+{
+	struct heif_error ok = { heif_error_Ok, heif_suberror_Unspecified, "Success" };
+
+	g_byte_array_append((GByteArray *) userdata, data, size);
+	return ok;
+}
+
+// fars_heif_failed moves a libheif error into the libvips error buffer.
+static int
+fars_heif_failed(struct heif_error err)
+{
+	if (err.code == heif_error_Ok) {
+		return 0;
+	}
+	vips_error("fars", "libheif: %s", err.message);
+	return -1;
+}
+
+// fars_avifsave_sequence encodes 8-bit sRGB frames stacked at page-height as
+// an AVIF image sequence, keeping the frame delays. A negative speed keeps
+// the encoder default.
+static int
+fars_avifsave_sequence(VipsImage *in, int quality, int speed, void **out, size_t *outlen)
+{
+	int page = vips_image_get_page_height(in);
+	int pages = in->Ysize / page;
+	size_t row = (size_t) in->Xsize * in->Bands;
+	int *delays = NULL;
+	int n_delays = 0;
+	struct heif_context *ctx;
+	struct heif_encoder *encoder = NULL;
+	heif_track_options *options;
+	heif_track *track = NULL;
+	struct heif_writer writer = { 1, fars_heif_write };
+	GByteArray *bytes;
+	unsigned char *pixels;
+	size_t size;
+	int i, y, stride, err;
+
+	if (in->Xsize > 65535 || page > 65535) {
+		vips_error("fars", "animation is too large for an AVIF sequence");
+		return -1;
+	}
+	if (vips_image_get_typeof(in, "delay") &&
+		vips_image_get_array_int(in, "delay", &delays, &n_delays)) {
+		return -1;
+	}
+	if (fars_heif_failed(heif_init(NULL))) {
+		return -1;
+	}
+	if (!(pixels = vips_image_write_to_memory(in, &size))) {
+		heif_deinit();
+		return -1;
+	}
+
+	ctx = heif_context_alloc();
+	bytes = g_byte_array_new();
+	heif_context_set_sequence_timescale(ctx, 1000);
+	options = heif_track_options_alloc();
+	heif_track_options_set_timescale(options, 1000);
+	err = fars_heif_failed(heif_context_get_encoder_for_format(ctx, heif_compression_AV1, &encoder)) ||
+		fars_heif_failed(heif_encoder_set_lossy_quality(encoder, quality)) ||
+		fars_heif_failed(heif_context_add_visual_sequence_track(ctx, in->Xsize, page,
+			heif_track_type_image_sequence, options, NULL, &track));
+	if (!err && speed >= 0) {
+		// Not every AV1 encoder plugin knows the parameter.
+		heif_encoder_set_parameter_integer(encoder, "speed", speed);
+	}
+	for (i = 0; !err && i < pages; i++) {
+		struct heif_image *image;
+		uint8_t *plane;
+
+		if (fars_heif_failed(heif_image_create(in->Xsize, page, heif_colorspace_RGB,
+			in->Bands == 4 ? heif_chroma_interleaved_RGBA : heif_chroma_interleaved_RGB, &image))) {
+			err = -1;
+			break;
+		}
+		err = fars_heif_failed(heif_image_add_plane(image, heif_channel_interleaved, in->Xsize, page, 8));
+		if (!err) {
+			plane = heif_image_get_plane(image, heif_channel_interleaved, &stride);
+			for (y = 0; y < page; y++) {
+				memcpy(plane + (size_t) y * stride, pixels + ((size_t) i * page + y) * row, row);
+			}
+			heif_image_set_duration(image, i < n_delays && delays[i] > 0 ? delays[i] : 100);
+			err = fars_heif_failed(heif_track_encode_sequence_image(track, image, encoder, NULL));
+		}
+		heif_image_release(image);
+	}
+	if (!err) {
+		err = fars_heif_failed(heif_track_encode_end_of_sequence(track, encoder)) ||
+			fars_heif_failed(heif_context_write(ctx, &writer, bytes));
+	}
+
+	if (track) {
+		heif_track_release(track);
+	}
+	if (encoder) {
+		heif_encoder_release(encoder);
+	}
+	heif_track_options_release(options);
+	heif_context_free(ctx);
+	heif_deinit();
+	g_free(pixels);
+	if (err) {
+		g_byte_array_free(bytes, TRUE);
+		return -1;
+	}
+	*outlen = bytes->len;
+	*out = g_byte_array_free(bytes, FALSE);
+	return 0;
+}
+#else
+static int
+fars_avifsave_sequence(VipsImage *in, int quality, int speed, void **out, size_t *outlen)
+{
+	vips_error("fars", "AVIF sequences need libheif 1.20 or newer");
+	return -1;
+}
+#endif
+
+// fars_resize_animated scales every frame of an animated image and pads the
+// frames like fars_embed_canvas when the canvas is larger. The frames stay
+// stacked at page-height with their delays and loop count; the caller owns
+// *out.
+static int
+fars_resize_animated(void *buf, size_t len, FarsAnimation *o, VipsImage **out)
+{
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 4);
+	VipsImage **frames;
+	VipsImage *result;
+	VipsArrayDouble *background;
+	int page, pages, i, err;
+
+	if (o->crop >= 0) {
+		err = vips_thumbnail_buffer(buf, len, &t[0], o->thumb_width,
+			"height", o->thumb_height, "crop", o->crop,
+			"option_string", "n=-1", NULL);
+	} else {
+		err = vips_thumbnail_buffer(buf, len, &t[0], o->thumb_width,
+			"height", o->thumb_height, "size", VIPS_SIZE_FORCE,
+			"option_string", "n=-1", NULL);
+	}
+	if (err) {
+		g_object_unref(base);
+		return err;
+	}
+
+	if (o->flatten && vips_image_hasalpha(t[0])) {
+		background = vips_array_double_new(o->colour, 3);
+		err = vips_flatten(t[0], &t[1], "background", background, NULL);
+		vips_area_unref(VIPS_AREA(background));
+	} else if (!o->flatten && !vips_image_hasalpha(t[0])) {
+		err = vips_addalpha(t[0], &t[1], NULL);
+	} else {
+		err = vips_copy(t[0], &t[1], NULL);
+	}
+	if (err) {
+		g_object_unref(base);
+		return err;
+	}
+	result = t[1];
+
+	page = vips_image_get_page_height(t[1]);
+	if (t[1]->Xsize != o->canvas_width || page != o->canvas_height) {
+		pages = t[1]->Ysize / page;
+		frames = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 2 * pages);
+		background = vips_array_double_new(o->colour, t[1]->Bands);
+		for (i = 0; !err && i < pages; i++) {
+			err = vips_extract_area(t[1], &frames[i], 0, i * page, t[1]->Xsize, page, NULL) ||
+				vips_embed(frames[i], &frames[pages + i],
+					(o->canvas_width - t[1]->Xsize) / 2, (o->canvas_height - page) / 2,
+					o->canvas_width, o->canvas_height,
+					"extend", VIPS_EXTEND_BACKGROUND, "background", background, NULL);
+		}
+		vips_area_unref(VIPS_AREA(background));
+		if (err ||
+			vips_arrayjoin(frames + pages, &t[2], pages, "across", 1, NULL) ||
+			vips_copy(t[2], &t[3], NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		vips_image_set_int(t[3], "page-height", o->canvas_height);
+		result = t[3];
+	}
+
+	*out = result;
+	g_object_ref(result);
+	g_object_unref(base);
+	return 0;
+}
+
+// fars_save_animated saves frames stacked at page-height as WebP, GIF or an
+// AVIF sequence. Frame delays carry over, and the loop count does for WebP
+// and GIF.
+static int
+fars_save_animated(VipsImage *in, FarsAnimation *o, void **out, size_t *outlen)
+{
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 2);
+	int err;
+
+	if (o->format == FARS_ANIM_AVIF) {
+		err = vips_colourspace(in, &t[0], VIPS_INTERPRETATION_sRGB, NULL) ||
+			vips_cast_uchar(t[0], &t[1], NULL) ||
+			fars_avifsave_sequence(t[1], o->quality, o->speed, out, outlen);
+	} else if (o->format == FARS_ANIM_GIF && o->quality > 0) {
+		err = vips_gifsave_buffer(in, out, outlen, "bitdepth", o->quality, NULL);
+	} else if (o->format == FARS_ANIM_GIF) {
+		err = vips_gifsave_buffer(in, out, outlen, NULL);
+	} else {
+		err = vips_webpsave_buffer(in, out, outlen, "Q", o->quality, NULL);
+	}
+	g_object_unref(base);
+	return err;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"math"
+	"unsafe"
+
+	"github.com/h2non/bimg"
+)
+
+// coverCrop maps gravities onto the libvips crop strategies available to
+// animations; focal points fall back to the centre.
+var coverCrop = map[Gravity]C.int{
+	"":               C.VIPS_INTERESTING_CENTRE,
+	GravityCentre:    C.VIPS_INTERESTING_CENTRE,
+	GravityFocal:     C.VIPS_INTERESTING_CENTRE,
+	GravityNorth:     C.VIPS_INTERESTING_LOW,
+	GravityWest:      C.VIPS_INTERESTING_LOW,
+	GravitySouth:     C.VIPS_INTERESTING_HIGH,
+	GravityEast:      C.VIPS_INTERESTING_HIGH,
+	GravityAttention: C.VIPS_INTERESTING_ATTENTION,
+	GravityEntropy:   C.VIPS_INTERESTING_ENTROPY,
+}
+
+// avifSequences reports whether libheif can write AVIF image sequences.
+var avifSequences = C.FARS_AVIF_SEQUENCES != 0
+
+// sourceFrames returns the number of frames of an encoded image; still
+// images and unreadable payloads count as one.
+func sourceFrames(source []byte) int {
+	if len(source) == 0 {
+		return 1
+	}
+	defer C.vips_thread_shutdown()
+	return int(C.fars_source_pages(unsafe.Pointer(&source[0]), C.size_t(len(source))))
+}
+
+// resizeAnimated renders every frame of an animated source with the fit
+// modes and upscaling policy of still images, and composites the watermark
+// onto each frame. Letterbox padding is always solid, and trimming is not
+// applied.
+func resizeAnimated(source []byte, opts Options) ([]byte, error) {
+	size, err := bimg.Size(source)
+	if err != nil {
+		return nil, fmt.Errorf("inspect source size: %w", err)
+	}
+	anim := C.FarsAnimation{crop: -1, quality: C.int(opts.WebPQuality), speed: -1}
+	switch {
+	case opts.Format == FormatWEBP:
+		anim.format = C.FARS_ANIM_WEBP
+	case opts.Format == FormatGIF:
+		anim.format = C.FARS_ANIM_GIF
+		anim.quality = C.int(gifBitDepth(opts.GIFQuality))
+	case opts.Format == FormatAVIF && avifSequences:
+		anim.format = C.FARS_ANIM_AVIF
+		anim.quality = C.int(opts.AVIFQuality)
+		if opts.AVIFSpeed > 0 {
+			anim.speed = C.int(opts.AVIFSpeed)
+		}
+	default:
+		return nil, fmt.Errorf("format %q cannot be animated", opts.Format)
+	}
+	bg, flatten := opts.background()
+	anim.colour = [4]C.double{C.double(bg.R), C.double(bg.G), C.double(bg.B), C.double(bg.A)}
+	if flatten {
+		anim.flatten = 1
+	}
+
+	thumbWidth, thumbHeight := opts.Width, opts.Height
+	canvasWidth, canvasHeight := opts.Width, opts.Height
+	switch {
+	case opts.Width > 0 && opts.Height > 0 && opts.Fit == FitCover:
+		crop, ok := coverCrop[opts.Gravity]
+		if !ok {
+			return nil, fmt.Errorf("unsupported gravity %q", opts.Gravity)
+		}
+		anim.crop = crop
+	case opts.Width > 0 && opts.Height > 0 && opts.Fit == FitFill:
+	default:
+		// Contain, inside and single-side geometry: scale the frames as
+		// the still pipeline would and pad contain results.
+		singleSide := opts.Width == 0 || opts.Height == 0
+		switch {
+		case opts.Width == 0:
+			canvasWidth = max(1, int(math.Round(float64(opts.Height)*float64(size.Width)/float64(size.Height))))
+			if opts.Height > size.Height {
+				canvasWidth = max(canvasWidth, size.Width)
+			}
+		case opts.Height == 0:
+			canvasHeight = max(1, int(math.Round(float64(opts.Width)*float64(size.Height)/float64(size.Width))))
+			if opts.Width > size.Width {
+				canvasHeight = max(canvasHeight, size.Height)
+			}
+		}
+		fit := math.Min(float64(canvasWidth)/float64(size.Width), float64(canvasHeight)/float64(size.Height))
+		scale := opts.upscaleFactor(fit)
+		thumbWidth = min(canvasWidth, max(1, int(math.Round(float64(size.Width)*scale))))
+		thumbHeight = min(canvasHeight, max(1, int(math.Round(float64(size.Height)*scale))))
+		if opts.Fit == FitInside || (singleSide && fit <= 1) || (fit > 1 && opts.Upscale == UpscaleNone) {
+			canvasWidth, canvasHeight = thumbWidth, thumbHeight
+		}
+	}
+	anim.thumb_width, anim.thumb_height = C.int(thumbWidth), C.int(thumbHeight)
+	anim.canvas_width, anim.canvas_height = C.int(canvasWidth), C.int(canvasHeight)
+
+	defer C.vips_thread_shutdown()
+	var frames *C.VipsImage
+	if C.fars_resize_animated(unsafe.Pointer(&source[0]), C.size_t(len(source)), &anim, &frames) != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(frames))
+	if opts.Watermark.Image != nil && max(canvasWidth, canvasHeight) >= opts.Watermark.MinSize {
+		marked, err := watermarkFrames(frames, opts.Watermark)
+		if err != nil {
+			return nil, fmt.Errorf("compose watermark: %w", err)
+		}
+		defer C.g_object_unref(C.gpointer(marked))
+		frames = marked
+	}
+
+	var (
+		out    unsafe.Pointer
+		outLen C.size_t
+	)
+	if C.fars_save_animated(frames, &anim, &out, &outLen) != 0 {
+		return nil, vipsError()
+	}
+	return takeVipsBuffer(out, outLen), nil
+}
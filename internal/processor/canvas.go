@@ -0,0 +1,195 @@
+package processor
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+enum {
+	FARS_PAD_SOLID,
+	FARS_PAD_BLUR,
+	FARS_PAD_EDGE,
+	FARS_PAD_MIRROR
+};
+
+// The blurred backdrop is blurred at 1/FARS_BLUR_REDUCE of the canvas size
+// and scaled back up, which looks the same as a wide blur at full size for
+// a fraction of the cost.
+#define FARS_BLUR_REDUCE 8
+#define FARS_BLUR_SIGMA 2.5
+
+// fars_blur_backdrop covers a width x height canvas with a blurred copy of in.
+static int
+fars_blur_backdrop(VipsImage *base, VipsImage *in, int width, int height, VipsImage **out)
+{
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 2);
+
+	if (vips_thumbnail_image(in, &t[0], VIPS_MAX(width / FARS_BLUR_REDUCE, 1),
+			"height", VIPS_MAX(height / FARS_BLUR_REDUCE, 1),
+			"crop", VIPS_INTERESTING_CENTRE, NULL) ||
+		vips_gaussblur(t[0], &t[1], FARS_BLUR_SIGMA, NULL)) {
+		return -1;
+	}
+	return vips_thumbnail_image(t[1], out, width,
+		"height", height, "crop", VIPS_INTERESTING_CENTRE, NULL);
+}
+
+// fars_embed_canvas centres an encoded image on a width x height canvas and
+// saves the result as an uncompressed PNG. With flatten set the image is
+// flattened onto the background colour; otherwise it gains an alpha channel
+// if needed and solid padding keeps the colour's alpha. padding selects a
+// FARS_PAD_* fill for the area around the image.
+static int
+fars_embed_canvas(void *buf, size_t len, int width, int height, double *colour, int flatten, int padding, void **out, size_t *outlen)
+{
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 6);
+	VipsArrayDouble *background;
+	int left, top, err;
+
+	if (!(t[0] = vips_image_new_from_buffer(buf, len, "", NULL)) ||
+		vips_autorot(t[0], &t[1], NULL) ||
+		vips_colourspace(t[1], &t[2], VIPS_INTERPRETATION_sRGB, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+
+	if (flatten && vips_image_hasalpha(t[2])) {
+		background = vips_array_double_new(colour, 3);
+		err = vips_flatten(t[2], &t[3], "background", background, NULL);
+		vips_area_unref(VIPS_AREA(background));
+	} else if (!flatten && !vips_image_hasalpha(t[2])) {
+		err = vips_addalpha(t[2], &t[3], NULL);
+	} else {
+		err = vips_copy(t[2], &t[3], NULL);
+	}
+	if (err) {
+		g_object_unref(base);
+		return err;
+	}
+
+	left = (width - t[3]->Xsize) / 2;
+	top = (height - t[3]->Ysize) / 2;
+	switch (padding) {
+	case FARS_PAD_BLUR:
+		err = fars_blur_backdrop(base, t[3], width, height, &t[4]) ||
+			vips_insert(t[4], t[3], &t[5], left, top, NULL);
+		break;
+	case FARS_PAD_EDGE:
+		err = vips_embed(t[3], &t[5], left, top, width, height,
+			"extend", VIPS_EXTEND_COPY, NULL);
+		break;
+	case FARS_PAD_MIRROR:
+		err = vips_embed(t[3], &t[5], left, top, width, height,
+			"extend", VIPS_EXTEND_MIRROR, NULL);
+		break;
+	default:
+		background = vips_array_double_new(colour, t[3]->Bands);
+		err = vips_embed(t[3], &t[5], left, top, width, height,
+			"extend", VIPS_EXTEND_BACKGROUND, "background", background, NULL);
+		vips_area_unref(VIPS_AREA(background));
+	}
+	if (!err) {
+		err = vips_pngsave_buffer(t[5], out, outlen, "compression", 0, NULL);
+	}
+	g_object_unref(base);
+	return err;
+}
+
+// fars_entropy_cover scales an encoded image to cover a width x height box
+// and crops it to the window with the most entropy, like animations do, and
+// saves the result as an uncompressed PNG.
+static int
+fars_entropy_cover(void *buf, size_t len, int width, int height, void **out, size_t *outlen)
+{
+	VipsImage *image;
+	int err;
+
+	if (vips_thumbnail_buffer(buf, len, &image, width, "height", height,
+		"crop", VIPS_INTERESTING_ENTROPY, NULL)) {
+		return -1;
+	}
+	err = vips_pngsave_buffer(image, out, outlen, "compression", 0, NULL);
+	g_object_unref(image);
+	return err;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"strings"
+	"unsafe"
+)
+
+// vipsError returns the pending libvips error message as an error and clears
+// the error buffer.
+func vipsError() error {
+	message := strings.TrimSpace(C.GoString(C.vips_error_buffer()))
+	C.vips_error_clear()
+	return errors.New(message)
+}
+
+// takeVipsBuffer copies a buffer saved by libvips into Go memory and frees
+// it. The libvips stages of this package all save an uncompressed PNG, so
+// what they return is a lossless intermediate for the final encode.
+func takeVipsBuffer(out unsafe.Pointer, length C.size_t) []byte {
+	defer C.g_free(C.gpointer(out))
+	return C.GoBytes(out, C.int(length))
+}
+
+var paddingModes = map[Padding]C.int{
+	"":            C.FARS_PAD_SOLID,
+	PaddingSolid:  C.FARS_PAD_SOLID,
+	PaddingBlur:   C.FARS_PAD_BLUR,
+	PaddingEdge:   C.FARS_PAD_EDGE,
+	PaddingMirror: C.FARS_PAD_MIRROR,
+}
+
+// embedCanvas centres the encoded image on a width x height canvas in a
+// single libvips pipeline (autorotate, flatten onto bg or add alpha, then
+// pad with bg or the selected fill).
+func embedCanvas(source []byte, width, height int, bg color.NRGBA, flatten bool, padding Padding) ([]byte, error) {
+	if len(source) == 0 {
+		return nil, errors.New("canvas source is empty")
+	}
+	mode, ok := paddingModes[padding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported padding %q", padding)
+	}
+	defer C.vips_thread_shutdown()
+
+	var (
+		out    unsafe.Pointer
+		outLen C.size_t
+		flag   C.int
+	)
+	if flatten {
+		flag = 1
+	}
+	colour := [4]C.double{C.double(bg.R), C.double(bg.G), C.double(bg.B), C.double(bg.A)}
+	if C.fars_embed_canvas(unsafe.Pointer(&source[0]), C.size_t(len(source)), C.int(width), C.int(height), &colour[0], flag, mode, &out, &outLen) != 0 {
+		return nil, vipsError()
+	}
+	return takeVipsBuffer(out, outLen), nil
+}
+
+// entropyCover crops the encoded image to the width x height window with the
+// most detail using the libvips entropy strategy, so still and animated
+// entropy crops agree.
+func entropyCover(source []byte, width, height int) ([]byte, error) {
+	if len(source) == 0 {
+		return nil, errors.New("cover source is empty")
+	}
+	defer C.vips_thread_shutdown()
+	var (
+		out    unsafe.Pointer
+		outLen C.size_t
+	)
+	if C.fars_entropy_cover(unsafe.Pointer(&source[0]), C.size_t(len(source)), C.int(width), C.int(height), &out, &outLen) != 0 {
+		return nil, vipsError()
+	}
+	return takeVipsBuffer(out, outLen), nil
+}
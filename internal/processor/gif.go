@@ -0,0 +1,60 @@
+package processor
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+// fars_gifsave re-encodes an image as GIF with a palette of 2^bitdepth
+// colours. A zero bitdepth keeps the libvips default.
+static int
+fars_gifsave(void *buf, size_t len, int bitdepth, void **out, size_t *outlen)
+{
+	VipsImage *image = vips_image_new_from_buffer(buf, len, "", NULL);
+	int err;
+
+	if (!image) {
+		return -1;
+	}
+	if (bitdepth > 0) {
+		err = vips_gifsave_buffer(image, out, outlen, "bitdepth", bitdepth, NULL);
+	} else {
+		err = vips_gifsave_buffer(image, out, outlen, NULL);
+	}
+	g_object_unref(image);
+	return err;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"math"
+	"unsafe"
+)
+
+// gifBitDepth maps a 1-100 quality onto the palette bit depth: 100 keeps 256
+// colours, 50 leaves 16. Zero keeps the libvips default.
+func gifBitDepth(quality int) int {
+	if quality <= 0 {
+		return 0
+	}
+	return min(8, max(1, int(math.Ceil(float64(quality)*8/100))))
+}
+
+// encodeGIF converts a rendered image into GIF with a palette sized by
+// quality; bimg has no GIF encoder options.
+func encodeGIF(source []byte, quality int) ([]byte, error) {
+	if len(source) == 0 {
+		return nil, errors.New("gif source is empty")
+	}
+	defer C.vips_thread_shutdown()
+	var (
+		out    unsafe.Pointer
+		outLen C.size_t
+	)
+	if C.fars_gifsave(unsafe.Pointer(&source[0]), C.size_t(len(source)), C.int(gifBitDepth(quality)), &out, &outLen) != 0 {
+		return nil, vipsError()
+	}
+	return takeVipsBuffer(out, outLen), nil
+}
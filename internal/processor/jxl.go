@@ -0,0 +1,53 @@
+package processor
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+// fars_jxlsave re-encodes an image as JPEG XL. A zero quality or effort
+// keeps the libvips default.
+static int
+fars_jxlsave(void *buf, size_t len, int quality, int effort, void **out, size_t *outlen)
+{
+	VipsImage *image = vips_image_new_from_buffer(buf, len, "", NULL);
+	int err;
+
+	if (!image) {
+		return -1;
+	}
+	if (quality > 0 && effort > 0) {
+		err = vips_jxlsave_buffer(image, out, outlen, "Q", quality, "effort", effort, NULL);
+	} else if (quality > 0) {
+		err = vips_jxlsave_buffer(image, out, outlen, "Q", quality, NULL);
+	} else if (effort > 0) {
+		err = vips_jxlsave_buffer(image, out, outlen, "effort", effort, NULL);
+	} else {
+		err = vips_jxlsave_buffer(image, out, outlen, NULL);
+	}
+	g_object_unref(image);
+	return err;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// encodeJXL converts a rendered image into JPEG XL, which bimg cannot write.
+func encodeJXL(source []byte, quality, effort int) ([]byte, error) {
+	if len(source) == 0 {
+		return nil, errors.New("jxl source is empty")
+	}
+	defer C.vips_thread_shutdown()
+	var (
+		out    unsafe.Pointer
+		outLen C.size_t
+	)
+	if C.fars_jxlsave(unsafe.Pointer(&source[0]), C.size_t(len(source)), C.int(quality), C.int(effort), &out, &outLen) != 0 {
+		return nil, vipsError()
+	}
+	return takeVipsBuffer(out, outLen), nil
+}
@@ -1,17 +1,20 @@
 package processor
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"image"
 	"image/color"
-	"image/draw"
-	"image/png"
 	"math"
 
 	"github.com/h2non/bimg"
 )
 
+// ErrUnsupportedSource reports a source that no libvips loader can read.
+var ErrUnsupportedSource = errors.New("unsupported source format")
+
 // Format enumerates supported output formats.
 type Format string
 
@@ -20,19 +23,232 @@ const (
 	FormatPNG  Format = "png"
 	FormatWEBP Format = "webp"
 	FormatAVIF Format = "avif"
+	FormatGIF  Format = "gif"
+	FormatJXL  Format = "jxl"
+)
+
+// Fit enumerates how an image is placed into a geometry with both sides set.
+type Fit string
+
+const (
+	// FitContain shrinks the image to fit and centres it on a padded canvas.
+	FitContain Fit = "contain"
+	// FitCover scales the image to fill the box and crops the overflow.
+	FitCover Fit = "cover"
+	// FitFill stretches the image to the exact box, ignoring aspect ratio.
+	FitFill Fit = "fill"
+	// FitInside shrinks the image to fit without padding; the output shrinks to the content.
+	FitInside Fit = "inside"
+)
+
+// Gravity selects which part of the image survives a cover crop.
+type Gravity string
+
+const (
+	GravityCentre Gravity = "centre"
+	GravityNorth  Gravity = "north"
+	GravitySouth  Gravity = "south"
+	GravityEast   Gravity = "east"
+	GravityWest   Gravity = "west"
+	// GravityAttention uses the libvips smart-crop attention strategy.
+	GravityAttention Gravity = "attention"
+	// GravityEntropy keeps the region with the most detail.
+	GravityEntropy Gravity = "entropy"
+	// GravityFocal keeps the point described by Options.FocalX/FocalY.
+	GravityFocal Gravity = "focal"
+)
+
+// Padding selects how a letterbox canvas is filled around the image.
+type Padding string
+
+const (
+	// PaddingSolid fills the canvas with Options.Background.
+	PaddingSolid Padding = "solid"
+	// PaddingBlur fills the canvas with a blurred, scaled-up copy of the image.
+	PaddingBlur Padding = "blur"
+	// PaddingEdge repeats the outermost row or column of pixels.
+	PaddingEdge Padding = "edge"
+	// PaddingMirror reflects the image at its edges.
+	PaddingMirror Padding = "mirror"
+)
+
+// Upscale decides what happens when the source is smaller than the requested
+// geometry. Cover and fill fits always scale to the exact box.
+type Upscale string
+
+const (
+	// UpscalePad keeps the source size and pads it to the requested geometry.
+	UpscalePad Upscale = "pad"
+	// UpscaleNone keeps the source size and returns it without padding.
+	UpscaleNone Upscale = "none"
+	// UpscaleAlways interpolates the source up to the requested geometry,
+	// at most by Options.UpscaleLimit when set, padding the remainder.
+	UpscaleAlways Upscale = "always"
 )
 
+var bimgGravity = map[Gravity]bimg.Gravity{
+	GravityCentre:    bimg.GravityCentre,
+	GravityNorth:     bimg.GravityNorth,
+	GravitySouth:     bimg.GravitySouth,
+	GravityEast:      bimg.GravityEast,
+	GravityWest:      bimg.GravityWest,
+	GravityAttention: bimg.GravitySmart,
+}
+
 // Options describe a resize request.
 type Options struct {
 	Width          int
 	Height         int
 	Format         Format
+	Fit            Fit
+	Gravity        Gravity
+	FocalX         float64 // fraction of width, used with GravityFocal
+	FocalY         float64 // fraction of height, used with GravityFocal
 	JPEGQuality    int
 	WebPQuality    int
 	AVIFQuality    int
 	AVIFSpeed      int
 	PNGCompression int
+	JXLQuality     int // zero keeps the libvips default
+	JXLEffort      int // 1 (fastest) to 9; zero keeps the libvips default
+	GIFQuality     int // palette size, 100 for 256 colours; zero keeps the libvips default
 	EnsureOpaque   bool
+	// Background colours letterbox padding and what opaque output is
+	// flattened onto. The zero value keeps the defaults: white for opaque
+	// output, transparent otherwise.
+	Background color.NRGBA
+	// Padding fills letterbox canvases; empty means PaddingSolid.
+	Padding Padding
+	// Upscale applies to contain and inside fits; empty means UpscalePad.
+	Upscale Upscale
+	// UpscaleLimit caps the enlargement factor of UpscaleAlways; zero
+	// means no cap.
+	UpscaleLimit float64
+	// Trim crops near-uniform borders before the image is fitted. Pixels
+	// within TrimThreshold of TrimBackground count as border; the zero
+	// TrimBackground takes the colour from the top-left pixel.
+	Trim           bool
+	TrimThreshold  float64
+	TrimBackground color.NRGBA
+	// Animated keeps every frame of animated sources for output formats
+	// that can animate (see Format.CanAnimate). Otherwise the first frame is
+	// rendered as a still image.
+	Animated bool
+	// Adjust holds per-request operations. Rotation and mirroring apply
+	// before the image is fitted, the others to the resized image.
+	Adjust Adjustments
+	// Watermark is composited onto the result after resizing.
+	Watermark Watermark
+	// MaxRasterWidth and MaxRasterHeight bound the size vector sources are
+	// rendered at; zero leaves a side unbounded.
+	MaxRasterWidth  int
+	MaxRasterHeight int
+}
+
+// Adjustments are per-request image operations; the zero value changes
+// nothing.
+type Adjustments struct {
+	Rotate     int  // clockwise degrees: 0, 90, 180 or 270
+	Flip       bool // mirror top to bottom
+	Flop       bool // mirror left to right
+	Grayscale  bool
+	Tint       color.NRGBA // replaces the colour, keeping the lightness
+	Brightness float64     // multiplier; zero means 1
+	Contrast   float64     // multiplier around mid-grey; zero means 1
+	Blur       float64     // gaussian sigma in output pixels
+	Sharpen    float64     // sharpening sigma
+}
+
+// reorients reports whether the source is rotated or mirrored.
+func (a Adjustments) reorients() bool {
+	return a.Rotate != 0 || a.Flip || a.Flop
+}
+
+// filters reports whether the resized image is changed.
+func (a Adjustments) filters() bool {
+	a.Rotate, a.Flip, a.Flop = 0, false, false
+	return a != Adjustments{}
+}
+
+// Watermark is an overlay composited onto the rendered variant.
+type Watermark struct {
+	// Image is the encoded overlay; nil disables the watermark.
+	Image []byte
+	// Asset identifies the overlay (e.g. its path, mtime and size). Callers
+	// set it up front and may load Image later.
+	Asset string
+	// MinSize skips results whose longer side is shorter.
+	MinSize int
+	// Scale sizes the overlay as a fraction of the result width; zero keeps
+	// its own size. It always shrinks to fit inside Margin.
+	Scale float64
+	// AnchorX and AnchorY place the overlay inside Margin: 0 is the
+	// left/top edge, 0.5 the centre and 1 the right/bottom edge.
+	AnchorX float64
+	AnchorY float64
+	Margin  int
+	// Opacity multiplies the overlay alpha, from 0 to 1.
+	Opacity float64
+}
+
+// Animates reports whether animated sources keep their frames with these
+// options. Adjusted variants are always still images; watermarks are
+// composited onto every frame.
+func (o Options) Animates() bool {
+	return o.Animated && o.Adjust == Adjustments{} && o.Format.CanAnimate()
+}
+
+// CanAnimate reports whether the format can be written as an animation: WebP,
+// GIF and, when libheif supports image sequences (1.20+), AVIF.
+func (f Format) CanAnimate() bool {
+	return f == FormatWEBP || f == FormatGIF || (f == FormatAVIF && avifSequences)
+}
+
+// background returns the canvas colour and whether the image is flattened
+// onto it. Opaque output (JPEG, or EnsureOpaque) always flattens and ignores
+// alpha; other formats flatten only onto a fully opaque colour and otherwise
+// keep their transparency with translucent padding.
+func (o Options) background() (color.NRGBA, bool) {
+	bg := o.Background
+	switch {
+	case o.EnsureOpaque || o.Format == FormatJPEG:
+		if bg == (color.NRGBA{}) {
+			bg = color.NRGBA{R: 255, G: 255, B: 255}
+		}
+		bg.A = 255
+		return bg, true
+	default:
+		return bg, bg.A == 255
+	}
+}
+
+// upscaleFactor returns the scale to apply when fitting needs scale; only
+// enlargements (scale > 1) are subject to the upscaling policy.
+func (o Options) upscaleFactor(scale float64) float64 {
+	if scale <= 1 {
+		return scale
+	}
+	if o.Upscale != UpscaleAlways {
+		return 1
+	}
+	if o.UpscaleLimit > 0 {
+		return math.Min(scale, o.UpscaleLimit)
+	}
+	return scale
+}
+
+// Fingerprint identifies the encoder settings a variant was rendered with,
+// so cached variants produced under different settings can be detected.
+// Geometry and per-request options are part of the cache path instead, so
+// only the settings listed here count; adding an Options field leaves
+// existing fingerprints (and the cache) intact.
+func (o Options) Fingerprint() string {
+	bg := o.TrimBackground
+	fields := fmt.Sprintf("jpeg=%d;webp=%d;avif=%d;avif-speed=%d;png=%d;jxl=%d;jxl-effort=%d;gif=%d;trim=%g;trim-bg=%02x%02x%02x%02x",
+		o.JPEGQuality, o.WebPQuality, o.AVIFQuality, o.AVIFSpeed, o.PNGCompression,
+		o.JXLQuality, o.JXLEffort, o.GIFQuality, o.TrimThreshold, bg.R, bg.G, bg.B, bg.A)
+	sum := sha256.Sum256([]byte(fields))
+	return hex.EncodeToString(sum[:8])
 }
 
 // Processor wraps libvips via bimg to transform images.
@@ -43,65 +259,166 @@ func New() *Processor {
 	return &Processor{}
 }
 
-// Resize applies the provided options to the source payload.
-func (p *Processor) Resize(source []byte, opts Options) ([]byte, error) {
+// Probe describes an original as read from its header, before anything is
+// decoded.
+type Probe struct {
+	Width  int
+	Height int
+	Frames int
+	// Vector marks SVGs, which are rendered at the size the request needs
+	// rather than at Width x Height.
+	Vector bool
+}
+
+// Pixels returns the pixel count decoding the original for opts produces:
+// SVGs count the size they are rendered at, and animations that keep their
+// frames count every frame.
+func (p Probe) Pixels(opts Options) int64 {
+	width, height := p.Width, p.Height
+	if p.Vector {
+		width, height = svgRasterSize(width, height, opts)
+	}
+	pixels := int64(width) * int64(height)
+	if opts.Animates() {
+		pixels *= int64(max(1, p.Frames))
+	}
+	return pixels
+}
+
+func imageSize(source []byte) (int, int, bool) {
+	size, err := bimg.Size(source)
+	if err != nil {
+		return sourceSize(source)
+	}
+	return size.Width, size.Height, true
+}
+
+// svgScale returns the scale rendering an SVG of nominal size width x
+// height at the density opts need: fitting the requested box (covering it
+// for cover and fill fits), where a zero side is left free. The scale is
+// clamped so that neither rendered side exceeds MaxRasterWidth x
+// MaxRasterHeight, which keeps extreme aspect ratios from exploding.
+func svgScale(width, height int, opts Options) float64 {
+	if width <= 0 || height <= 0 {
+		return 1
+	}
+	xscale := float64(opts.Width) / float64(width)
+	yscale := float64(opts.Height) / float64(height)
+	scale := 1.0
+	switch {
+	case opts.Width > 0 && opts.Height > 0 && (opts.Fit == FitCover || opts.Fit == FitFill):
+		scale = max(xscale, yscale)
+	case opts.Width > 0 && opts.Height > 0:
+		scale = min(xscale, yscale)
+	case opts.Width > 0:
+		scale = xscale
+	case opts.Height > 0:
+		scale = yscale
+	}
+	if opts.MaxRasterWidth > 0 {
+		scale = min(scale, float64(opts.MaxRasterWidth)/float64(width))
+	}
+	if opts.MaxRasterHeight > 0 {
+		scale = min(scale, float64(opts.MaxRasterHeight)/float64(height))
+	}
+	return scale
+}
+
+// svgRasterSize returns the size an SVG of nominal size width x height is
+// rendered at for opts.
+func svgRasterSize(width, height int, opts Options) (int, int) {
+	scale := svgScale(width, height, opts)
+	return max(1, int(math.Round(float64(width)*scale))), max(1, int(math.Round(float64(height)*scale)))
+}
+
+// prepareSource detects the source type from its content. SVGs are
+// rasterised at the density the geometry needs rather than at their nominal
+// size, and formats bimg does not recognise (such as JPEG XL) are decoded by
+// libvips into a lossless intermediate. JPEG sources are always rendered
+// opaque.
+func prepareSource(source []byte, opts *Options) ([]byte, error) {
+	switch bimg.DetermineImageType(source) {
+	case bimg.JPEG:
+		opts.EnsureOpaque = true
+	case bimg.SVG:
+		width, height, ok := imageSize(source)
+		if !ok {
+			return nil, fmt.Errorf("%w: unreadable svg", ErrUnsupportedSource)
+		}
+		rendered, err := rasteriseSVG(source, svgScale(width, height, *opts))
+		if err != nil {
+			return nil, fmt.Errorf("rasterise svg: %w", err)
+		}
+		return rendered, nil
+	case bimg.UNKNOWN:
+		return decodeSource(source)
+	}
+	return source, nil
+}
+
+// Resize applies the provided options to the source payload. ctx is checked
+// before decoding and between pipeline stages; a libvips call in progress
+// cannot be interrupted.
+func (p *Processor) Resize(ctx context.Context, source []byte, opts Options) ([]byte, error) {
 	if len(source) == 0 {
 		return nil, fmt.Errorf("source payload is empty")
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	animate := opts.Animates() && sourceFrames(source) > 1
+	if !animate && (opts.Watermark.Image != nil || opts.Adjust.filters()) {
+		return p.resizeStaged(ctx, source, opts)
+	}
+	if opts.Format == FormatJXL || (opts.Format == FormatGIF && !animate) {
+		return p.resizeReencoded(ctx, source, opts)
+	}
+	source, err := prepareSource(source, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Adjust.reorients() {
+		if source, err = reorient(source, opts.Adjust); err != nil {
+			return nil, fmt.Errorf("reorient source: %w", err)
+		}
+	}
+	if animate {
+		result, err := resizeAnimated(source, opts)
+		if err != nil {
+			return nil, fmt.Errorf("resize animation: %w", err)
+		}
+		return result, nil
+	}
+	if opts.Trim {
+		trimmed, err := trimBorders(source, opts.TrimBackground, opts.TrimThreshold)
+		if err != nil {
+			return nil, fmt.Errorf("trim borders: %w", err)
+		}
+		if err := checkpoint(ctx, "trim borders"); err != nil {
+			return nil, err
+		}
+		source = trimmed
+	}
 	img := bimg.NewImage(source)
 
 	size, err := img.Size()
 	if err != nil {
 		return nil, fmt.Errorf("inspect source size: %w", err)
 	}
+	// bimg applies the EXIF orientation before resizing, so every box below
+	// is computed from the displayed dimensions.
+	size = orientedSize(img, size)
 	switch {
 	case opts.Width > 0 && opts.Height > 0:
-		widthRatio := float64(opts.Width) / float64(size.Width)
-		heightRatio := float64(opts.Height) / float64(size.Height)
-		scale := math.Min(widthRatio, heightRatio)
-		if scale > 1 {
-			scale = 1
-		}
-		if scale < 1 {
-			contentWidth := int(math.Round(float64(size.Width) * scale))
-			if contentWidth < 1 {
-				contentWidth = 1
-			}
-			contentHeight := int(math.Round(float64(size.Height) * scale))
-			if contentHeight < 1 {
-				contentHeight = 1
-			}
-			limitByWidth := widthRatio <= heightRatio
-			stageWidth := 0
-			stageHeight := 0
-			if limitByWidth {
-				stageWidth = contentWidth
-			} else {
-				stageHeight = contentHeight
-			}
-			srcImg := img
-			if opts.EnsureOpaque || opts.Format == FormatJPEG {
-				flattened, flatErr := p.flattenToWhite(source)
-				if flatErr != nil {
-					return nil, fmt.Errorf("flatten source: %w", flatErr)
-				}
-				srcImg = bimg.NewImage(flattened)
-			}
-			stage, err := srcImg.Process(bimg.Options{
-				Type:          bimg.PNG,
-				StripMetadata: true,
-				NoAutoRotate:  false,
-				Width:         stageWidth,
-				Height:        stageHeight,
-				Embed:         false,
-				Force:         true,
-			})
-			if err != nil {
-				return nil, fmt.Errorf("shrink source: %w", err)
-			}
-			return p.renderCanvas(stage, opts)
+		switch opts.Fit {
+		case FitCover:
+			return p.resizeCover(ctx, img, size, opts)
+		case FitFill:
+			return p.resizeFill(img, opts)
+		case FitInside:
+			return p.resizeInside(img, size, opts)
 		}
-		return p.resizeWithCanvas(img, opts)
+		return p.resizeContain(ctx, img, size, opts)
 	case opts.Width > 0 && opts.Height == 0:
 		if opts.Width > size.Width {
 			canvas := opts
@@ -110,7 +427,7 @@ func (p *Processor) Resize(source []byte, opts Options) ([]byte, error) {
 			if canvas.Height < size.Height {
 				canvas.Height = size.Height
 			}
-			return p.resizeWithCanvas(img, canvas)
+			return p.resizeContain(ctx, img, size, canvas)
 		}
 	case opts.Height > 0 && opts.Width == 0:
 		if opts.Height > size.Height {
@@ -120,7 +437,7 @@ func (p *Processor) Resize(source []byte, opts Options) ([]byte, error) {
 			if canvas.Width < size.Width {
 				canvas.Width = size.Width
 			}
-			return p.resizeWithCanvas(img, canvas)
+			return p.resizeContain(ctx, img, size, canvas)
 		}
 	}
 	options, err := buildBaseOptions(opts)
@@ -141,42 +458,312 @@ func (p *Processor) Resize(source []byte, opts Options) ([]byte, error) {
 	return result, nil
 }
 
-func (p *Processor) resizeWithCanvas(img *bimg.Image, opts Options) ([]byte, error) {
-	stage, err := img.Process(bimg.Options{
+// resizeStaged renders the variant as a lossless PNG, applies the
+// adjustments and then the watermark, so neither is blurred or tinted by the
+// other, and only then encodes the requested format.
+func (p *Processor) resizeStaged(ctx context.Context, source []byte, opts Options) ([]byte, error) {
+	stage := opts
+	stage.Format = FormatPNG
+	stage.PNGCompression = 0
+	stage.EnsureOpaque = opts.EnsureOpaque || opts.Format == FormatJPEG
+	stage.Animated = false
+	stage.Adjust = Adjustments{Rotate: opts.Adjust.Rotate, Flip: opts.Adjust.Flip, Flop: opts.Adjust.Flop}
+	stage.Watermark = Watermark{}
+	rendered, err := p.Resize(ctx, source, stage)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Adjust.filters() {
+		if err := checkpoint(ctx, "render adjustment stage"); err != nil {
+			return nil, err
+		}
+		if rendered, err = adjustImage(rendered, opts.Adjust); err != nil {
+			return nil, fmt.Errorf("adjust image: %w", err)
+		}
+	}
+	if opts.Watermark.Image != nil {
+		size, err := bimg.Size(rendered)
+		if err != nil {
+			return nil, fmt.Errorf("inspect rendered size: %w", err)
+		}
+		if max(size.Width, size.Height) >= opts.Watermark.MinSize {
+			if err := checkpoint(ctx, "render watermark stage"); err != nil {
+				return nil, err
+			}
+			if rendered, err = composeWatermark(rendered, opts.Watermark); err != nil {
+				return nil, fmt.Errorf("compose watermark: %w", err)
+			}
+		}
+	}
+	return p.encodeStage(ctx, rendered, opts)
+}
+
+// encodeStage encodes a lossless intermediate in the requested format.
+func (p *Processor) encodeStage(ctx context.Context, rendered []byte, opts Options) ([]byte, error) {
+	if err := checkpoint(ctx, "finish stage"); err != nil {
+		return nil, err
+	}
+	if opts.Format == FormatJXL || opts.Format == FormatGIF {
+		return encodeReencoded(rendered, opts)
+	}
+	options, err := buildBaseOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	options.Embed = false
+	result, err := bimg.NewImage(rendered).Process(options)
+	if err != nil {
+		return nil, fmt.Errorf("encode image: %w", err)
+	}
+	return result, nil
+}
+
+// resizeReencoded renders the variant as a lossless PNG and re-encodes it as
+// JPEG XL, which bimg cannot write, or GIF, whose palette bimg cannot size.
+func (p *Processor) resizeReencoded(ctx context.Context, source []byte, opts Options) ([]byte, error) {
+	stage := opts
+	stage.Format = FormatPNG
+	stage.PNGCompression = 0
+	rendered, err := p.Resize(ctx, source, stage)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkpoint(ctx, "render "+string(opts.Format)+" stage"); err != nil {
+		return nil, err
+	}
+	return encodeReencoded(rendered, opts)
+}
+
+// encodeReencoded encodes a lossless intermediate as JPEG XL or GIF.
+func encodeReencoded(rendered []byte, opts Options) ([]byte, error) {
+	if opts.Format == FormatGIF {
+		result, err := encodeGIF(rendered, opts.GIFQuality)
+		if err != nil {
+			return nil, fmt.Errorf("encode gif: %w", err)
+		}
+		return result, nil
+	}
+	result, err := encodeJXL(rendered, opts.JXLQuality, opts.JXLEffort)
+	if err != nil {
+		return nil, fmt.Errorf("encode jxl: %w", err)
+	}
+	return result, nil
+}
+
+// resizeContain fits the image into the opts.Width x opts.Height box and
+// centres it on a canvas of that size. Sources smaller than the box are
+// padded, returned as they are or enlarged according to opts.Upscale.
+func (p *Processor) resizeContain(ctx context.Context, img *bimg.Image, size bimg.ImageSize, opts Options) ([]byte, error) {
+	widthRatio := float64(opts.Width) / float64(size.Width)
+	heightRatio := float64(opts.Height) / float64(size.Height)
+	fit := math.Min(widthRatio, heightRatio)
+	if fit > 1 && opts.Upscale == UpscaleNone {
+		return p.encodeOriginal(img, opts)
+	}
+	scale := opts.upscaleFactor(fit)
+	if scale == 1 {
+		return p.resizeWithCanvas(ctx, img, opts)
+	}
+	contentWidth := max(1, int(math.Round(float64(size.Width)*scale)))
+	contentHeight := max(1, int(math.Round(float64(size.Height)*scale)))
+	// Opaque output is flattened onto the background by libvips in the
+	// same pass as the scaling.
+	stageOptions := bimg.Options{
 		Type:          bimg.PNG,
+		Compression:   1,
 		StripMetadata: true,
 		NoAutoRotate:  false,
+		Width:         min(contentWidth, opts.Width),
+		Height:        min(contentHeight, opts.Height),
 		Embed:         false,
-		Force:         false,
-	})
+		Force:         true,
+	}
+	applyBackground(&stageOptions, opts)
+	stage, err := img.Process(stageOptions)
 	if err != nil {
-		return nil, fmt.Errorf("prepare source for canvas: %w", err)
+		return nil, fmt.Errorf("scale source: %w", err)
 	}
-	return p.renderCanvas(stage, opts)
+	return p.renderCanvas(ctx, stage, opts)
 }
 
-func (p *Processor) renderCanvas(stage []byte, opts Options) ([]byte, error) {
-	decoded, err := png.Decode(bytes.NewReader(stage))
+// encodeOriginal re-encodes the image at its own size.
+func (p *Processor) encodeOriginal(img *bimg.Image, opts Options) ([]byte, error) {
+	options, err := buildBaseOptions(opts)
 	if err != nil {
-		return nil, fmt.Errorf("decode intermediate image: %w", err)
+		return nil, err
 	}
+	options.Embed = false
+	applyBackground(&options, opts)
+	result, err := img.Process(options)
+	if err != nil {
+		return nil, fmt.Errorf("encode original: %w", err)
+	}
+	return result, nil
+}
 
-	canvas := image.NewNRGBA(image.Rect(0, 0, opts.Width, opts.Height))
-	if opts.Format == FormatJPEG {
-		draw.Draw(canvas, canvas.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+// resizeCover scales the image so it covers the whole box and crops the overflow
+// according to the requested gravity.
+func (p *Processor) resizeCover(ctx context.Context, img *bimg.Image, size bimg.ImageSize, opts Options) ([]byte, error) {
+	switch opts.Gravity {
+	case GravityFocal:
+		return p.resizeCoverFocal(img, size, opts, opts.FocalX, opts.FocalY)
+	case GravityEntropy:
+		stage, err := entropyCover(img.Image(), opts.Width, opts.Height)
+		if err != nil {
+			return nil, fmt.Errorf("crop to entropy: %w", err)
+		}
+		if err := checkpoint(ctx, "crop to entropy"); err != nil {
+			return nil, err
+		}
+		options, err := buildBaseOptions(opts)
+		if err != nil {
+			return nil, err
+		}
+		options.Width = 0
+		options.Height = 0
+		options.Embed = false
+		applyBackground(&options, opts)
+		result, err := bimg.NewImage(stage).Process(options)
+		if err != nil {
+			return nil, fmt.Errorf("encode entropy crop: %w", err)
+		}
+		return result, nil
+	}
+	gravity, ok := bimgGravity[opts.Gravity]
+	if !ok && opts.Gravity != "" {
+		return nil, fmt.Errorf("unsupported gravity %q", opts.Gravity)
+	}
+	options, err := buildBaseOptions(opts)
+	if err != nil {
+		return nil, err
 	}
+	options.Width = opts.Width
+	options.Height = opts.Height
+	options.Crop = true
+	options.Enlarge = true
+	options.Gravity = gravity
+	applyBackground(&options, opts)
+	result, err := img.Process(options)
+	if err != nil {
+		return nil, fmt.Errorf("cover image: %w", err)
+	}
+	return result, nil
+}
 
-	sourceBounds := decoded.Bounds()
-	contentWidth := sourceBounds.Dx()
-	contentHeight := sourceBounds.Dy()
-	left := int(math.Max(0, float64(opts.Width-contentWidth)/2))
-	top := int(math.Max(0, float64(opts.Height-contentHeight)/2))
-	position := image.Rect(left, top, left+contentWidth, top+contentHeight)
-	draw.Draw(canvas, position, decoded, sourceBounds.Min, draw.Over)
+// resizeCoverFocal scales the image to cover the box and extracts the window
+// centred as closely as possible on the focal point (fx, fy).
+func (p *Processor) resizeCoverFocal(img *bimg.Image, size bimg.ImageSize, opts Options, fx, fy float64) ([]byte, error) {
+	scale := math.Max(float64(opts.Width)/float64(size.Width), float64(opts.Height)/float64(size.Height))
+	scaledWidth := max(opts.Width, int(math.Round(float64(size.Width)*scale)))
+	scaledHeight := max(opts.Height, int(math.Round(float64(size.Height)*scale)))
 
-	var buf bytes.Buffer
-	if err := png.Encode(&buf, canvas); err != nil {
-		return nil, fmt.Errorf("encode canvas: %w", err)
+	options, err := buildBaseOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	options.Width = scaledWidth
+	options.Height = scaledHeight
+	options.Embed = false
+	options.Force = true
+	options.Left = focalOffset(fx, scaledWidth, opts.Width)
+	options.Top = focalOffset(fy, scaledHeight, opts.Height)
+	options.AreaWidth = opts.Width
+	options.AreaHeight = opts.Height
+	applyBackground(&options, opts)
+	result, err := img.Process(options)
+	if err != nil {
+		return nil, fmt.Errorf("crop around focal point: %w", err)
+	}
+	return result, nil
+}
+
+// focalOffset returns the window start that centres the focal fraction while
+// keeping the window inside the scaled image.
+func focalOffset(fraction float64, scaled, window int) int {
+	offset := int(math.Round(fraction*float64(scaled) - float64(window)/2))
+	return min(max(offset, 0), scaled-window)
+}
+
+// orientedSize swaps the stored dimensions when EXIF orientation rotates the image by 90°.
+func orientedSize(img *bimg.Image, size bimg.ImageSize) bimg.ImageSize {
+	meta, err := img.Metadata()
+	if err != nil {
+		return size
+	}
+	if meta.Orientation >= 5 && meta.Orientation <= 8 {
+		return bimg.ImageSize{Width: size.Height, Height: size.Width}
+	}
+	return size
+}
+
+// resizeFill stretches the image to the exact box.
+func (p *Processor) resizeFill(img *bimg.Image, opts Options) ([]byte, error) {
+	options, err := buildBaseOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	options.Width = opts.Width
+	options.Height = opts.Height
+	options.Embed = false
+	options.Force = true
+	applyBackground(&options, opts)
+	result, err := img.Process(options)
+	if err != nil {
+		return nil, fmt.Errorf("fill image: %w", err)
+	}
+	return result, nil
+}
+
+// resizeInside scales the image to fit the box without padding. Sources
+// smaller than the box are only enlarged with UpscaleAlways.
+func (p *Processor) resizeInside(img *bimg.Image, size bimg.ImageSize, opts Options) ([]byte, error) {
+	options, err := buildBaseOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	scale := opts.upscaleFactor(math.Min(float64(opts.Width)/float64(size.Width), float64(opts.Height)/float64(size.Height)))
+	if scale != 1 {
+		options.Width = max(1, int(math.Round(float64(size.Width)*scale)))
+		options.Height = max(1, int(math.Round(float64(size.Height)*scale)))
+		options.Embed = false
+		options.Force = true
+	}
+	applyBackground(&options, opts)
+	result, err := img.Process(options)
+	if err != nil {
+		return nil, fmt.Errorf("fit image inside: %w", err)
+	}
+	return result, nil
+}
+
+// applyBackground flattens results onto the background whenever the canvas
+// path would. bimg skips flattening onto pure black; JPEG output still ends
+// up on black because the encoder drops alpha against black.
+func applyBackground(options *bimg.Options, opts Options) {
+	if bg, flatten := opts.background(); flatten {
+		options.Background = bimg.Color{R: bg.R, G: bg.G, B: bg.B}
+	}
+}
+
+// resizeWithCanvas centres the unscaled source on the requested canvas.
+func (p *Processor) resizeWithCanvas(ctx context.Context, img *bimg.Image, opts Options) ([]byte, error) {
+	return p.renderCanvas(ctx, img.Image(), opts)
+}
+
+// renderCanvas centres stage on an opts.Width x opts.Height canvas filled
+// according to opts.Padding and encodes the result. The canvas is composed
+// by libvips (see embedCanvas).
+func (p *Processor) renderCanvas(ctx context.Context, stage []byte, opts Options) ([]byte, error) {
+	if err := checkpoint(ctx, "prepare canvas"); err != nil {
+		return nil, err
+	}
+	bg, flatten := opts.background()
+	canvas, err := embedCanvas(stage, opts.Width, opts.Height, bg, flatten, opts.Padding)
+	if err != nil {
+		return nil, fmt.Errorf("compose canvas: %w", err)
+	}
+	if err := checkpoint(ctx, "compose canvas"); err != nil {
+		return nil, err
 	}
 
 	finalOptions, err := buildBaseOptions(opts)
@@ -187,13 +774,21 @@ func (p *Processor) renderCanvas(stage []byte, opts Options) ([]byte, error) {
 	finalOptions.Height = 0
 	finalOptions.Embed = false
 
-	result, err := bimg.NewImage(buf.Bytes()).Process(finalOptions)
+	result, err := bimg.NewImage(canvas).Process(finalOptions)
 	if err != nil {
 		return nil, fmt.Errorf("render final image: %w", err)
 	}
 	return result, nil
 }
 
+// checkpoint stops a multi-stage pipeline once ctx is done.
+func checkpoint(ctx context.Context, stage string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", stage, err)
+	}
+	return nil
+}
+
 func buildBaseOptions(opts Options) (bimg.Options, error) {
 	options := bimg.Options{
 		StripMetadata: true,
@@ -202,8 +797,10 @@ func buildBaseOptions(opts Options) (bimg.Options, error) {
 		NoAutoRotate:  false,
 		Interlace:     true,
 	}
-	if opts.EnsureOpaque {
-		options.Background = bimg.Color{R: 255, G: 255, B: 255}
+	// Plain JPEG output leaves flattening to the encoder unless a colour
+	// was asked for.
+	if bg, flatten := opts.background(); flatten && (opts.EnsureOpaque || opts.Background != (color.NRGBA{})) {
+		options.Background = bimg.Color{R: bg.R, G: bg.G, B: bg.B}
 		options.Extend = bimg.ExtendBackground
 	}
 	switch opts.Format {
@@ -220,35 +817,10 @@ func buildBaseOptions(opts Options) (bimg.Options, error) {
 		options.Type = bimg.AVIF
 		options.Quality = opts.AVIFQuality
 		options.Speed = opts.AVIFSpeed
+	case FormatGIF:
+		options.Type = bimg.GIF
 	default:
 		return bimg.Options{}, fmt.Errorf("unsupported format %q", opts.Format)
 	}
 	return options, nil
 }
-
-// flattenToWhite composites the image onto a white background, removing transparency.
-func (p *Processor) flattenToWhite(source []byte) ([]byte, error) {
-	pngData, err := bimg.NewImage(source).Process(bimg.Options{
-		Type: bimg.PNG,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("convert to png: %w", err)
-	}
-
-	decoded, err := png.Decode(bytes.NewReader(pngData))
-	if err != nil {
-		return nil, fmt.Errorf("decode png: %w", err)
-	}
-
-	bounds := decoded.Bounds()
-	flat := image.NewNRGBA(bounds)
-
-	draw.Draw(flat, bounds, &image.Uniform{color.White}, image.Point{}, draw.Src)
-	draw.Draw(flat, bounds, decoded, bounds.Min, draw.Over)
-
-	var buf bytes.Buffer
-	if err := png.Encode(&buf, flat); err != nil {
-		return nil, fmt.Errorf("encode flattened: %w", err)
-	}
-	return buf.Bytes(), nil
-}
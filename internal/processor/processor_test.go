@@ -2,15 +2,19 @@ package processor
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"image"
 	"image/color"
 	"image/draw"
+	"image/gif"
+	"image/jpeg"
 	"image/png"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/h2non/bimg"
-
-	_ "image/jpeg"
 )
 
 func TestResizeCentersImageWithoutUpscaling(t *testing.T) {
@@ -23,7 +27,7 @@ func TestResizeCentersImageWithoutUpscaling(t *testing.T) {
 		t.Fatalf("encode source png: %v", err)
 	}
 	p := New()
-	result, err := p.Resize(buf.Bytes(), Options{
+	result, err := p.Resize(context.Background(), buf.Bytes(), Options{
 		Width:          canvasSize,
 		Height:         canvasSize,
 		Format:         FormatPNG,
@@ -70,7 +74,7 @@ func TestResizeUpscalesWithSingleDimension(t *testing.T) {
 
 	p := New()
 	targetWidth := 20
-	result, err := p.Resize(buf.Bytes(), Options{
+	result, err := p.Resize(context.Background(), buf.Bytes(), Options{
 		Width:          targetWidth,
 		Height:         0,
 		Format:         FormatJPEG,
@@ -139,7 +143,7 @@ func TestResizeDownscaleFitsWithinCanvas(t *testing.T) {
 	}
 	p := New()
 	target := 6
-	result, err := p.Resize(buf.Bytes(), Options{
+	result, err := p.Resize(context.Background(), buf.Bytes(), Options{
 		Width:          target,
 		Height:         target,
 		Format:         FormatPNG,
@@ -175,3 +179,949 @@ func TestResizeDownscaleFitsWithinCanvas(t *testing.T) {
 		t.Fatalf("expected transparent padding at top edge, got alpha=%d", top.A)
 	}
 }
+
+func TestResizeFitModes(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	fill := color.NRGBA{R: 30, G: 90, B: 200, A: 255}
+	draw.Draw(src, src.Bounds(), &image.Uniform{fill}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatalf("encode source png: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		fit        Fit
+		width      int
+		height     int
+		wantWidth  int
+		wantHeight int
+	}{
+		{name: "cover crops to box", fit: FitCover, width: 10, height: 10, wantWidth: 10, wantHeight: 10},
+		{name: "fill stretches to box", fit: FitFill, width: 10, height: 30, wantWidth: 10, wantHeight: 30},
+		{name: "inside shrinks to content", fit: FitInside, width: 10, height: 10, wantWidth: 10, wantHeight: 5},
+		{name: "inside keeps smaller source", fit: FitInside, width: 80, height: 80, wantWidth: 40, wantHeight: 20},
+	}
+
+	p := New()
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := p.Resize(context.Background(), buf.Bytes(), Options{
+				Width:          tc.width,
+				Height:         tc.height,
+				Fit:            tc.fit,
+				Format:         FormatPNG,
+				PNGCompression: 6,
+			})
+			if err != nil {
+				t.Fatalf("Resize returned error: %v", err)
+			}
+			decoded, err := png.Decode(bytes.NewReader(result))
+			if err != nil {
+				t.Fatalf("decode result png: %v", err)
+			}
+			bounds := decoded.Bounds()
+			if bounds.Dx() != tc.wantWidth || bounds.Dy() != tc.wantHeight {
+				t.Fatalf("got %dx%d, want %dx%d", bounds.Dx(), bounds.Dy(), tc.wantWidth, tc.wantHeight)
+			}
+			corner := color.NRGBAModel.Convert(decoded.At(0, 0)).(color.NRGBA)
+			if corner.A != 255 {
+				t.Fatalf("expected no padding for %s, got alpha=%d at corner", tc.fit, corner.A)
+			}
+		})
+	}
+}
+
+func TestResizeRespectsEXIFOrientation(t *testing.T) {
+	// A 40x20 JPEG tagged with orientation 6 displays as 20x40.
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(src, src.Bounds(), &image.Uniform{color.NRGBA{R: 30, G: 90, B: 200, A: 255}}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, src, nil); err != nil {
+		t.Fatalf("encode source jpeg: %v", err)
+	}
+	source := withOrientation(buf.Bytes(), 6)
+
+	tests := []struct {
+		name       string
+		fit        Fit
+		width      int
+		height     int
+		upscale    Upscale
+		wantWidth  int
+		wantHeight int
+		padded     bool // portrait content letterboxed left and right
+	}{
+		{name: "inside", fit: FitInside, width: 10, height: 10, wantWidth: 5, wantHeight: 10},
+		{name: "contain", fit: FitContain, width: 10, height: 10, wantWidth: 10, wantHeight: 10, padded: true},
+		{name: "contain enlarged", fit: FitContain, width: 80, height: 80, upscale: UpscaleAlways, wantWidth: 80, wantHeight: 80, padded: true},
+		{name: "free height", width: 10, wantWidth: 10, wantHeight: 20},
+	}
+
+	p := New()
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := p.Resize(context.Background(), source, Options{
+				Width:   tc.width,
+				Height:  tc.height,
+				Fit:     tc.fit,
+				Upscale: tc.upscale,
+				Format:  FormatPNG,
+			})
+			if err != nil {
+				t.Fatalf("Resize returned error: %v", err)
+			}
+			decoded, err := png.Decode(bytes.NewReader(result))
+			if err != nil {
+				t.Fatalf("decode result png: %v", err)
+			}
+			if bounds := decoded.Bounds(); bounds.Dx() != tc.wantWidth || bounds.Dy() != tc.wantHeight {
+				t.Fatalf("got %dx%d, want %dx%d", bounds.Dx(), bounds.Dy(), tc.wantWidth, tc.wantHeight)
+			}
+			if tc.padded {
+				// White padding on the sides, blue content touching the top.
+				edge := color.NRGBAModel.Convert(decoded.At(0, tc.wantHeight/2)).(color.NRGBA)
+				top := color.NRGBAModel.Convert(decoded.At(tc.wantWidth/2, 0)).(color.NRGBA)
+				if edge.R < 200 || top.R > 100 {
+					t.Fatalf("expected portrait content, got edge %+v and top %+v", edge, top)
+				}
+			}
+		})
+	}
+}
+
+// withOrientation inserts an EXIF segment carrying the orientation tag right
+// after the JPEG SOI marker.
+func withOrientation(jpegData []byte, orientation uint16) []byte {
+	tiff := []byte{
+		'I', 'I', 0x2a, 0, 8, 0, 0, 0, // little-endian header, IFD at offset 8
+		1, 0, // one entry
+		0x12, 0x01, 3, 0, 1, 0, 0, 0, byte(orientation), byte(orientation >> 8), 0, 0, // orientation, SHORT
+		0, 0, 0, 0, // no next IFD
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xff, 0xe1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	out := append([]byte{}, jpegData[:2]...)
+	out = append(out, segment...)
+	out = append(out, payload...)
+	return append(out, jpegData[2:]...)
+}
+
+func TestResizePaddingModes(t *testing.T) {
+	tone := color.NRGBA{R: 40, G: 160, B: 90, A: 255}
+	src := image.NewNRGBA(image.Rect(0, 0, 10, 20))
+	draw.Draw(src, src.Bounds(), &image.Uniform{tone}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatalf("encode source png: %v", err)
+	}
+	tests := []struct {
+		padding Padding
+		opaque  bool // whether the padding repeats the image
+	}{
+		{padding: PaddingSolid},
+		{padding: PaddingBlur, opaque: true},
+		{padding: PaddingEdge, opaque: true},
+		{padding: PaddingMirror, opaque: true},
+	}
+	p := New()
+	for _, tc := range tests {
+		t.Run(string(tc.padding), func(t *testing.T) {
+			result, err := p.Resize(context.Background(), buf.Bytes(), Options{
+				Width:          40,
+				Height:         20,
+				Format:         FormatPNG,
+				PNGCompression: 6,
+				Padding:        tc.padding,
+			})
+			if err != nil {
+				t.Fatalf("Resize returned error: %v", err)
+			}
+			decoded, err := png.Decode(bytes.NewReader(result))
+			if err != nil {
+				t.Fatalf("decode result png: %v", err)
+			}
+			if bounds := decoded.Bounds(); bounds.Dx() != 40 || bounds.Dy() != 20 {
+				t.Fatalf("got %dx%d, want 40x20", bounds.Dx(), bounds.Dy())
+			}
+			corner := color.NRGBAModel.Convert(decoded.At(0, 0)).(color.NRGBA)
+			if !tc.opaque {
+				if corner.A != 0 {
+					t.Fatalf("expected transparent padding, got %+v", corner)
+				}
+				return
+			}
+			if corner.A != 255 || diff(corner.R, tone.R) > 10 || diff(corner.G, tone.G) > 10 || diff(corner.B, tone.B) > 10 {
+				t.Fatalf("expected padding in the source tone, got %+v", corner)
+			}
+		})
+	}
+	if _, err := p.Resize(context.Background(), buf.Bytes(), Options{Width: 40, Height: 20, Format: FormatPNG, Padding: "stripes"}); err == nil {
+		t.Fatal("expected error for unknown padding")
+	}
+}
+
+func TestResizeUpscalePolicies(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 10, 6))
+	draw.Draw(src, src.Bounds(), &image.Uniform{color.NRGBA{R: 30, G: 90, B: 200, A: 255}}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatalf("encode source png: %v", err)
+	}
+	type geometry struct {
+		width, height int
+		fit           Fit
+	}
+	policies := []struct {
+		name    string
+		upscale Upscale
+		limit   float64
+	}{
+		{name: "pad", upscale: UpscalePad},
+		{name: "none", upscale: UpscaleNone},
+		{name: "always", upscale: UpscaleAlways},
+		{name: "max-2x", upscale: UpscaleAlways, limit: 2},
+	}
+	tests := []struct {
+		name     string
+		geometry geometry
+		// per policy: output size and the opaque content size within it
+		want map[string][4]int
+	}{
+		{
+			name:     "contain",
+			geometry: geometry{width: 40, height: 40, fit: FitContain},
+			want: map[string][4]int{
+				"pad":    {40, 40, 10, 6},
+				"none":   {10, 6, 10, 6},
+				"always": {40, 40, 40, 24},
+				"max-2x": {40, 40, 20, 12},
+			},
+		},
+		{
+			name:     "width only",
+			geometry: geometry{width: 40},
+			want: map[string][4]int{
+				"pad":    {40, 24, 10, 6},
+				"none":   {10, 6, 10, 6},
+				"always": {40, 24, 40, 24},
+				"max-2x": {40, 24, 20, 12},
+			},
+		},
+		{
+			name:     "height only",
+			geometry: geometry{height: 24},
+			want: map[string][4]int{
+				"pad":    {40, 24, 10, 6},
+				"none":   {10, 6, 10, 6},
+				"always": {40, 24, 40, 24},
+				"max-2x": {40, 24, 20, 12},
+			},
+		},
+		{
+			name:     "inside",
+			geometry: geometry{width: 40, height: 40, fit: FitInside},
+			want: map[string][4]int{
+				"pad":    {10, 6, 10, 6},
+				"none":   {10, 6, 10, 6},
+				"always": {40, 24, 40, 24},
+				"max-2x": {20, 12, 20, 12},
+			},
+		},
+		{
+			name:     "cover",
+			geometry: geometry{width: 40, height: 40, fit: FitCover},
+			want: map[string][4]int{
+				"pad":    {40, 40, 40, 40},
+				"none":   {40, 40, 40, 40},
+				"always": {40, 40, 40, 40},
+				"max-2x": {40, 40, 40, 40},
+			},
+		},
+		{
+			name:     "contain shrink",
+			geometry: geometry{width: 5, height: 5, fit: FitContain},
+			want: map[string][4]int{
+				"pad":    {5, 5, 5, 3},
+				"none":   {5, 5, 5, 3},
+				"always": {5, 5, 5, 3},
+				"max-2x": {5, 5, 5, 3},
+			},
+		},
+	}
+	p := New()
+	for _, tc := range tests {
+		for _, policy := range policies {
+			t.Run(tc.name+"/"+policy.name, func(t *testing.T) {
+				result, err := p.Resize(context.Background(), buf.Bytes(), Options{
+					Width:          tc.geometry.width,
+					Height:         tc.geometry.height,
+					Fit:            tc.geometry.fit,
+					Format:         FormatPNG,
+					PNGCompression: 6,
+					Upscale:        policy.upscale,
+					UpscaleLimit:   policy.limit,
+				})
+				if err != nil {
+					t.Fatalf("Resize returned error: %v", err)
+				}
+				decoded, err := png.Decode(bytes.NewReader(result))
+				if err != nil {
+					t.Fatalf("decode result png: %v", err)
+				}
+				want := tc.want[policy.name]
+				bounds := decoded.Bounds()
+				if bounds.Dx() != want[0] || bounds.Dy() != want[1] {
+					t.Fatalf("got %dx%d, want %dx%d", bounds.Dx(), bounds.Dy(), want[0], want[1])
+				}
+				var contentWidth, contentHeight int
+				for x := 0; x < bounds.Dx(); x++ {
+					if color.NRGBAModel.Convert(decoded.At(x, bounds.Dy()/2)).(color.NRGBA).A > 127 {
+						contentWidth++
+					}
+				}
+				for y := 0; y < bounds.Dy(); y++ {
+					if color.NRGBAModel.Convert(decoded.At(bounds.Dx()/2, y)).(color.NRGBA).A > 127 {
+						contentHeight++
+					}
+				}
+				if contentWidth != want[2] || contentHeight != want[3] {
+					t.Fatalf("got content %dx%d, want %dx%d", contentWidth, contentHeight, want[2], want[3])
+				}
+			})
+		}
+	}
+}
+
+func TestResizeTrimsBorders(t *testing.T) {
+	red := color.NRGBA{R: 220, G: 20, B: 20, A: 255}
+	tests := []struct {
+		name   string
+		border color.NRGBA
+		opts   Options
+	}{
+		{name: "white margin", border: color.NRGBA{R: 255, G: 255, B: 255, A: 255}, opts: Options{TrimThreshold: 10}},
+		{name: "near-white margin", border: color.NRGBA{R: 250, G: 252, B: 255, A: 255}, opts: Options{TrimThreshold: 10, TrimBackground: color.NRGBA{R: 255, G: 255, B: 255, A: 255}}},
+		{name: "transparent margin", border: color.NRGBA{}, opts: Options{TrimThreshold: 10}},
+	}
+	p := New()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			src := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+			draw.Draw(src, src.Bounds(), &image.Uniform{tc.border}, image.Point{}, draw.Src)
+			draw.Draw(src, image.Rect(4, 6, 14, 16), &image.Uniform{red}, image.Point{}, draw.Src)
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, src); err != nil {
+				t.Fatalf("encode source png: %v", err)
+			}
+			opts := tc.opts
+			opts.Width, opts.Height, opts.Format, opts.Trim = 10, 10, FormatPNG, true
+			result, err := p.Resize(context.Background(), buf.Bytes(), opts)
+			if err != nil {
+				t.Fatalf("Resize returned error: %v", err)
+			}
+			decoded, err := png.Decode(bytes.NewReader(result))
+			if err != nil {
+				t.Fatalf("decode result png: %v", err)
+			}
+			if bounds := decoded.Bounds(); bounds.Dx() != 10 || bounds.Dy() != 10 {
+				t.Fatalf("got %dx%d, want 10x10", bounds.Dx(), bounds.Dy())
+			}
+			for _, pt := range []image.Point{{0, 0}, {9, 9}, {5, 5}} {
+				got := color.NRGBAModel.Convert(decoded.At(pt.X, pt.Y)).(color.NRGBA)
+				if got.A != 255 || diff(got.R, red.R) > 10 || diff(got.G, red.G) > 10 {
+					t.Fatalf("expected the trimmed content at %v, got %+v", pt, got)
+				}
+			}
+		})
+	}
+}
+
+func TestResizeAnimatedSources(t *testing.T) {
+	palette := color.Palette{color.NRGBA{A: 0}, color.NRGBA{R: 255, A: 255}, color.NRGBA{G: 255, A: 255}, color.NRGBA{B: 255, A: 255}}
+	anim := &gif.GIF{LoopCount: 0}
+	for i := 1; i <= 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 20, 10), palette)
+		draw.Draw(frame, frame.Bounds(), &image.Uniform{palette[i]}, image.Point{}, draw.Src)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatalf("encode source gif: %v", err)
+	}
+	if frames := sourceFrames(buf.Bytes()); frames != 3 {
+		t.Fatalf("sourceFrames = %d, want 3", frames)
+	}
+
+	tests := []struct {
+		name     string
+		format   Format
+		animated bool
+		frames   int
+	}{
+		{name: "webp", format: FormatWEBP, animated: true, frames: 3},
+		{name: "gif", format: FormatGIF, animated: true, frames: 3},
+		{name: "poster", format: FormatWEBP, frames: 1},
+		{name: "still format", format: FormatPNG, animated: true, frames: 1},
+	}
+	p := New()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := p.Resize(context.Background(), buf.Bytes(), Options{
+				Width:       10,
+				Height:      10,
+				Format:      tc.format,
+				WebPQuality: 75,
+				Animated:    tc.animated,
+			})
+			if err != nil {
+				t.Fatalf("Resize returned error: %v", err)
+			}
+			if frames := sourceFrames(result); frames != tc.frames {
+				t.Fatalf("got %d frames, want %d", frames, tc.frames)
+			}
+			size, err := bimg.Size(result)
+			if err != nil {
+				t.Fatalf("inspect result size: %v", err)
+			}
+			if size.Width != 10 {
+				t.Fatalf("got width %d, want 10", size.Width)
+			}
+		})
+	}
+
+	t.Run("avif", func(t *testing.T) {
+		if !FormatAVIF.CanAnimate() {
+			t.Skip("libheif cannot write AVIF sequences")
+		}
+		result, err := p.Resize(context.Background(), buf.Bytes(), Options{
+			Width:       10,
+			Height:      10,
+			Format:      FormatAVIF,
+			AVIFQuality: 60,
+			Animated:    true,
+		})
+		if err != nil {
+			t.Fatalf("Resize returned error: %v", err)
+		}
+		// Image sequences carry the "avis" brand in their ftyp box; a still
+		// AVIF only lists "avif".
+		if !bytes.Contains(result[:min(len(result), 64)], []byte("avis")) {
+			t.Fatalf("expected an AVIF image sequence, got header %q", result[:min(len(result), 64)])
+		}
+	})
+}
+
+func TestResizeGIFQuality(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			src.Set(x, y, color.NRGBA{R: uint8(x * 4), G: uint8(y * 4), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatalf("encode source png: %v", err)
+	}
+
+	p := New()
+	for _, tc := range []struct {
+		quality   int
+		maxColors int
+	}{
+		{quality: 100, maxColors: 256},
+		{quality: 25, maxColors: 4},
+	} {
+		result, err := p.Resize(context.Background(), buf.Bytes(), Options{Width: 32, Format: FormatGIF, GIFQuality: tc.quality})
+		if err != nil {
+			t.Fatalf("Resize(quality %d) returned error: %v", tc.quality, err)
+		}
+		decoded, err := gif.Decode(bytes.NewReader(result))
+		if err != nil {
+			t.Fatalf("decode result gif: %v", err)
+		}
+		paletted, ok := decoded.(*image.Paletted)
+		if !ok {
+			t.Fatalf("expected a paletted image, got %T", decoded)
+		}
+		if colors := len(paletted.Palette); colors > tc.maxColors {
+			t.Fatalf("quality %d: got %d palette colours, want at most %d", tc.quality, colors, tc.maxColors)
+		}
+		if width := paletted.Bounds().Dx(); width != 32 {
+			t.Fatalf("got width %d, want 32", width)
+		}
+	}
+}
+
+func TestResizeSourceFormats(t *testing.T) {
+	// A 10x10 SVG rendered at 100x100 must be rasterised at that density:
+	// the edge between the halves stays a hard transition instead of an upscaled blur.
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><rect width="10" height="10" fill="#fff"/><rect width="5" height="10" fill="#000"/></svg>`)
+	p := New()
+	result, err := p.Resize(context.Background(), svg, Options{Width: 100, Height: 100, Format: FormatPNG, Upscale: UpscaleAlways})
+	if err != nil {
+		t.Fatalf("Resize returned error: %v", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(result))
+	if err != nil {
+		t.Fatalf("decode result png: %v", err)
+	}
+	if bounds := decoded.Bounds(); bounds.Dx() != 100 || bounds.Dy() != 100 {
+		t.Fatalf("got %dx%d, want 100x100", bounds.Dx(), bounds.Dy())
+	}
+	for _, x := range []int{47, 52} {
+		got := color.NRGBAModel.Convert(decoded.At(x, 50)).(color.NRGBA)
+		if got.R > 10 && got.R < 245 {
+			t.Fatalf("pixel %d is %+v, want a sharp edge", x, got)
+		}
+	}
+
+	if _, err := p.Resize(context.Background(), []byte("not an image"), Options{Width: 10, Height: 10, Format: FormatPNG}); !errors.Is(err, ErrUnsupportedSource) {
+		t.Fatalf("expected ErrUnsupportedSource, got %v", err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	base := Options{Width: 100, Format: FormatWEBP, JPEGQuality: 80, WebPQuality: 75, AVIFQuality: 60, AVIFSpeed: 5, PNGCompression: 6, JXLQuality: 75, JXLEffort: 7, GIFQuality: 100}
+	// Geometry and per-request options live in the cache path.
+	same := base
+	same.Width, same.Fit, same.Trim, same.Animated = 300, FitCover, true, true
+	same.Adjust = Adjustments{Grayscale: true}
+	same.Watermark = Watermark{Image: []byte("logo"), Asset: "logo"}
+	if base.Fingerprint() != same.Fingerprint() {
+		t.Fatalf("expected geometry, operations and overlay bytes not to change the fingerprint")
+	}
+	for name, edit := range map[string]func(*Options){
+		"jpeg quality":    func(o *Options) { o.JPEGQuality = 81 },
+		"webp quality":    func(o *Options) { o.WebPQuality = 76 },
+		"avif quality":    func(o *Options) { o.AVIFQuality = 61 },
+		"avif speed":      func(o *Options) { o.AVIFSpeed = 6 },
+		"png compression": func(o *Options) { o.PNGCompression = 7 },
+		"jxl quality":     func(o *Options) { o.JXLQuality = 76 },
+		"jxl effort":      func(o *Options) { o.JXLEffort = 8 },
+		"gif quality":     func(o *Options) { o.GIFQuality = 50 },
+		"trim threshold":  func(o *Options) { o.TrimThreshold = 12 },
+		"trim background": func(o *Options) { o.TrimBackground = color.NRGBA{R: 255, A: 255} },
+	} {
+		changed := base
+		edit(&changed)
+		if changed.Fingerprint() == base.Fingerprint() {
+			t.Errorf("expected %s to change the fingerprint", name)
+		}
+	}
+}
+
+func TestSVGRasterSize(t *testing.T) {
+	cases := []struct {
+		name          string
+		width, height int
+		opts          Options
+		want          [2]int
+	}{
+		{"fits the box", 10, 20, Options{Width: 100, Height: 100}, [2]int{50, 100}},
+		{"covers the box", 10, 20, Options{Width: 100, Height: 100, Fit: FitCover}, [2]int{100, 200}},
+		{"free height", 10, 20, Options{Width: 100}, [2]int{100, 200}},
+		{"nominal size", 10, 20, Options{}, [2]int{10, 20}},
+		{"extreme aspect, free height", 1, 10000, Options{Width: 2000, MaxRasterWidth: 2000, MaxRasterHeight: 2000}, [2]int{1, 2000}},
+		{"extreme aspect, cover", 1, 10000, Options{Width: 2000, Height: 2000, Fit: FitCover, MaxRasterWidth: 2000, MaxRasterHeight: 2000}, [2]int{1, 2000}},
+		{"huge nominal size", 50000, 50000, Options{MaxRasterWidth: 2000, MaxRasterHeight: 2000}, [2]int{2000, 2000}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			width, height := svgRasterSize(tc.width, tc.height, tc.opts)
+			if got := [2]int{width, height}; got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProbePixels(t *testing.T) {
+	animation := Probe{Width: 100, Height: 50, Frames: 10}
+	cases := []struct {
+		name string
+		opts Options
+		want int64
+	}{
+		{"animated output counts every frame", Options{Format: FormatWEBP, Animated: true}, 50_000},
+		{"still output decodes one frame", Options{Format: FormatJPEG, Animated: true}, 5_000},
+		{"poster decodes one frame", Options{Format: FormatWEBP}, 5_000},
+		{"watermarked animation counts every frame", Options{Format: FormatWEBP, Animated: true, Watermark: Watermark{Asset: "logo"}}, 50_000},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := animation.Pixels(tc.opts); got != tc.want {
+				t.Fatalf("got %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProbeExtremeSVG(t *testing.T) {
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="1" height="10000"><rect width="1" height="10000" fill="#000"/></svg>`)
+	path := filepath.Join(t.TempDir(), "line.svg")
+	if err := os.WriteFile(path, svg, 0o644); err != nil {
+		t.Fatalf("write svg: %v", err)
+	}
+	probe, err := ProbeFile(path)
+	if err != nil || probe != (Probe{Width: 1, Height: 10000, Frames: 1, Vector: true}) {
+		t.Fatalf("unexpected probe %+v, %v", probe, err)
+	}
+	if fromBytes, err := ProbeSource(svg); err != nil || fromBytes != probe {
+		t.Fatalf("ProbeSource = %+v, %v; want %+v", fromBytes, err, probe)
+	}
+	opts := Options{Width: 2000, Height: 2000, Fit: FitCover, Format: FormatPNG, MaxRasterWidth: 2000, MaxRasterHeight: 2000}
+	if pixels := probe.Pixels(opts); pixels != 2000 {
+		t.Fatalf("got %d pixels, want 2000", pixels)
+	}
+	if _, err := New().Resize(context.Background(), svg, opts); err != nil {
+		t.Fatalf("Resize returned error: %v", err)
+	}
+}
+
+func TestResizeEncodesJXL(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(src, src.Bounds(), &image.Uniform{color.NRGBA{R: 200, G: 40, B: 40, A: 255}}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatalf("encode source png: %v", err)
+	}
+	result, err := New().Resize(context.Background(), buf.Bytes(), Options{Width: 20, Height: 20, Format: FormatJXL, JXLQuality: 75, JXLEffort: 3})
+	if err != nil {
+		t.Fatalf("Resize returned error: %v", err)
+	}
+	// Bare codestream or ISOBMFF container signature.
+	if !bytes.HasPrefix(result, []byte{0xff, 0x0a}) && !bytes.HasPrefix(result, []byte("\x00\x00\x00\x0cJXL ")) {
+		t.Fatalf("result is not JPEG XL: % x", result[:min(len(result), 12)])
+	}
+	if width, height, ok := sourceSize(result); !ok || width != 20 || height != 20 {
+		t.Fatalf("got %dx%d (ok=%v), want 20x20", width, height, ok)
+	}
+}
+
+func TestResizeWatermarks(t *testing.T) {
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	encode := func(img image.Image) []byte {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatalf("encode png: %v", err)
+		}
+		return buf.Bytes()
+	}
+	src := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(src, src.Bounds(), &image.Uniform{white}, image.Point{}, draw.Src)
+	logo := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+	draw.Draw(logo, logo.Bounds(), &image.Uniform{color.NRGBA{R: 255, A: 255}}, image.Point{}, draw.Src)
+	mark := Watermark{Image: encode(logo), Asset: "logo", MinSize: 50, Scale: 0.4, AnchorX: 1, AnchorY: 1, Margin: 5, Opacity: 1}
+
+	tests := []struct {
+		name   string
+		size   int
+		marked bool
+	}{
+		{name: "large", size: 100, marked: true},
+		{name: "below min size", size: 40},
+	}
+	p := New()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := p.Resize(context.Background(), encode(src), Options{Width: tc.size, Height: tc.size, Format: FormatPNG, Watermark: mark})
+			if err != nil {
+				t.Fatalf("Resize returned error: %v", err)
+			}
+			decoded, err := png.Decode(bytes.NewReader(result))
+			if err != nil {
+				t.Fatalf("decode result png: %v", err)
+			}
+			if bounds := decoded.Bounds(); bounds.Dx() != tc.size || bounds.Dy() != tc.size {
+				t.Fatalf("got %dx%d, want %dx%d", bounds.Dx(), bounds.Dy(), tc.size, tc.size)
+			}
+			// The 40x20 overlay sits 5px from the bottom-right corner.
+			corner := color.NRGBAModel.Convert(decoded.At(tc.size-10, tc.size-10)).(color.NRGBA)
+			if marked := corner.G < 50; marked != tc.marked {
+				t.Fatalf("corner pixel %+v, want watermark %v", corner, tc.marked)
+			}
+			if margin := color.NRGBAModel.Convert(decoded.At(tc.size-2, tc.size-2)).(color.NRGBA); margin.G < 200 {
+				t.Fatalf("expected the margin to stay clear, got %+v", margin)
+			}
+		})
+	}
+}
+
+func TestResizeWatermarksAnimations(t *testing.T) {
+	palette := color.Palette{color.NRGBA{R: 255, G: 255, B: 255, A: 255}, color.NRGBA{B: 255, A: 255}}
+	anim := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 100, 100), palette)
+		// A blue bar moves down the white frames.
+		draw.Draw(frame, image.Rect(0, i*10, 100, i*10+10), &image.Uniform{palette[1]}, image.Point{}, draw.Src)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatalf("encode source gif: %v", err)
+	}
+	logo := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+	draw.Draw(logo, logo.Bounds(), &image.Uniform{color.NRGBA{R: 255, A: 255}}, image.Point{}, draw.Src)
+	var logoPNG bytes.Buffer
+	if err := png.Encode(&logoPNG, logo); err != nil {
+		t.Fatalf("encode logo: %v", err)
+	}
+	mark := Watermark{Image: logoPNG.Bytes(), Asset: "logo", Scale: 0.4, AnchorX: 1, AnchorY: 1, Margin: 5, Opacity: 1}
+
+	result, err := New().Resize(context.Background(), buf.Bytes(), Options{Width: 100, Height: 100, Format: FormatGIF, Animated: true, Watermark: mark})
+	if err != nil {
+		t.Fatalf("Resize returned error: %v", err)
+	}
+	decoded, err := gif.DecodeAll(bytes.NewReader(result))
+	if err != nil {
+		t.Fatalf("decode result gif: %v", err)
+	}
+	if len(decoded.Image) != 3 {
+		t.Fatalf("got %d frames, want 3", len(decoded.Image))
+	}
+	// Later frames may only carry the pixels that changed, so each frame is
+	// drawn over the previous ones before the overlay is checked.
+	canvas := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	for i, frame := range decoded.Image {
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		if corner := canvas.NRGBAAt(90, 90); corner.R < 200 || corner.G > 50 {
+			t.Fatalf("frame %d: corner pixel %+v, want the red overlay", i, corner)
+		}
+	}
+}
+
+func TestResizeAdjustments(t *testing.T) {
+	// A 40x20 source: red on the left half, blue on the right.
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(src, image.Rect(0, 0, 20, 20), &image.Uniform{color.NRGBA{R: 255, A: 255}}, image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(20, 0, 40, 20), &image.Uniform{color.NRGBA{B: 255, A: 255}}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatalf("encode source png: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		adjust Adjustments
+		width  int
+		height int
+		check  func(img image.Image) bool
+	}{
+		{
+			name:   "rotate before fitting",
+			adjust: Adjustments{Rotate: 90},
+			width:  20,
+			height: 40,
+			// Clockwise: the red half ends up on top.
+			check: func(img image.Image) bool { return isRed(img.At(10, 5)) && isBlue(img.At(10, 35)) },
+		},
+		{
+			name:   "flop",
+			adjust: Adjustments{Flop: true},
+			width:  40,
+			height: 20,
+			check:  func(img image.Image) bool { return isBlue(img.At(5, 10)) && isRed(img.At(35, 10)) },
+		},
+		{
+			name:   "grayscale",
+			adjust: Adjustments{Grayscale: true},
+			width:  40,
+			height: 20,
+			check: func(img image.Image) bool {
+				c := color.NRGBAModel.Convert(img.At(5, 10)).(color.NRGBA)
+				return diff(c.R, c.G) < 3 && diff(c.G, c.B) < 3
+			},
+		},
+		{
+			name:   "blur",
+			adjust: Adjustments{Blur: 4},
+			width:  40,
+			height: 20,
+			check: func(img image.Image) bool {
+				c := color.NRGBAModel.Convert(img.At(20, 10)).(color.NRGBA)
+				return c.R > 40 && c.B > 40
+			},
+		},
+	}
+	p := New()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := p.Resize(context.Background(), buf.Bytes(), Options{Width: tc.width, Format: FormatPNG, Adjust: tc.adjust})
+			if err != nil {
+				t.Fatalf("Resize returned error: %v", err)
+			}
+			decoded, err := png.Decode(bytes.NewReader(result))
+			if err != nil {
+				t.Fatalf("decode result png: %v", err)
+			}
+			if bounds := decoded.Bounds(); bounds.Dx() != tc.width || bounds.Dy() != tc.height {
+				t.Fatalf("got %dx%d, want %dx%d", bounds.Dx(), bounds.Dy(), tc.width, tc.height)
+			}
+			if !tc.check(decoded) {
+				t.Fatalf("unexpected pixels for %+v", tc.adjust)
+			}
+		})
+	}
+}
+
+func isRed(c color.Color) bool {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return n.R > 200 && n.B < 50
+}
+
+func isBlue(c color.Color) bool {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return n.B > 200 && n.R < 50
+}
+
+func TestFocalOffset(t *testing.T) {
+	tests := []struct {
+		fraction float64
+		scaled   int
+		window   int
+		want     int
+	}{
+		{fraction: 0.5, scaled: 200, window: 100, want: 50},
+		{fraction: 0, scaled: 200, window: 100, want: 0},
+		{fraction: 1, scaled: 200, window: 100, want: 100},
+		{fraction: 0.3, scaled: 200, window: 100, want: 10},
+		{fraction: 0.5, scaled: 100, window: 100, want: 0},
+	}
+	for _, tc := range tests {
+		if got := focalOffset(tc.fraction, tc.scaled, tc.window); got != tc.want {
+			t.Fatalf("focalOffset(%v, %d, %d) = %d, want %d", tc.fraction, tc.scaled, tc.window, got, tc.want)
+		}
+	}
+}
+
+func TestResizeCoverKeepsFocalPoint(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(src, src.Bounds(), &image.Uniform{color.NRGBA{R: 255, G: 255, B: 255, A: 255}}, image.Point{}, draw.Src)
+	// A striped subject on the right edge gives entropy crops some detail to find.
+	for x := 30; x < 40; x++ {
+		stripe := color.NRGBA{R: 220, G: 20, B: 20, A: 255}
+		if x%2 == 0 {
+			stripe = color.NRGBA{R: 20, G: 20, B: 220, A: 255}
+		}
+		draw.Draw(src, image.Rect(x, 0, x+1, 20), &image.Uniform{stripe}, image.Point{}, draw.Src)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatalf("encode source png: %v", err)
+	}
+
+	p := New()
+	for _, gravity := range []Gravity{GravityFocal, GravityEast, GravityEntropy} {
+		result, err := p.Resize(context.Background(), buf.Bytes(), Options{
+			Width:          10,
+			Height:         10,
+			Fit:            FitCover,
+			Gravity:        gravity,
+			FocalX:         0.9,
+			FocalY:         0.5,
+			Format:         FormatPNG,
+			PNGCompression: 6,
+		})
+		if err != nil {
+			t.Fatalf("Resize(%s) returned error: %v", gravity, err)
+		}
+		decoded, err := png.Decode(bytes.NewReader(result))
+		if err != nil {
+			t.Fatalf("decode result png: %v", err)
+		}
+		if b := decoded.Bounds(); b.Dx() != 10 || b.Dy() != 10 {
+			t.Fatalf("%s: got %dx%d, want 10x10", gravity, b.Dx(), b.Dy())
+		}
+		right := color.NRGBAModel.Convert(decoded.At(9, 5)).(color.NRGBA)
+		if right.R > 240 && right.G > 240 && right.B > 240 {
+			t.Fatalf("%s: expected subject on the right edge, got %+v", gravity, right)
+		}
+	}
+}
+
+func TestResizeStopsWhenContextIsDone(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatalf("encode source png: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := New().Resize(ctx, buf.Bytes(), Options{Width: 20, Height: 20, Format: FormatPNG})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+// benchmarkSource encodes a gradient photo stand-in of the given size.
+func benchmarkSource(b *testing.B, width, height int) []byte {
+	b.Helper()
+	src := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: uint8(x + y), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		b.Fatalf("encode source png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkResizeLetterbox(b *testing.B) {
+	source := benchmarkSource(b, 2400, 1600)
+	p := New()
+	for _, format := range []Format{FormatPNG, FormatJPEG} {
+		b.Run(string(format), func(b *testing.B) {
+			opts := Options{Width: 800, Height: 800, Format: format, JPEGQuality: 80, PNGCompression: 6}
+			for i := 0; i < b.N; i++ {
+				if _, err := p.Resize(context.Background(), source, opts); err != nil {
+					b.Fatalf("Resize returned error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCanvas compares composing a letterbox canvas in libvips with the
+// previous approach of decoding, drawing and re-encoding it in Go.
+func BenchmarkCanvas(b *testing.B) {
+	stage := benchmarkSource(b, 1200, 800)
+	b.Run("libvips", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := embedCanvas(stage, 1200, 1200, color.NRGBA{}, false, PaddingSolid); err != nil {
+				b.Fatalf("embedCanvas returned error: %v", err)
+			}
+		}
+	})
+	b.Run("libvips-blur", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := embedCanvas(stage, 1200, 1200, color.NRGBA{}, false, PaddingBlur); err != nil {
+				b.Fatalf("embedCanvas returned error: %v", err)
+			}
+		}
+	})
+	b.Run("image-draw", func(b *testing.B) {
+		// embedCanvas writes an uncompressed PNG stage, so the baseline does too.
+		encoder := png.Encoder{CompressionLevel: png.NoCompression}
+		for i := 0; i < b.N; i++ {
+			decoded, err := png.Decode(bytes.NewReader(stage))
+			if err != nil {
+				b.Fatalf("decode stage: %v", err)
+			}
+			canvas := image.NewNRGBA(image.Rect(0, 0, 1200, 1200))
+			bounds := decoded.Bounds()
+			top := (1200 - bounds.Dy()) / 2
+			draw.Draw(canvas, image.Rect(0, top, bounds.Dx(), top+bounds.Dy()), decoded, bounds.Min, draw.Over)
+			var buf bytes.Buffer
+			if err := encoder.Encode(&buf, canvas); err != nil {
+				b.Fatalf("encode canvas: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,179 @@
+package processor
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <string.h>
+#include <vips/vips.h>
+
+// fars_source_size reads the dimensions of an encoded image from its header.
+static int
+fars_source_size(void *buf, size_t len, int *width, int *height)
+{
+	VipsImage *image = vips_image_new_from_buffer(buf, len, "", NULL);
+
+	if (!image) {
+		vips_error_clear();
+		return -1;
+	}
+	*width = image->Xsize;
+	*height = image->Ysize;
+	g_object_unref(image);
+	return 0;
+}
+
+// fars_describe reports the dimensions and frame count of an image opened by
+// loader, and whether it is an SVG.
+static void
+fars_describe(VipsImage *image, const char *loader, int *width, int *height, int *pages, int *vector)
+{
+	*width = image->Xsize;
+	*height = image->Ysize;
+	*pages = vips_image_get_n_pages(image);
+	*vector = strncmp(loader, "svgload", 7) == 0;
+}
+
+// fars_probe_file describes an image file. libvips opens files lazily, so
+// only the header is read.
+static int
+fars_probe_file(const char *path, int *width, int *height, int *pages, int *vector)
+{
+	const char *loader = vips_foreign_find_load(path);
+	VipsImage *image;
+
+	if (!loader || !(image = vips_image_new_from_file(path, NULL))) {
+		return -1;
+	}
+	fars_describe(image, loader, width, height, pages, vector);
+	g_object_unref(image);
+	return 0;
+}
+
+// fars_probe_buffer describes an encoded image from its header.
+static int
+fars_probe_buffer(void *buf, size_t len, int *width, int *height, int *pages, int *vector)
+{
+	const char *loader = vips_foreign_find_load_buffer(buf, len);
+	VipsImage *image;
+
+	if (!loader || !(image = vips_image_new_from_buffer(buf, len, "", NULL))) {
+		return -1;
+	}
+	fars_describe(image, loader, width, height, pages, vector);
+	g_object_unref(image);
+	return 0;
+}
+
+// fars_decode loads an image with whichever loader libvips picks and saves
+// it as an uncompressed PNG.
+static int
+fars_decode(void *buf, size_t len, void **out, size_t *outlen)
+{
+	VipsImage *image = vips_image_new_from_buffer(buf, len, "", NULL);
+	int err;
+
+	if (!image) {
+		return -1;
+	}
+	err = vips_pngsave_buffer(image, out, outlen, "compression", 0, NULL);
+	g_object_unref(image);
+	return err;
+}
+
+// fars_rasterise_svg renders an SVG at scale and saves it as an
+// uncompressed PNG.
+static int
+fars_rasterise_svg(void *buf, size_t len, double scale, void **out, size_t *outlen)
+{
+	VipsImage *image;
+	int err;
+
+	if (vips_svgload_buffer(buf, len, &image, "scale", scale, NULL)) {
+		return -1;
+	}
+	err = vips_pngsave_buffer(image, out, outlen, "compression", 0, NULL);
+	g_object_unref(image);
+	return err;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// sourceSize reads the dimensions of formats bimg cannot inspect.
+func sourceSize(source []byte) (int, int, bool) {
+	if len(source) == 0 {
+		return 0, 0, false
+	}
+	defer C.vips_thread_shutdown()
+	var width, height C.int
+	if C.fars_source_size(unsafe.Pointer(&source[0]), C.size_t(len(source)), &width, &height) != 0 {
+		return 0, 0, false
+	}
+	return int(width), int(height), true
+}
+
+// ProbeFile reads what decoding the image file at path involves from its
+// header alone. A header libvips cannot read is reported as
+// ErrUnsupportedSource.
+func ProbeFile(path string) (Probe, error) {
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	defer C.vips_thread_shutdown()
+	var width, height, pages, vector C.int
+	if C.fars_probe_file(cpath, &width, &height, &pages, &vector) != 0 {
+		return Probe{}, fmt.Errorf("%w: %v", ErrUnsupportedSource, vipsError())
+	}
+	return Probe{Width: int(width), Height: int(height), Frames: int(pages), Vector: vector != 0}, nil
+}
+
+// ProbeSource is ProbeFile for an encoded image already in memory.
+func ProbeSource(source []byte) (Probe, error) {
+	if len(source) == 0 {
+		return Probe{}, ErrUnsupportedSource
+	}
+	defer C.vips_thread_shutdown()
+	var width, height, pages, vector C.int
+	if C.fars_probe_buffer(unsafe.Pointer(&source[0]), C.size_t(len(source)), &width, &height, &pages, &vector) != 0 {
+		return Probe{}, fmt.Errorf("%w: %v", ErrUnsupportedSource, vipsError())
+	}
+	return Probe{Width: int(width), Height: int(height), Frames: int(pages), Vector: vector != 0}, nil
+}
+
+// decodeSource converts a source bimg does not recognise (e.g. JPEG XL)
+// into a PNG intermediate.
+func decodeSource(source []byte) ([]byte, error) {
+	if len(source) == 0 {
+		return nil, ErrUnsupportedSource
+	}
+	defer C.vips_thread_shutdown()
+	var (
+		out    unsafe.Pointer
+		outLen C.size_t
+	)
+	if C.fars_decode(unsafe.Pointer(&source[0]), C.size_t(len(source)), &out, &outLen) != 0 {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedSource, vipsError())
+	}
+	return takeVipsBuffer(out, outLen), nil
+}
+
+// rasteriseSVG renders an SVG at scale (see svgScale) instead of its nominal
+// size.
+func rasteriseSVG(source []byte, scale float64) ([]byte, error) {
+	if len(source) == 0 {
+		return nil, errors.New("svg source is empty")
+	}
+	defer C.vips_thread_shutdown()
+	var (
+		out    unsafe.Pointer
+		outLen C.size_t
+	)
+	if C.fars_rasterise_svg(unsafe.Pointer(&source[0]), C.size_t(len(source)), C.double(scale), &out, &outLen) != 0 {
+		return nil, vipsError()
+	}
+	return takeVipsBuffer(out, outLen), nil
+}
@@ -0,0 +1,93 @@
+package processor
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+// fars_trim removes near-uniform borders from an encoded image and saves the
+// result as an uncompressed PNG. colour holds the border colour, or NULL to
+// take it from the top-left pixel; pixels within threshold of it count as
+// border. Transparent pixels are judged as if flattened onto the colour. An
+// image that is all border is kept whole.
+static int
+fars_trim(void *buf, size_t len, double *colour, double threshold, void **out, size_t *outlen)
+{
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 5);
+	VipsArrayDouble *background;
+	double *pixel = NULL;
+	int n, left, top, width, height, err;
+
+	if (!(t[0] = vips_image_new_from_buffer(buf, len, "", NULL)) ||
+		vips_autorot(t[0], &t[1], NULL) ||
+		vips_colourspace(t[1], &t[2], VIPS_INTERPRETATION_sRGB, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+	if (!colour) {
+		if (vips_getpoint(t[2], &pixel, &n, 0, 0, NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		colour = pixel;
+	}
+
+	background = vips_array_double_new(colour, 3);
+	if (vips_image_hasalpha(t[2])) {
+		err = vips_flatten(t[2], &t[3], "background", background, NULL);
+	} else {
+		err = vips_copy(t[2], &t[3], NULL);
+	}
+	if (!err) {
+		err = vips_find_trim(t[3], &left, &top, &width, &height,
+			"background", background, "threshold", threshold, NULL);
+	}
+	vips_area_unref(VIPS_AREA(background));
+	g_free(pixel);
+
+	if (!err) {
+		if (width == 0 || height == 0) {
+			left = 0;
+			top = 0;
+			width = t[2]->Xsize;
+			height = t[2]->Ysize;
+		}
+		err = vips_extract_area(t[2], &t[4], left, top, width, height, NULL) ||
+			vips_pngsave_buffer(t[4], out, outlen, "compression", 0, NULL);
+	}
+	g_object_unref(base);
+	return err;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image/color"
+	"unsafe"
+)
+
+// trimBorders crops near-uniform borders off the encoded image in a single
+// libvips pipeline. bg is the border colour; the zero value takes it from
+// the top-left pixel.
+func trimBorders(source []byte, bg color.NRGBA, threshold float64) ([]byte, error) {
+	if len(source) == 0 {
+		return nil, errors.New("trim source is empty")
+	}
+	defer C.vips_thread_shutdown()
+
+	var (
+		out    unsafe.Pointer
+		outLen C.size_t
+		ptr    *C.double
+	)
+	colour := [3]C.double{C.double(bg.R), C.double(bg.G), C.double(bg.B)}
+	if bg != (color.NRGBA{}) {
+		ptr = &colour[0]
+	}
+	if C.fars_trim(unsafe.Pointer(&source[0]), C.size_t(len(source)), ptr, C.double(threshold), &out, &outLen) != 0 {
+		return nil, vipsError()
+	}
+	return takeVipsBuffer(out, outLen), nil
+}
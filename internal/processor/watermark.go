@@ -0,0 +1,165 @@
+package processor
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+// fars_overlay loads a watermark and prepares it for an image of width x
+// height: scale sizes it as a fraction of the width (zero keeps its own
+// size), and it is shrunk further to fit inside the margin. anchor_x and
+// anchor_y place it within the margin, from 0 (left/top) to 1
+// (right/bottom), and opacity scales its alpha. The overlay is owned by
+// scope.
+static int
+fars_overlay(VipsObject *scope, void *mark, size_t marklen, int width, int height, double scale, double anchor_x, double anchor_y, int margin, double opacity, VipsImage **overlay, int *x, int *y)
+{
+	VipsImage **t = (VipsImage **) vips_object_local_array(scope, 6);
+	double alpha[4] = {1, 1, 1, opacity};
+	double offset[4] = {0, 0, 0, 0};
+	double factor;
+	int room_width, room_height, err;
+
+	if (!(t[0] = vips_image_new_from_buffer(mark, marklen, "", NULL)) ||
+		vips_colourspace(t[0], &t[1], VIPS_INTERPRETATION_sRGB, NULL)) {
+		return -1;
+	}
+	if (vips_image_hasalpha(t[1])) {
+		err = vips_copy(t[1], &t[2], NULL);
+	} else {
+		err = vips_addalpha(t[1], &t[2], NULL);
+	}
+	if (err) {
+		return err;
+	}
+
+	room_width = VIPS_MAX(width - 2 * margin, 1);
+	room_height = VIPS_MAX(height - 2 * margin, 1);
+	factor = scale > 0 ? scale * width / t[2]->Xsize : 1;
+	factor = VIPS_MIN(factor, (double) room_width / t[2]->Xsize);
+	factor = VIPS_MIN(factor, (double) room_height / t[2]->Ysize);
+	if (factor != 1) {
+		err = vips_resize(t[2], &t[3], factor, NULL);
+	} else {
+		err = vips_copy(t[2], &t[3], NULL);
+	}
+	if (err ||
+		vips_linear(t[3], &t[4], alpha, offset, 4, NULL) ||
+		vips_cast_uchar(t[4], &t[5], NULL)) {
+		return -1;
+	}
+
+	*overlay = t[5];
+	*x = margin + VIPS_MAX((int) (anchor_x * (room_width - t[5]->Xsize) + 0.5), 0);
+	*y = margin + VIPS_MAX((int) (anchor_y * (room_height - t[5]->Ysize) + 0.5), 0);
+	return 0;
+}
+
+// fars_composite blends the overlay over in; compositing adds an alpha
+// channel, which opaque images drop again.
+static int
+fars_composite(VipsObject *scope, VipsImage *in, VipsImage *overlay, int x, int y, VipsImage **out)
+{
+	VipsImage **t = (VipsImage **) vips_object_local_array(scope, 2);
+
+	if (vips_composite2(in, overlay, &t[0], VIPS_BLEND_MODE_OVER, "x", x, "y", y, NULL)) {
+		return -1;
+	}
+	if (vips_image_hasalpha(in)) {
+		*out = t[0];
+		return 0;
+	}
+	if (vips_flatten(t[0], &t[1], NULL)) {
+		return -1;
+	}
+	*out = t[1];
+	return 0;
+}
+
+// fars_watermark composites an overlay onto an encoded image and saves the
+// result as an uncompressed PNG.
+static int
+fars_watermark(void *buf, size_t len, void *mark, size_t marklen, double scale, double anchor_x, double anchor_y, int margin, double opacity, void **out, size_t *outlen)
+{
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 4);
+	VipsImage *overlay;
+	int x, y, err;
+
+	err = !(t[0] = vips_image_new_from_buffer(buf, len, "", NULL)) ||
+		vips_colourspace(t[0], &t[1], VIPS_INTERPRETATION_sRGB, NULL) ||
+		fars_overlay(VIPS_OBJECT(base), mark, marklen, t[1]->Xsize, t[1]->Ysize,
+			scale, anchor_x, anchor_y, margin, opacity, &overlay, &x, &y) ||
+		fars_composite(VIPS_OBJECT(base), t[1], overlay, x, y, &t[2]) ||
+		vips_pngsave_buffer(t[2], out, outlen, "compression", 0, NULL);
+	g_object_unref(base);
+	return err;
+}
+
+// fars_watermark_frames composites an overlay onto every frame of an
+// animation (frames stacked at page-height). The overlay is placed on a
+// transparent frame that is repeated down the strip, so a single composite
+// covers them all. The caller owns *out.
+static int
+fars_watermark_frames(VipsImage *in, void *mark, size_t marklen, double scale, double anchor_x, double anchor_y, int margin, double opacity, VipsImage **out)
+{
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 3);
+	VipsImage *overlay;
+	int page = vips_image_get_page_height(in);
+	int x, y, err;
+
+	err = fars_overlay(VIPS_OBJECT(base), mark, marklen, in->Xsize, page,
+			scale, anchor_x, anchor_y, margin, opacity, &overlay, &x, &y) ||
+		vips_embed(overlay, &t[0], x, y, in->Xsize, page, NULL) ||
+		vips_replicate(t[0], &t[1], 1, in->Ysize / page, NULL) ||
+		fars_composite(VIPS_OBJECT(base), in, t[1], 0, 0, &t[2]);
+	if (!err) {
+		*out = t[2];
+		g_object_ref(*out);
+	}
+	g_object_unref(base);
+	return err;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// composeWatermark composites the overlay onto a rendered image in a single
+// libvips pipeline.
+func composeWatermark(source []byte, mark Watermark) ([]byte, error) {
+	if len(source) == 0 || len(mark.Image) == 0 {
+		return nil, errors.New("watermark source is empty")
+	}
+	defer C.vips_thread_shutdown()
+	var (
+		out    unsafe.Pointer
+		outLen C.size_t
+	)
+	if C.fars_watermark(unsafe.Pointer(&source[0]), C.size_t(len(source)),
+		unsafe.Pointer(&mark.Image[0]), C.size_t(len(mark.Image)),
+		C.double(mark.Scale), C.double(mark.AnchorX), C.double(mark.AnchorY),
+		C.int(mark.Margin), C.double(mark.Opacity), &out, &outLen) != 0 {
+		return nil, vipsError()
+	}
+	return takeVipsBuffer(out, outLen), nil
+}
+
+// watermarkFrames composites the overlay onto every frame of an animation.
+// The caller owns the returned image.
+func watermarkFrames(frames *C.VipsImage, mark Watermark) (*C.VipsImage, error) {
+	if len(mark.Image) == 0 {
+		return nil, errors.New("watermark source is empty")
+	}
+	var out *C.VipsImage
+	if C.fars_watermark_frames(frames, unsafe.Pointer(&mark.Image[0]), C.size_t(len(mark.Image)),
+		C.double(mark.Scale), C.double(mark.AnchorX), C.double(mark.AnchorY),
+		C.int(mark.Margin), C.double(mark.Opacity), &out) != 0 {
+		return nil, vipsError()
+	}
+	return out, nil
+}
@@ -10,9 +10,11 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.uber.org/fx"
 
+	"fars/internal/admission"
 	"fars/internal/cache"
 	"fars/internal/config"
 	"fars/internal/httpapi"
+	"fars/internal/locker"
 )
 
 // Module exposes fx providers for the HTTP server.
@@ -29,6 +31,8 @@ type Params struct {
 	Config    *config.Config
 	Engine    *gin.Engine
 	Cache     *cache.Manager
+	Flights   *locker.Group
+	Admission *admission.Controller
 	Logger    *slog.Logger
 }
 
@@ -59,6 +63,7 @@ func RegisterLifecycle(p Params) {
 			cleanupCtx, cancel := context.WithCancel(context.Background())
 			cleanupCancel = cancel
 			p.Cache.StartCleanup(cleanupCtx)
+			p.Cache.StartStatsLog(cleanupCtx)
 			go func() {
 				if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 					p.Logger.Error("http server failure", slog.Any("error", err))
@@ -71,6 +76,23 @@ func RegisterLifecycle(p Params) {
 			if cleanupCancel != nil {
 				cleanupCancel()
 			}
+			stats := p.Flights.Stats()
+			p.Logger.Info("request coalescing stats",
+				slog.Int64("leaders", stats.Leaders),
+				slog.Int64("coalesced", stats.Coalesced),
+				slog.Int64("canceled", stats.Canceled),
+				slog.Int64("timed_out", stats.TimedOut))
+			admitted := p.Admission.Stats()
+			p.Logger.Info("processing admission stats",
+				slog.Int64("admitted", admitted.Admitted),
+				slog.Int64("rejected", admitted.Rejected),
+				slog.Int64("timed_out", admitted.TimedOut))
+			if memory := p.Cache.MemoryStats(); memory.Hits+memory.Misses > 0 {
+				p.Logger.Info("memory cache stats",
+					slog.Uint64("hits", memory.Hits),
+					slog.Uint64("misses", memory.Misses),
+					slog.Int("entries", memory.Entries))
+			}
 			return srv.Shutdown(ctx)
 		},
 	})
@@ -2,6 +2,7 @@ package configutil
 
 import (
 	"fmt"
+	"image/color"
 	"regexp"
 	"strconv"
 	"strings"
@@ -101,3 +102,226 @@ func sizeMultiplier(unit string) (int64, bool) {
 		return 0, false
 	}
 }
+
+// ParseFocalPoint parses an "fx,fy" pair of fractions within [0,1].
+func ParseFocalPoint(raw string) (float64, float64, error) {
+	xRaw, yRaw, ok := strings.Cut(strings.TrimSpace(raw), ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid focal point %q: expected fx,fy", raw)
+	}
+	x, err := strconv.ParseFloat(strings.TrimSpace(xRaw), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse focal x %q: %w", xRaw, err)
+	}
+	y, err := strconv.ParseFloat(strings.TrimSpace(yRaw), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse focal y %q: %w", yRaw, err)
+	}
+	// Negated so NaN fails too; infinities are out of range anyway.
+	if !(x >= 0 && x <= 1 && y >= 0 && y <= 1) {
+		return 0, 0, fmt.Errorf("focal point %q must be within 0-1", raw)
+	}
+	return x, y, nil
+}
+
+// ParseSize parses a "WxH" geometry where either side may be empty or zero
+// (e.g. "200x200", "200x", "x120").
+func ParseSize(raw string) (int, int, error) {
+	wRaw, hRaw, ok := strings.Cut(strings.ToLower(strings.TrimSpace(raw)), "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid size %q: expected WxH", raw)
+	}
+	var dims [2]int
+	for i, part := range []string{wRaw, hRaw} {
+		if part == "" {
+			continue
+		}
+		value, err := strconv.Atoi(part)
+		if err != nil || value < 0 {
+			return 0, 0, fmt.Errorf("invalid size %q", raw)
+		}
+		dims[i] = value
+	}
+	if dims[0] == 0 && dims[1] == 0 {
+		return 0, 0, fmt.Errorf("size %q needs a width or height", raw)
+	}
+	return dims[0], dims[1], nil
+}
+
+// ParseColor parses a hex colour: "rgb", "rgba", "rrggbb" or "rrggbbaa",
+// optionally prefixed with "#". Colours without alpha are opaque.
+func ParseColor(raw string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(raw), "#")
+	if len(hex) == 3 || len(hex) == 4 {
+		var expanded strings.Builder
+		for _, r := range hex {
+			expanded.WriteRune(r)
+			expanded.WriteRune(r)
+		}
+		hex = expanded.String()
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid colour %q: expected hex rgb, rgba, rrggbb or rrggbbaa", raw)
+	}
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid colour %q: %w", raw, err)
+	}
+	return color.NRGBA{R: uint8(value >> 24), G: uint8(value >> 16), B: uint8(value >> 8), A: uint8(value)}, nil
+}
+
+// ParseUpscale parses an upscaling policy: "pad", "none", "always", or a
+// maximum factor such as "2" or "1.5x", which is "always" capped at that
+// factor. The returned limit is zero unless a factor was given.
+func ParseUpscale(raw string) (string, float64, error) {
+	value := strings.ToLower(strings.TrimSpace(raw))
+	switch value {
+	case "pad", "none", "always":
+		return value, 0, nil
+	}
+	factor, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+	if err != nil || !(factor >= 1) || factor > 100 {
+		return "", 0, fmt.Errorf("invalid upscale policy %q: expected pad, none, always or a factor between 1 and 100", raw)
+	}
+	return "always", factor, nil
+}
+
+// OpNames lists the operations ParseOps accepts, in the order they apply.
+var OpNames = []string{"rotate", "flip", "flop", "grayscale", "tint", "brightness", "contrast", "blur", "sharpen"}
+
+// Ops is a parsed operations list. Zero fields were not requested.
+type Ops struct {
+	Rotate     int  // clockwise degrees: 90, 180 or 270
+	Flip       bool // mirror top to bottom
+	Flop       bool // mirror left to right
+	Grayscale  bool
+	Tint       color.NRGBA // opaque tint colour
+	Brightness float64     // multiplier, 1 keeps the image
+	Contrast   float64     // multiplier around mid-grey, 1 keeps the image
+	Blur       float64     // gaussian sigma in output pixels
+	Sharpen    float64     // sharpening sigma
+}
+
+// ParseOps parses a comma separated operations list such as
+// "grayscale,blur:4,rotate:90". Each operation may appear once; they always
+// apply in OpNames order, whatever the order in raw. "greyscale" is accepted
+// for grayscale and sharpen defaults to a sigma of 1.
+func ParseOps(raw string) (Ops, error) {
+	var ops Ops
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(entry, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if name == "greyscale" {
+			name = "grayscale"
+		}
+		if seen[name] {
+			return Ops{}, fmt.Errorf("duplicate operation %q", name)
+		}
+		seen[name] = true
+		if hasValue && (name == "flip" || name == "flop" || name == "grayscale") {
+			return Ops{}, fmt.Errorf("operation %s takes no value", name)
+		}
+		var err error
+		switch name {
+		case "flip":
+			ops.Flip = true
+		case "flop":
+			ops.Flop = true
+		case "grayscale":
+			ops.Grayscale = true
+		case "rotate":
+			degrees, err := strconv.Atoi(value)
+			if err != nil || degrees%90 != 0 {
+				return Ops{}, fmt.Errorf("invalid rotate %q: expected a multiple of 90", value)
+			}
+			ops.Rotate = (degrees%360 + 360) % 360
+		case "tint":
+			if ops.Tint, err = ParseColor(value); err != nil {
+				return Ops{}, fmt.Errorf("invalid tint: %w", err)
+			}
+			ops.Tint.A = 255
+		case "brightness":
+			ops.Brightness, err = parseOpValue(name, value, 4)
+		case "contrast":
+			ops.Contrast, err = parseOpValue(name, value, 4)
+		case "blur":
+			ops.Blur, err = parseOpValue(name, value, 100)
+		case "sharpen":
+			ops.Sharpen = 1
+			if hasValue {
+				ops.Sharpen, err = parseOpValue(name, value, 10)
+			}
+		default:
+			return Ops{}, fmt.Errorf("unknown operation %q", name)
+		}
+		if err != nil {
+			return Ops{}, err
+		}
+	}
+	return ops, nil
+}
+
+func parseOpValue(name, raw string, limit float64) (float64, error) {
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || !(value > 0) || value > limit {
+		return 0, fmt.Errorf("invalid %s %q: expected a number above 0 and up to %g", name, raw, limit)
+	}
+	return value, nil
+}
+
+// Names returns the requested operations in OpNames order.
+func (o Ops) Names() []string {
+	var names []string
+	for _, part := range o.parts() {
+		name, _, _ := strings.Cut(part, ":")
+		names = append(names, name)
+	}
+	return names
+}
+
+// String returns the canonical form of the list, the same for every
+// spelling and order of the same operations.
+func (o Ops) String() string {
+	return strings.Join(o.parts(), ",")
+}
+
+func (o Ops) parts() []string {
+	var parts []string
+	if o.Rotate != 0 {
+		parts = append(parts, fmt.Sprintf("rotate:%d", o.Rotate))
+	}
+	if o.Flip {
+		parts = append(parts, "flip")
+	}
+	if o.Flop {
+		parts = append(parts, "flop")
+	}
+	if o.Grayscale {
+		parts = append(parts, "grayscale")
+	}
+	if o.Tint != (color.NRGBA{}) {
+		parts = append(parts, fmt.Sprintf("tint:%02x%02x%02x", o.Tint.R, o.Tint.G, o.Tint.B))
+	}
+	if o.Brightness != 0 {
+		parts = append(parts, fmt.Sprintf("brightness:%g", o.Brightness))
+	}
+	if o.Contrast != 0 {
+		parts = append(parts, fmt.Sprintf("contrast:%g", o.Contrast))
+	}
+	if o.Blur != 0 {
+		parts = append(parts, fmt.Sprintf("blur:%g", o.Blur))
+	}
+	if o.Sharpen != 0 {
+		parts = append(parts, fmt.Sprintf("sharpen:%g", o.Sharpen))
+	}
+	return parts
+}
@@ -0,0 +1,65 @@
+package urlsign
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	signed, err := New("secret").Sign("https://img.example.com/resize/200x200c/img/p/1.jpg?gravity=north")
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("parse signed url: %v", err)
+	}
+	if u.Query().Get(SignatureParam) == "" {
+		t.Fatalf("expected signature in %s", signed)
+	}
+	secrets := [][]byte{[]byte("next"), []byte("secret")}
+	if err := Verify(u.Path, u.Query(), secrets, time.Now()); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	tampered := u.Query()
+	tampered.Set("gravity", "south")
+	if err := Verify(u.Path, tampered, secrets, time.Now()); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected invalid signature for tampered query, got %v", err)
+	}
+	if err := Verify("/resize/400x400c/img/p/1.jpg", u.Query(), secrets, time.Now()); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected invalid signature for tampered path, got %v", err)
+	}
+	if err := Verify(u.Path, u.Query(), [][]byte{[]byte("other")}, time.Now()); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected invalid signature for unknown secret, got %v", err)
+	}
+	if err := Verify(u.Path, url.Values{}, secrets, time.Now()); !errors.Is(err, ErrMissingSignature) {
+		t.Fatalf("expected missing signature, got %v", err)
+	}
+}
+
+func TestSignWithExpiry(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	signed, err := New("secret").SignWithExpiry("/resize/100x/a.jpg", now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("SignWithExpiry: %v", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("parse signed url: %v", err)
+	}
+	secrets := [][]byte{[]byte("secret")}
+	if err := Verify(u.Path, u.Query(), secrets, now); err != nil {
+		t.Fatalf("Verify before expiry: %v", err)
+	}
+	if err := Verify(u.Path, u.Query(), secrets, now.Add(2*time.Hour)); !errors.Is(err, ErrExpired) {
+		t.Fatalf("expected expiry error, got %v", err)
+	}
+	extended := u.Query()
+	extended.Set(ExpiresParam, "9999999999")
+	if err := Verify(u.Path, extended, secrets, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected invalid signature for extended expiry, got %v", err)
+	}
+}